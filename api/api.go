@@ -0,0 +1,130 @@
+// Package api serves PUT and GET of a node over HTTP.
+package api
+
+import (
+	"context"
+	"d7024e/kademlia"
+	"d7024e/metrics"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Timeouts of the HTTP API, a request may carry a value of the maximum object size
+// and its reply waits for a PUT or GET across the network
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 2 * time.Minute
+	writeTimeout      = 2 * time.Minute
+	idleTimeout       = time.Minute
+)
+
+// Server handles the HTTP API of a node:
+//
+//	POST /objects        stores the body and returns its hash in the Location header
+//	GET  /objects/{hash} returns the stored bytes
+//	GET  /metrics        returns the metrics of the node in the Prometheus text format
+type Server struct {
+	kademlia *kademlia.Kademlia
+	mux      *http.ServeMux
+	http     *http.Server
+}
+
+// NewServer creates a Server for the node
+func NewServer(k *kademlia.Kademlia) *Server {
+	server := &Server{kademlia: k, mux: http.NewServeMux()}
+	server.mux.HandleFunc("POST /objects", server.handlePut)
+	server.mux.HandleFunc("GET /objects/{hash}", server.handleGet)
+	server.mux.HandleFunc("GET /metrics", server.handleMetrics)
+	server.http = &http.Server{
+		Handler:           server,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	return server
+}
+
+// ServeHTTP implements http.Handler
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on the address until the server fails or is shut down,
+// it returns nil once Shutdown is called
+func (server *Server) ListenAndServe(address string) error {
+	slog.Info("Serving the HTTP API", "address", address)
+	server.http.Addr = address
+	if err := server.http.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests and waits until the requests being served finish or the context ends
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.http.Shutdown(ctx)
+}
+
+// handlePut stores the request body with Kademlia.Put, it answers 201 with the hash
+// if a majority of the k closest nodes stored it and 503 otherwise
+func (server *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	limit := server.kademlia.Network.ObjectSizeLimit()
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		err = kademlia.ErrObjectTooLarge
+	}
+	var key kademlia.KademliaID
+	if err == nil {
+		key, _, err = server.kademlia.Put(r.Context(), data)
+	}
+
+	switch {
+	case err == nil:
+		w.Header().Set("Location", "/objects/"+key.String())
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, key.String())
+	case errors.Is(err, kademlia.ErrObjectTooLarge):
+		http.Error(w, fmt.Sprintf("object is larger than the maximum object size of %d bytes", limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, kademlia.ErrNotEnoughReplicas):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, kademlia.ErrEmptyData):
+		http.Error(w, "empty body", http.StatusBadRequest)
+	default:
+		http.Error(w, "error reading body", http.StatusBadRequest)
+	}
+}
+
+// handleGet looks up the value of the hash with Kademlia.Get and answers 404 if no node has it
+func (server *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	hash, err := kademlia.ParseKademliaID(r.PathValue("hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("hash must be %d hex characters", kademlia.IDLength*2), http.StatusBadRequest)
+		return
+	}
+
+	data, _, err := server.kademlia.Get(r.Context(), *hash)
+	if errors.Is(err, kademlia.ErrDataNotFound) {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// handleMetrics writes the metrics of the node for Prometheus to scrape
+func (server *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := server.kademlia.WriteMetrics(w); err != nil {
+		slog.Debug("Error writing metrics", "err", err)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"d7024e/kademlia"
+	"d7024e/memnet"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memnetNodes starts n nodes on an in-memory network that all joined through the first one,
+// configure is called on every node before it starts listening
+func memnetNodes(t *testing.T, n int, configure ...func(*kademlia.Kademlia)) []*kademlia.Kademlia {
+	network := memnet.New(1)
+	nodes := make([]*kademlia.Kademlia, n)
+	for i := range nodes {
+		address := fmt.Sprintf("10.0.0.%d:8000", i+1)
+		conn, err := network.Listen(address)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		k := kademlia.NewKademliaWithTransport(kademlia.NewRoutingTable(kademlia.NewContact(kademlia.NewRandomKademliaID(), address)), conn)
+		k.Network.Timeout = 100 * time.Millisecond
+		k.Network.Retries = 0
+		for _, fn := range configure {
+			fn(k)
+		}
+		go k.ListenActionChannel()
+		go k.Network.Listen(k)
+		nodes[i] = k
+	}
+	for _, k := range nodes[1:] {
+		if _, err := k.Join(context.Background(), []kademlia.Contact{nodes[0].RoutingTable.Me}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	return nodes
+}
+
+func TestServer_PutThenGetFromOtherNode(t *testing.T) {
+	// With k = 5 every node except the one handling the PUT stores the value
+	nodes := memnetNodes(t, kademlia.DefaultK+1)
+	data := []byte("hello over http")
+
+	put := httptest.NewRecorder()
+	NewServer(nodes[1]).ServeHTTP(put, httptest.NewRequest(http.MethodPost, "/objects", bytes.NewReader(data)))
+
+	hash := kademlia.HashData(data).String()
+	if put.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", put.Code, put.Body.String())
+	}
+	if location := put.Header().Get("Location"); location != "/objects/"+hash {
+		t.Errorf("Expected Location /objects/%s, got %s", hash, location)
+	}
+
+	get := httptest.NewRecorder()
+	NewServer(nodes[kademlia.DefaultK]).ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/objects/"+hash, nil))
+
+	if get.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", get.Code, get.Body.String())
+	}
+	if body, _ := io.ReadAll(get.Body); !bytes.Equal(body, data) {
+		t.Errorf("Expected %q, got %q", data, body)
+	}
+}
+
+func TestServer_ShutdownEndsListenAndServe(t *testing.T) {
+	server := NewServer(memnetNodes(t, 1)[0])
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe("127.0.0.1:0") }()
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected ListenAndServe to return nil after Shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ListenAndServe to return after Shutdown")
+	}
+}
+
+func TestServer_GetReturnsNotFound(t *testing.T) {
+	nodes := memnetNodes(t, 3)
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[0]).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/objects/"+kademlia.NewRandomKademliaID().String(), nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", recorder.Code)
+	}
+}
+
+func TestServer_GetRejectsInvalidHash(t *testing.T) {
+	nodes := memnetNodes(t, 1)
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[0]).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/objects/not-a-hash", nil))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", recorder.Code)
+	}
+}
+
+func TestServer_GetAcceptsUppercaseHash(t *testing.T) {
+	nodes := memnetNodes(t, 1)
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[0]).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/objects/"+strings.ToUpper(kademlia.NewRandomKademliaID().String()), nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", recorder.Code)
+	}
+}
+
+func TestServer_PutWithoutReplicasReturnsServiceUnavailable(t *testing.T) {
+	nodes := memnetNodes(t, 1)
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[0]).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/objects", strings.NewReader("data")))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", recorder.Code)
+	}
+}
+
+func TestServer_PutRejectsObjectsAboveMaxObjectSize(t *testing.T) {
+	nodes := memnetNodes(t, 1, func(k *kademlia.Kademlia) { k.Network.MaxObjectSize = 4 })
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[0]).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/objects", strings.NewReader("too large")))
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", recorder.Code)
+	}
+}
+
+func TestServer_RejectsOtherMethods(t *testing.T) {
+	nodes := memnetNodes(t, 1)
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[0]).ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/objects", nil))
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", recorder.Code)
+	}
+}
+
+func TestServer_ServesMetrics(t *testing.T) {
+	nodes := memnetNodes(t, 2)
+	recorder := httptest.NewRecorder()
+
+	NewServer(nodes[1]).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %s", contentType)
+	}
+	// The node pinged the first node when it joined
+	if body := recorder.Body.String(); !strings.Contains(body, `kademlia_rpcs_sent_total{type="PING"}`) {
+		t.Errorf("Expected the PINGs sent by the join, got\n%s", body)
+	}
+}
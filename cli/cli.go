@@ -2,14 +2,13 @@ package cli
 
 import (
 	"bufio"
-	"crypto/sha1"
+	"context"
 	"d7024e/kademlia"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
-	"sync"
 )
 
 type CLI struct {
@@ -47,10 +46,14 @@ func (cli *CLI) ReadUserInput() (string, string, error) {
 	return strings.ToUpper(command), arg, nil
 }
 
-// UserInputHandler continuously handles user input until the "EXIT" command is received
+// UserInputHandler continuously handles user input until the "EXIT" command is received,
+// it returns false if the input ends before that
 func (cli *CLI) UserInputHandler() bool {
 	for {
 		command, arg, err := cli.ReadUserInput()
+		if errors.Is(err, io.EOF) {
+			return false
+		}
 		if err != nil {
 			fmt.Fprintln(cli.writer, err)
 			continue
@@ -63,13 +66,13 @@ func (cli *CLI) UserInputHandler() bool {
 
 // handleCommand processes individual commands entered by the user
 func (cli *CLI) handleCommand(command, arg string) bool {
-	fmt.Fprintf(cli.writer, "You entered: command=%s, argument=%s\n", command, arg)
-
 	switch command {
 	case "GET":
 		cli.handleGet(arg)
 	case "PUT":
 		cli.handlePut(arg)
+	case "FORGET":
+		cli.handleForget(arg)
 	case "EXIT":
 		fmt.Fprintln(cli.writer, "Exiting program.")
 		return true
@@ -88,9 +91,18 @@ func (cli *CLI) handleGet(arg string) {
 		return
 	}
 
-	targetContact := cli.CreateTargetContact(arg)
-	foundOnContact, foundData := cli.performNodeLookup(targetContact, arg)
-	cli.HandleLookupResult(foundOnContact, foundData)
+	hash, err := kademlia.ParseKademliaID(arg)
+	if err != nil {
+		fmt.Fprintln(cli.writer, "error: Kademlia ID must be hex")
+		return
+	}
+
+	data, result, err := cli.kademlia.Get(context.Background(), *hash)
+	if err != nil && !errors.Is(err, kademlia.ErrDataNotFound) {
+		fmt.Fprintln(cli.writer, "Error:", err)
+		return
+	}
+	cli.HandleLookupResult(result.FoundOn, data)
 }
 
 // ValidateGetArg ensures the argument for GET is valid
@@ -106,17 +118,6 @@ func (cli *CLI) ValidateGetArg(arg string) error {
 	return nil
 }
 
-// CreateTargetContact creates a target Kademlia contact for lookup
-func (cli *CLI) CreateTargetContact(arg string) kademlia.Contact {
-	return kademlia.NewContact(kademlia.NewKademliaID(arg), "")
-}
-
-// performNodeLookup performs a node lookup using the Kademlia instance
-func (cli *CLI) performNodeLookup(targetContact kademlia.Contact, arg string) (kademlia.Contact, []byte) {
-	_, foundOnContact, foundData := cli.kademlia.NodeLookup(&targetContact, arg)
-	return foundOnContact, foundData
-}
-
 // HandleLookupResult prints the result of the lookup
 func (cli *CLI) HandleLookupResult(foundOnContact kademlia.Contact, foundData []byte) {
 	if foundData != nil {
@@ -127,72 +128,65 @@ func (cli *CLI) HandleLookupResult(foundOnContact kademlia.Contact, foundData []
 	}
 }
 
-// handlePut handles the "PUT" command by storing data on contacts
-func (cli *CLI) handlePut(arg string) {
-	if err := cli.ValidatePutArg(arg); err != nil {
+// handleForget handles the "FORGET" command by no longer refreshing data this node has PUT
+func (cli *CLI) handleForget(arg string) {
+	if err := cli.ValidateForgetArg(arg); err != nil {
 		fmt.Fprintln(cli.writer, err)
 		return
 	}
 
-	data := []byte(arg)
-	kadId, targetContact := cli.CreatePutTargetContact(data)
-	contacts := cli.performPutNodeLookup(targetContact)
-	successCount := cli.storeDataOnContacts(kadId, data, contacts)
-	cli.HandleStoreResult(successCount, len(contacts), kadId.String())
+	hash := strings.ToLower(arg)
+	if cli.kademlia.Forget(hash) {
+		fmt.Fprintln(cli.writer, "Stopped refreshing data with hash: "+hash)
+	} else {
+		fmt.Fprintln(cli.writer, "Error: No data with hash "+hash+" was PUT from this node.")
+	}
 }
 
-// ValidatePutArg ensures the argument for PUT is valid
-func (cli *CLI) ValidatePutArg(arg string) error {
+// ValidateForgetArg ensures the argument for FORGET is valid
+func (cli *CLI) ValidateForgetArg(arg string) error {
 	if arg == "" {
-		return fmt.Errorf("error: No argument provided for PUT")
+		return fmt.Errorf("error: No argument provided for FORGET")
+	}
+
+	if len(arg) != 40 { // Kademlia ID length
+		return fmt.Errorf("error: Invalid Kademlia ID length")
+	}
+
+	if _, err := kademlia.ParseKademliaID(arg); err != nil {
+		return fmt.Errorf("error: Kademlia ID must be hex")
 	}
+
 	return nil
 }
 
-// CreatePutTargetContact creates a target Kademlia contact for storing data
-func (cli *CLI) CreatePutTargetContact(data []byte) (*kademlia.KademliaID, kademlia.Contact) {
-	hasher := sha1.New()
-	hasher.Write(data)
-	hash := hasher.Sum(nil)
-	hashString := hex.EncodeToString(hash)
-	kadId := kademlia.NewKademliaID(hashString)
-	targetContact := kademlia.NewContact(kadId, "")
-	return kadId, targetContact
-}
+// handlePut handles the "PUT" command by storing data on contacts
+func (cli *CLI) handlePut(arg string) {
+	if err := cli.ValidatePutArg(arg); err != nil {
+		fmt.Fprintln(cli.writer, err)
+		return
+	}
 
-// performPutNodeLookup performs a node lookup for storing data
-func (cli *CLI) performPutNodeLookup(targetContact kademlia.Contact) []kademlia.Contact {
-	contacts, _, _ := cli.kademlia.NodeLookup(&targetContact, "")
-	return contacts
+	key, result, err := cli.kademlia.Put(context.Background(), []byte(arg))
+	if err != nil && !errors.Is(err, kademlia.ErrNotEnoughReplicas) {
+		fmt.Fprintln(cli.writer, "Error:", err)
+		return
+	}
+	for _, contact := range result.StoredOn {
+		fmt.Fprintln(cli.writer, "Stored data with key:", key.String(), "on contact:", contact.String())
+	}
+	cli.HandleStoreResult(len(result.StoredOn), len(result.Contacts), key.String())
 }
 
-// storeDataOnContacts stores data on the provided contacts
-func (cli *CLI) storeDataOnContacts(kadId *kademlia.KademliaID, data []byte, contacts []kademlia.Contact) int {
-	resultChan := make(chan bool, len(contacts))
-	var wg sync.WaitGroup
-
-	for _, contact := range contacts {
-		wg.Add(1)
-		go func(contact kademlia.Contact) {
-			defer wg.Done()
-			result := cli.kademlia.Network.SendStoreMessage(&cli.kademlia.RoutingTable.Me, &contact, kadId, data)
-			fmt.Fprintln(cli.writer, "Storing data with key:", kadId.String(), "on contact:", contact.String())
-			resultChan <- result
-		}(contact)
-	}
-
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
-
-	successCount := 0
-	for success := range resultChan {
-		if success {
-			successCount++
-		}
+// ValidatePutArg ensures the argument for PUT is valid
+func (cli *CLI) ValidatePutArg(arg string) error {
+	if arg == "" {
+		return fmt.Errorf("error: No argument provided for PUT")
 	}
-	return successCount
+	if cli.kademlia != nil && cli.kademlia.Network != nil && len(arg) > cli.kademlia.Network.ObjectSizeLimit() {
+		return fmt.Errorf("error: PUT data is larger than the maximum object size of %d bytes", cli.kademlia.Network.ObjectSizeLimit())
+	}
+	return nil
 }
 
 // HandleStoreResult prints the result of storing data
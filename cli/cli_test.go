@@ -62,7 +62,7 @@ func TestHandleGet_InvalidArgumentLength(t *testing.T) {
 	}
 }
 
-func TestHandleGet_EmptyArgument(t *testing.T) {
+func TestHandleGet_NonHexArgument(t *testing.T) {
 	k := &kademlia.Kademlia{}
 	writer := &strings.Builder{}
 	cli := &CLI{
@@ -71,21 +71,30 @@ func TestHandleGet_EmptyArgument(t *testing.T) {
 		writer:   writer,
 	}
 
-	arg := ""
+	arg := "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz"
 	cli.handleGet(arg)
 
-	expectedOutput := "error: No argument provided for GET"
+	expectedOutput := "error: Kademlia ID must be hex"
 	if !strings.Contains(writer.String(), expectedOutput) {
 		t.Errorf("Expected output to contain '%s', got '%s'", expectedOutput, writer.String())
 	}
 }
-func TestCreateTargetContact_ValidArgument(t *testing.T) {
-	cli := &CLI{}
-	arg := "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
-	contact := cli.CreateTargetContact(arg)
 
-	if contact.ID.String() != arg {
-		t.Errorf("Expected contact ID to be '%s', got '%s'", arg, contact.ID.String())
+func TestHandleGet_EmptyArgument(t *testing.T) {
+	k := &kademlia.Kademlia{}
+	writer := &strings.Builder{}
+	cli := &CLI{
+		kademlia: k,
+		reader:   strings.NewReader(""),
+		writer:   writer,
+	}
+
+	arg := ""
+	cli.handleGet(arg)
+
+	expectedOutput := "error: No argument provided for GET"
+	if !strings.Contains(writer.String(), expectedOutput) {
+		t.Errorf("Expected output to contain '%s', got '%s'", expectedOutput, writer.String())
 	}
 }
 func TestHandleLookupResult_DataFound(t *testing.T) {
@@ -134,49 +143,6 @@ func TestValidatePutArg_ValidArgument(t *testing.T) {
 	}
 }
 
-/*func TestCreatePutTargetContact_ValidData(t *testing.T) {
-	cli := &CLI{}
-	data := []byte("some data")
-	kadId, contact := cli.CreatePutTargetContact(data)
-
-	expectedKadId := "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
-	if kadId.String() != expectedKadId {
-		t.Errorf("Expected Kademlia ID to be '%s', got '%s'", expectedKadId, kadId.String())
-	}
-	if contact.ID.String() != expectedKadId {
-		t.Errorf("Expected contact ID to be '%s', got '%s'", expectedKadId, contact.ID.String())
-	}
-}*/
-
-func TestCreatePutTargetContact_EmptyData(t *testing.T) {
-	cli := &CLI{}
-	data := []byte("")
-	kadId, contact := cli.CreatePutTargetContact(data)
-
-	expectedKadId := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
-	if kadId.String() != expectedKadId {
-		t.Errorf("Expected Kademlia ID to be '%s', got '%s'", expectedKadId, kadId.String())
-	}
-	if contact.ID.String() != expectedKadId {
-		t.Errorf("Expected contact ID to be '%s', got '%s'", expectedKadId, contact.ID.String())
-	}
-}
-
-/*
-	func TestCreatePutTargetContact_SpecialCharacters(t *testing.T) {
-		cli := &CLI{}
-		data := []byte("!@#$%^&*()")
-		kadId, contact := cli.CreatePutTargetContact(data)
-
-		expectedKadId := "d3486ae9136e7856bc42212385ea797094475802"
-		if kadId.String() != expectedKadId {
-			t.Errorf("Expected Kademlia ID to be '%s', got '%s'", expectedKadId, kadId.String())
-		}
-		if contact.ID.String() != expectedKadId {
-			t.Errorf("Expected contact ID to be '%s', got '%s'", expectedKadId, contact.ID.String())
-		}
-	}
-*/
 func TestReadUserInput_ValidCommandAndArgument(t *testing.T) {
 	reader := strings.NewReader("GET some_data\n")
 	writer := &strings.Builder{}
@@ -255,12 +221,24 @@ func TestUserInputHandler_ExitCommand(t *testing.T) {
 
 	cli.UserInputHandler()
 
-	expectedOutput := ">You entered: command=EXIT, argument=\nExiting program.\n"
+	expectedOutput := ">Exiting program.\n"
 	if writer.String() != expectedOutput {
 		t.Errorf("Expected output to be '%s', got '%s'", expectedOutput, writer.String())
 	}
 }
 
+func TestUserInputHandler_ReturnsFalseWhenInputEnds(t *testing.T) {
+	writer := &strings.Builder{}
+	cli := &CLI{reader: strings.NewReader(""), writer: writer}
+
+	if cli.UserInputHandler() {
+		t.Error("Expected false when the input ends without EXIT")
+	}
+	if writer.String() != ">" {
+		t.Errorf("Expected only the prompt, got '%s'", writer.String())
+	}
+}
+
 func TestHandleStoreResult_SuccessfulStorage(t *testing.T) {
 	writer := &strings.Builder{}
 	cli := &CLI{writer: writer}
@@ -296,3 +274,47 @@ func TestHandleStoreResult_ExactHalfSuccess(t *testing.T) {
 		t.Errorf("Expected output to be '%s', got '%s'", expectedOutput, writer.String())
 	}
 }
+
+func TestHandleForget_PublishedHash(t *testing.T) {
+	k := &kademlia.Kademlia{}
+	k.Publish("a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", []byte("some data"))
+	writer := &strings.Builder{}
+	cli := &CLI{kademlia: k, writer: writer}
+
+	cli.handleForget("A94A8FE5CCB19BA61C4C0873D391E987982FBBD3")
+
+	expectedOutput := "Stopped refreshing data with hash: a94a8fe5ccb19ba61c4c0873d391e987982fbbd3\n"
+	if writer.String() != expectedOutput {
+		t.Errorf("Expected output to be '%s', got '%s'", expectedOutput, writer.String())
+	}
+}
+
+func TestHandleForget_UnknownHash(t *testing.T) {
+	writer := &strings.Builder{}
+	cli := &CLI{kademlia: &kademlia.Kademlia{}, writer: writer}
+
+	cli.handleForget("a94a8fe5ccb19ba61c4c0873d391e987982fbbd3")
+
+	expectedOutput := "Error: No data with hash a94a8fe5ccb19ba61c4c0873d391e987982fbbd3 was PUT from this node.\n"
+	if writer.String() != expectedOutput {
+		t.Errorf("Expected output to be '%s', got '%s'", expectedOutput, writer.String())
+	}
+}
+
+func TestValidateForgetArg_EmptyArgument(t *testing.T) {
+	cli := &CLI{}
+	err := cli.ValidateForgetArg("")
+
+	if err == nil || err.Error() != "error: No argument provided for FORGET" {
+		t.Errorf("Expected error 'error: No argument provided for FORGET', got '%v'", err)
+	}
+}
+
+func TestValidateForgetArg_NonHexArgument(t *testing.T) {
+	cli := &CLI{}
+	err := cli.ValidateForgetArg("zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz")
+
+	if err == nil || err.Error() != "error: Kademlia ID must be hex" {
+		t.Errorf("Expected error 'error: Kademlia ID must be hex', got '%v'", err)
+	}
+}
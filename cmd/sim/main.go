@@ -0,0 +1,54 @@
+// Command sim runs a Kademlia network of many nodes in one process and prints lookup statistics.
+//
+//	go run ./cmd/sim -nodes 1000 -scenario join,put,get,churn,check
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"d7024e/sim"
+)
+
+func main() {
+	options := sim.Default()
+	flags := flag.NewFlagSet("sim", flag.ExitOnError)
+	flags.IntVar(&options.Nodes, "nodes", options.Nodes, "nodes started by the join step")
+	flags.Int64Var(&options.Seed, "seed", options.Seed, "seed of node IDs, keys and network faults")
+	flags.IntVar(&options.K, "k", options.K, "replication parameter of every node")
+	flags.IntVar(&options.Alpha, "alpha", options.Alpha, "parallel RPCs of every lookup")
+	flags.DurationVar(&options.Timeout, "rpc-timeout", options.Timeout, "RPC timeout of every node")
+	flags.IntVar(&options.Retries, "rpc-retries", options.Retries, "RPC retries of every node")
+	flags.DurationVar(&options.Latency, "latency", options.Latency, "one-way latency of every datagram")
+	flags.DurationVar(&options.Jitter, "jitter", options.Jitter, "random extra latency of every datagram")
+	flags.Float64Var(&options.Loss, "loss", options.Loss, "fraction of datagrams dropped")
+	flags.Float64Var(&options.Reordering, "reordering", options.Reordering, "fraction of datagrams delivered out of order")
+	flags.IntVar(&options.Concurrency, "concurrency", options.Concurrency, "joins, PUTs or GETs running at the same time")
+	flags.IntVar(&options.Puts, "puts", options.Puts, "values stored by the put step")
+	flags.IntVar(&options.ValueSize, "value-size", options.ValueSize, "size of every stored value in bytes")
+	flags.IntVar(&options.Gets, "gets", options.Gets, "values fetched by the get step")
+	flags.IntVar(&options.Lookups, "lookups", options.Lookups, "random node IDs looked up by the lookup step")
+	flags.Float64Var(&options.Churn, "churn", options.Churn, "fraction of the nodes replaced by the churn step")
+	flags.BoolVar(&options.Unsigned, "unsigned", options.Unsigned, "nodes neither sign messages nor require signatures")
+	scenario := flags.String("scenario", "join,lookup,put,get,churn,check", "comma separated steps: join, put, get, lookup, churn, check")
+	verbose := flags.Bool("verbose", false, "log the RPCs of the nodes to stderr")
+	flags.Parse(os.Args[1:])
+
+	// The nodes log every RPC, keep only the report unless asked for
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if *verbose {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+	report, err := sim.New(options).Run(context.Background(), strings.Split(*scenario, ","))
+
+	report.Print(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,453 @@
+package config
+
+import (
+	"d7024e/kademlia"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBootstrap is the bootstrap node of the docker-compose network, it has no fixed ID
+// so it takes the ID its signing key is bound to like any other node
+const DefaultBootstrap = "172.20.0.6:8000"
+
+// Formats the logs can be written in
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Config holds everything needed to start a node
+type Config struct {
+	ListenAddress     string                    // address the UDP socket binds to
+	AdvertiseAddress  string                    // address other nodes use to reach this node, detected if empty
+	Bootstrap         []Seed                    // contacts used to join the network
+	NodeID            string                    // hex encoded node ID, random if empty
+	K                 int                       // bucket size and number of replicas
+	Alpha             int                       // number of parallel lookups
+	RPCTimeout        time.Duration             // timeout of a single RPC attempt
+	RPCRetries        int                       // number of times a failed RPC is resent
+	RefreshInterval   time.Duration             // how long a bucket may go untouched before it is refreshed
+	Encoding          kademlia.Encoding         // wire encoding of outgoing requests
+	MaxObjectSize     int                       // largest value that is stored or returned, in bytes
+	StreamThreshold   int                       // packets larger than this are sent over TCP, in bytes
+	HTTPAddress       string                    // address the HTTP API listens on, disabled if empty
+	LogLevel          slog.Level                // least severe level that is logged
+	LogFormat         string                    // format of the logs on stderr, text or json
+	DataDir           string                    // directory stored values are kept in, in memory if empty
+	StateFile         string                    // file the node ID and routing table are saved to, not saved if empty
+	StateInterval     time.Duration             // how often the state file is saved
+	Handoff           bool                      // hand the stored values to the closest nodes when the node stops
+	SecureID          bool                      // derive the node ID from a key pair with crypto puzzles and require the same of contacts
+	Puzzle            kademlia.PuzzleDifficulty // difficulty of the puzzles of secure IDs, in leading zero bits
+	RequireSignatures bool                      // drop messages that are not signed
+	RateLimit         int                       // requests of each type a node ID may send per second, a source IP five times as many of any type, 0 for no limit
+	RateBurst         int                       // requests of each type a node ID may send in a burst
+	StoreQuota        int                       // bytes of values one publisher or one IP may store on the node, 0 for no limit
+	StorageLimit      int                       // bytes of values all other nodes may store on the node, 0 for no limit
+}
+
+// Seed is a bootstrap contact given as id@host:port, or as host:port if its ID is learned from its PONG
+type Seed struct {
+	ID      string
+	Address string
+}
+
+// String returns the seed in the id@host:port or host:port form
+func (seed Seed) String() string {
+	if seed.ID == "" {
+		return seed.Address
+	}
+	return seed.ID + "@" + seed.Address
+}
+
+// fileConfig is the JSON layout of the optional config file
+type fileConfig struct {
+	Listen            *string  `json:"listen"`
+	Advertise         *string  `json:"advertise"`
+	Bootstrap         []string `json:"bootstrap"`
+	ID                *string  `json:"id"`
+	K                 *int     `json:"k"`
+	Alpha             *int     `json:"alpha"`
+	RPCTimeout        *string  `json:"rpc_timeout"`
+	RPCRetries        *int     `json:"rpc_retries"`
+	RefreshInterval   *string  `json:"refresh_interval"`
+	WireEncoding      *string  `json:"wire_encoding"`
+	MaxObjectSize     *string  `json:"max_object_size"`
+	StreamThreshold   *string  `json:"stream_threshold"`
+	HTTP              *string  `json:"http"`
+	LogLevel          *string  `json:"log_level"`
+	LogFormat         *string  `json:"log_format"`
+	DataDir           *string  `json:"data_dir"`
+	StateFile         *string  `json:"state_file"`
+	StateInterval     *string  `json:"state_interval"`
+	Handoff           *bool    `json:"handoff"`
+	SecureID          *bool    `json:"secure_id"`
+	PuzzleStatic      *int     `json:"puzzle_static"`
+	PuzzleDynamic     *int     `json:"puzzle_dynamic"`
+	RequireSignatures *bool    `json:"require_signatures"`
+	RateLimit         *int     `json:"rate_limit"`
+	RateBurst         *int     `json:"rate_burst"`
+	StoreQuota        *string  `json:"store_quota"`
+	StorageLimit      *string  `json:"storage_limit"`
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() Config {
+	seed, _ := ParseSeed(DefaultBootstrap)
+	return Config{
+		ListenAddress:     ":8000",
+		Bootstrap:         []Seed{seed},
+		K:                 kademlia.DefaultK,
+		Alpha:             kademlia.DefaultAlpha,
+		RPCTimeout:        kademlia.DefaultRPCTimeout,
+		RPCRetries:        kademlia.DefaultRPCRetries,
+		RefreshInterval:   kademlia.DefaultRefreshInterval,
+		MaxObjectSize:     kademlia.DefaultMaxObjectSize,
+		StreamThreshold:   kademlia.DefaultStreamThreshold,
+		HTTPAddress:       ":8080",
+		LogLevel:          slog.LevelInfo,
+		LogFormat:         LogFormatText,
+		StateInterval:     kademlia.DefaultStateInterval,
+		Puzzle:            kademlia.DefaultPuzzle,
+		RequireSignatures: true,
+		RateLimit:         int(kademlia.DefaultRateLimit.Rate),
+		RateBurst:         kademlia.DefaultRateLimit.Burst,
+		StoreQuota:        kademlia.DefaultStoreQuota,
+		StorageLimit:      kademlia.DefaultStorageLimit,
+	}
+}
+
+// Load builds the configuration from the defaults, the optional config file,
+// the environment and the command line flags, later sources override earlier ones
+func Load(args []string, getenv func(string) string) (Config, error) {
+	flags := flag.NewFlagSet("kademlia", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a JSON config file (env KADEMLIA_CONFIG)")
+	flags.String("listen", "", "address to listen on, e.g. :8000 (env KADEMLIA_LISTEN)")
+	flags.String("advertise", "", "address other nodes reach this node on (env KADEMLIA_ADVERTISE)")
+	flags.String("bootstrap", "", "comma separated bootstrap contacts as id@host:port or host:port (env KADEMLIA_BOOTSTRAP)")
+	flags.String("id", "", "hex encoded node ID, random if empty (env KADEMLIA_ID)")
+	flags.String("k", "", "bucket size and number of replicas (env KADEMLIA_K)")
+	flags.String("alpha", "", "number of parallel lookups (env KADEMLIA_ALPHA)")
+	flags.String("rpc-timeout", "", "timeout of a single RPC attempt, e.g. 2s (env KADEMLIA_RPC_TIMEOUT)")
+	flags.String("rpc-retries", "", "number of times a failed RPC is resent (env KADEMLIA_RPC_RETRIES)")
+	flags.String("refresh-interval", "", "how long a bucket may go untouched, e.g. 1h (env KADEMLIA_REFRESH_INTERVAL)")
+	flags.String("wire-encoding", "", "encoding of outgoing requests, binary or json for debugging (env KADEMLIA_WIRE_ENCODING)")
+	flags.String("max-object-size", "", "largest value that is stored or returned, e.g. 64MiB (env KADEMLIA_MAX_OBJECT_SIZE)")
+	flags.String("stream-threshold", "", "packets larger than this are sent over TCP, e.g. 32KiB (env KADEMLIA_STREAM_THRESHOLD)")
+	flags.String("http", "", "address of the HTTP API, e.g. :8080, off to disable it (env KADEMLIA_HTTP)")
+	flags.String("log-level", "", "least severe level that is logged, debug, info, warn or error (env KADEMLIA_LOG_LEVEL)")
+	flags.String("log-format", "", "format of the logs on stderr, text or json (env KADEMLIA_LOG_FORMAT)")
+	flags.String("data-dir", "", "directory stored values are kept in across restarts, in memory if empty (env KADEMLIA_DATA_DIR)")
+	flags.String("state-file", "", "file the node ID and routing table are saved to and reloaded from on start (env KADEMLIA_STATE_FILE)")
+	flags.String("state-interval", "", "how often the state file is saved, e.g. 1m (env KADEMLIA_STATE_INTERVAL)")
+	flags.String("handoff", "", "hand the stored values to the closest nodes when the node stops, true or false (env KADEMLIA_HANDOFF)")
+	flags.String("secure-id", "", "derive the node ID from a key pair with crypto puzzles and require the same of contacts, true or false (env KADEMLIA_SECURE_ID)")
+	flags.String("puzzle-static", "", "leading zero bits the static puzzle of a secure ID requires (env KADEMLIA_PUZZLE_STATIC)")
+	flags.String("puzzle-dynamic", "", "leading zero bits the dynamic puzzle of a secure ID requires (env KADEMLIA_PUZZLE_DYNAMIC)")
+	flags.String("require-signatures", "", "drop messages that are not signed, true or false (env KADEMLIA_REQUIRE_SIGNATURES)")
+	flags.String("rate-limit", "", "requests of each type a node ID may send per second, a source IP five times as many of any type, 0 for no limit (env KADEMLIA_RATE_LIMIT)")
+	flags.String("rate-burst", "", "requests of each type a node ID may send in a burst (env KADEMLIA_RATE_BURST)")
+	flags.String("store-quota", "", "bytes of values one publisher or one IP may store on the node, e.g. 256MiB, 0 for no limit (env KADEMLIA_STORE_QUOTA)")
+	flags.String("storage-limit", "", "bytes of values all other nodes may store on the node, e.g. 1GiB, 0 for no limit (env KADEMLIA_STORAGE_LIMIT)")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := Default()
+
+	path := *configPath
+	if path == "" {
+		path = getenv("KADEMLIA_CONFIG")
+	}
+	if path != "" {
+		if err := config.applyFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Environment variables override the config file
+	for _, name := range []string{"listen", "advertise", "bootstrap", "id", "k", "alpha", "rpc-timeout", "rpc-retries", "refresh-interval", "wire-encoding", "max-object-size", "stream-threshold", "http", "log-level", "log-format", "data-dir", "state-file", "state-interval", "handoff", "secure-id", "puzzle-static", "puzzle-dynamic", "require-signatures", "rate-limit", "rate-burst", "store-quota", "storage-limit"} {
+		value := getenv("KADEMLIA_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+		if value == "" {
+			continue
+		}
+		if err := config.set(name, value); err != nil {
+			return Config{}, fmt.Errorf("KADEMLIA_%s: %w", strings.ToUpper(strings.ReplaceAll(name, "-", "_")), err)
+		}
+	}
+
+	// Flags that were set explicitly override everything else
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		if setErr := config.set(f.Name, f.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	return config, config.Validate()
+}
+
+// set sets a single option from its string form
+func (config *Config) set(name string, value string) error {
+	var err error
+	switch name {
+	case "listen":
+		config.ListenAddress = value
+	case "advertise":
+		config.AdvertiseAddress = value
+	case "bootstrap":
+		config.Bootstrap, err = ParseSeeds(value)
+	case "id":
+		config.NodeID = strings.ToLower(value)
+	case "k":
+		config.K, err = strconv.Atoi(value)
+	case "alpha":
+		config.Alpha, err = strconv.Atoi(value)
+	case "rpc-timeout":
+		config.RPCTimeout, err = time.ParseDuration(value)
+	case "rpc-retries":
+		config.RPCRetries, err = strconv.Atoi(value)
+	case "refresh-interval":
+		config.RefreshInterval, err = time.ParseDuration(value)
+	case "wire-encoding":
+		config.Encoding, err = kademlia.ParseEncoding(value)
+	case "max-object-size":
+		config.MaxObjectSize, err = ParseSize(value)
+	case "stream-threshold":
+		config.StreamThreshold, err = ParseSize(value)
+	case "http":
+		if value == "off" {
+			value = ""
+		}
+		config.HTTPAddress = value
+	case "log-level":
+		err = config.LogLevel.UnmarshalText([]byte(value))
+	case "log-format":
+		config.LogFormat = strings.ToLower(value)
+	case "data-dir":
+		config.DataDir = value
+	case "state-file":
+		config.StateFile = value
+	case "state-interval":
+		config.StateInterval, err = time.ParseDuration(value)
+	case "handoff":
+		config.Handoff, err = strconv.ParseBool(value)
+	case "secure-id":
+		config.SecureID, err = strconv.ParseBool(value)
+	case "puzzle-static":
+		config.Puzzle.Static, err = strconv.Atoi(value)
+	case "puzzle-dynamic":
+		config.Puzzle.Dynamic, err = strconv.Atoi(value)
+	case "require-signatures":
+		config.RequireSignatures, err = strconv.ParseBool(value)
+	case "rate-limit":
+		config.RateLimit, err = strconv.Atoi(value)
+	case "rate-burst":
+		config.RateBurst, err = strconv.Atoi(value)
+	case "store-quota":
+		config.StoreQuota, err = ParseSize(value)
+	case "storage-limit":
+		config.StorageLimit, err = ParseSize(value)
+	default:
+		err = fmt.Errorf("unknown option %s", name)
+	}
+	return err
+}
+
+// applyFile reads the JSON config file and applies the options it contains
+func (config *Config) applyFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	var file fileConfig
+	if err := json.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	options := map[string]*string{
+		"listen":           file.Listen,
+		"advertise":        file.Advertise,
+		"id":               file.ID,
+		"rpc-timeout":      file.RPCTimeout,
+		"refresh-interval": file.RefreshInterval,
+		"wire-encoding":    file.WireEncoding,
+		"max-object-size":  file.MaxObjectSize,
+		"stream-threshold": file.StreamThreshold,
+		"http":             file.HTTP,
+		"log-level":        file.LogLevel,
+		"log-format":       file.LogFormat,
+		"data-dir":         file.DataDir,
+		"state-file":       file.StateFile,
+		"state-interval":   file.StateInterval,
+		"store-quota":      file.StoreQuota,
+		"storage-limit":    file.StorageLimit,
+	}
+	for name, value := range options {
+		if value == nil {
+			continue
+		}
+		if err := config.set(name, *value); err != nil {
+			return fmt.Errorf("config file %s: %w", name, err)
+		}
+	}
+	if file.Bootstrap != nil {
+		if err := config.set("bootstrap", strings.Join(file.Bootstrap, ",")); err != nil {
+			return fmt.Errorf("config file bootstrap: %w", err)
+		}
+	}
+	if file.K != nil {
+		config.K = *file.K
+	}
+	if file.Alpha != nil {
+		config.Alpha = *file.Alpha
+	}
+	if file.RPCRetries != nil {
+		config.RPCRetries = *file.RPCRetries
+	}
+	if file.Handoff != nil {
+		config.Handoff = *file.Handoff
+	}
+	if file.SecureID != nil {
+		config.SecureID = *file.SecureID
+	}
+	if file.PuzzleStatic != nil {
+		config.Puzzle.Static = *file.PuzzleStatic
+	}
+	if file.PuzzleDynamic != nil {
+		config.Puzzle.Dynamic = *file.PuzzleDynamic
+	}
+	if file.RequireSignatures != nil {
+		config.RequireSignatures = *file.RequireSignatures
+	}
+	if file.RateLimit != nil {
+		config.RateLimit = *file.RateLimit
+	}
+	if file.RateBurst != nil {
+		config.RateBurst = *file.RateBurst
+	}
+	return nil
+}
+
+// Validate checks that the configuration can be used to start a node
+func (config Config) Validate() error {
+	if config.ListenAddress == "" {
+		return fmt.Errorf("listen address must not be empty")
+	}
+	if config.NodeID != "" {
+		if _, err := kademlia.ParseKademliaID(config.NodeID); err != nil {
+			return fmt.Errorf("node ID must be %d hex characters", kademlia.IDLength*2)
+		}
+	}
+	if config.K <= 0 {
+		return fmt.Errorf("k must be positive")
+	}
+	if config.Alpha <= 0 {
+		return fmt.Errorf("alpha must be positive")
+	}
+	if config.RPCTimeout <= 0 {
+		return fmt.Errorf("rpc timeout must be positive")
+	}
+	if config.RPCRetries < 0 {
+		return fmt.Errorf("rpc retries must not be negative")
+	}
+	if config.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh interval must be positive")
+	}
+	if config.MaxObjectSize <= 0 {
+		return fmt.Errorf("max object size must be positive")
+	}
+	if config.StreamThreshold <= 0 {
+		return fmt.Errorf("stream threshold must be positive")
+	}
+	if config.StateInterval <= 0 {
+		return fmt.Errorf("state interval must be positive")
+	}
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON {
+		return fmt.Errorf("log format must be %s or %s", LogFormatText, LogFormatJSON)
+	}
+	if config.RateLimit < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+	if config.RateLimit > 0 && config.RateBurst <= 0 {
+		return fmt.Errorf("rate burst must be positive")
+	}
+	if config.StoreQuota < 0 {
+		return fmt.Errorf("store quota must not be negative")
+	}
+	if config.StorageLimit < 0 {
+		return fmt.Errorf("storage limit must not be negative")
+	}
+	if err := config.Puzzle.Validate(); err != nil {
+		return err
+	}
+	if config.SecureID && config.NodeID != "" {
+		return fmt.Errorf("node ID cannot be set with a secure ID, it is derived from the key")
+	}
+	return nil
+}
+
+// ParseSeeds parses a comma separated list of bootstrap contacts
+func ParseSeeds(value string) ([]Seed, error) {
+	var seeds []Seed
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		seed, err := ParseSeed(part)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
+
+// ParseSeed parses a single id@host:port or host:port bootstrap contact
+func ParseSeed(value string) (Seed, error) {
+	id, address, found := strings.Cut(value, "@")
+	if !found {
+		id, address = "", value
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return Seed{}, fmt.Errorf("bootstrap contact %q must be id@host:port or host:port", value)
+	}
+	id = strings.ToLower(id)
+	if found {
+		if _, err := kademlia.ParseKademliaID(id); err != nil {
+			return Seed{}, fmt.Errorf("bootstrap contact %q has an invalid ID", value)
+		}
+	}
+	return Seed{ID: id, Address: address}, nil
+}
+
+// ParseSize parses a number of bytes with an optional KiB, MiB or GiB suffix
+func ParseSize(value string) (int, error) {
+	multiplier := 1
+	for suffix, size := range map[string]int{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSuffix(value, suffix)
+			multiplier = size
+			break
+		}
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
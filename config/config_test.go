@@ -0,0 +1,268 @@
+package config
+
+import (
+	"d7024e/kademlia"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// envMap returns a getenv function backed by the given map
+func envMap(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func TestLoad_ReturnsDefaults(t *testing.T) {
+	config, err := Load(nil, envMap(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ListenAddress != ":8000" || config.K != 5 || config.Alpha != 3 {
+		t.Errorf("Unexpected defaults: %+v", config)
+	}
+	if len(config.Bootstrap) != 1 || config.Bootstrap[0].String() != DefaultBootstrap {
+		t.Errorf("Expected the default bootstrap contact, got %v", config.Bootstrap)
+	}
+}
+
+func TestLoad_FlagsOverrideEnvironment(t *testing.T) {
+	env := map[string]string{"KADEMLIA_LISTEN": ":9000", "KADEMLIA_K": "8", "KADEMLIA_RPC_TIMEOUT": "5s"}
+	config, err := Load([]string{"-listen", "127.0.0.1:9001"}, envMap(env))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ListenAddress != "127.0.0.1:9001" {
+		t.Errorf("Expected the flag to win, got %s", config.ListenAddress)
+	}
+	if config.K != 8 || config.RPCTimeout != 5*time.Second {
+		t.Errorf("Expected environment values to be used, got %+v", config)
+	}
+}
+
+func TestLoad_EnvironmentOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.json")
+	content := `{"listen": ":7000", "alpha": 2, "bootstrap": ["0000000000000000000000000000000000000001@127.0.0.1:7001"]}`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := Load([]string{"-config", path}, envMap(map[string]string{"KADEMLIA_LISTEN": ":7002"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ListenAddress != ":7002" {
+		t.Errorf("Expected the environment to win, got %s", config.ListenAddress)
+	}
+	if config.Alpha != 2 {
+		t.Errorf("Expected alpha from the file, got %d", config.Alpha)
+	}
+	if len(config.Bootstrap) != 1 || config.Bootstrap[0].Address != "127.0.0.1:7001" {
+		t.Errorf("Expected bootstrap contact from the file, got %v", config.Bootstrap)
+	}
+}
+
+func TestLoad_ParsesMultipleBootstrapContacts(t *testing.T) {
+	seeds := "0000000000000000000000000000000000000001@127.0.0.1:8001, 0000000000000000000000000000000000000002@127.0.0.1:8002"
+	config, err := Load([]string{"-bootstrap", seeds}, envMap(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.Bootstrap) != 2 || config.Bootstrap[1].Address != "127.0.0.1:8002" {
+		t.Errorf("Expected two bootstrap contacts, got %v", config.Bootstrap)
+	}
+}
+
+func TestLoad_RejectsInvalidValues(t *testing.T) {
+	cases := [][]string{
+		{"-k", "zero"},
+		{"-alpha", "0"},
+		{"-id", "not-an-id"},
+		{"-rpc-timeout", "-1s"},
+		{"-bootstrap", "127.0.0.1"},
+		{"-wire-encoding", "xml"},
+		{"-max-object-size", "0"},
+		{"-log-level", "verbose"},
+		{"-log-format", "xml"},
+		{"-state-interval", "0s"},
+		{"-handoff", "maybe"},
+		{"-puzzle-static", "99"},
+		{"-puzzle-dynamic", "-1"},
+		{"-secure-id", "true", "-id", "0000000000000000000000000000000000000001"},
+		{"-rate-limit", "-1"},
+		{"-rate-burst", "0"},
+		{"-store-quota", "lots"},
+		{"-storage-limit", "-1"},
+	}
+	for _, args := range cases {
+		if _, err := Load(args, envMap(nil)); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestParseSeed_RejectsInvalidID(t *testing.T) {
+	if _, err := ParseSeed("xyz@127.0.0.1:8000"); err == nil {
+		t.Error("Expected an error for an invalid ID")
+	}
+}
+
+func TestParseSeed_AcceptsSeedWithoutID(t *testing.T) {
+	seed, err := ParseSeed("127.0.0.1:8000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if seed.ID != "" || seed.Address != "127.0.0.1:8000" {
+		t.Errorf("Expected a seed without ID, got %+v", seed)
+	}
+}
+
+func TestLoad_SelectsJSONWireEncoding(t *testing.T) {
+	config, err := Load(nil, envMap(map[string]string{"KADEMLIA_WIRE_ENCODING": "json"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Encoding != kademlia.EncodingJSON {
+		t.Errorf("Expected the JSON encoding, got %v", config.Encoding)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int{"1024": 1024, "64MiB": 64 << 20, "2KiB": 2048, "1GiB": 1 << 30}
+	for value, expected := range cases {
+		size, err := ParseSize(value)
+		if err != nil || size != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", value, expected, size, err)
+		}
+	}
+	if _, err := ParseSize("64MB"); err == nil {
+		t.Error("Expected an error for an unknown suffix")
+	}
+}
+
+func TestLoad_DisablesHTTPAPI(t *testing.T) {
+	config, err := Load(nil, envMap(map[string]string{"KADEMLIA_HTTP": "off"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.HTTPAddress != "" {
+		t.Errorf("Expected the HTTP API to be disabled, got %q", config.HTTPAddress)
+	}
+	config, _ = Load([]string{"-http", "127.0.0.1:9090"}, envMap(nil))
+	if config.HTTPAddress != "127.0.0.1:9090" {
+		t.Errorf("Expected the HTTP address from the flag, got %q", config.HTTPAddress)
+	}
+}
+
+func TestLoad_SetsLogLevelAndFormat(t *testing.T) {
+	config, err := Load(nil, envMap(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.LogLevel != slog.LevelInfo || config.LogFormat != LogFormatText {
+		t.Errorf("Expected info level text logs by default, got %v %s", config.LogLevel, config.LogFormat)
+	}
+	config, err = Load([]string{"-log-format", "JSON"}, envMap(map[string]string{"KADEMLIA_LOG_LEVEL": "debug"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.LogLevel != slog.LevelDebug || config.LogFormat != LogFormatJSON {
+		t.Errorf("Expected debug level JSON logs, got %v %s", config.LogLevel, config.LogFormat)
+	}
+}
+
+func TestLoad_SetsDataDir(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"data_dir": "/var/lib/kademlia"}`), 0o644)
+
+	config, err := Load([]string{"-config", path}, envMap(nil))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.DataDir != "/var/lib/kademlia" {
+		t.Errorf("Expected the data directory from the config file, got %q", config.DataDir)
+	}
+	if config, _ := Load(nil, envMap(nil)); config.DataDir != "" {
+		t.Errorf("Expected values to be kept in memory by default, got %q", config.DataDir)
+	}
+}
+
+func TestLoad_SetsStateFile(t *testing.T) {
+	config, err := Load([]string{"-state-interval", "30s"}, envMap(map[string]string{"KADEMLIA_STATE_FILE": "/var/lib/kademlia/state.json"}))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.StateFile != "/var/lib/kademlia/state.json" || config.StateInterval != 30*time.Second {
+		t.Errorf("Expected the state file and interval, got %q and %v", config.StateFile, config.StateInterval)
+	}
+}
+
+func TestLoad_SetsHandoff(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"handoff": true}`), 0o644)
+
+	config, err := Load([]string{"-config", path}, envMap(nil))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.Handoff {
+		t.Error("Expected the handoff from the config file")
+	}
+	if config, _ := Load([]string{"-config", path}, envMap(map[string]string{"KADEMLIA_HANDOFF": "false"})); config.Handoff {
+		t.Error("Expected the environment to override the config file")
+	}
+}
+
+func TestLoad_SetsSecureIDAndPuzzle(t *testing.T) {
+	config, err := Load([]string{"-secure-id", "true", "-puzzle-dynamic", "16"}, envMap(map[string]string{"KADEMLIA_PUZZLE_STATIC": "10"}))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.SecureID || config.Puzzle.Static != 10 || config.Puzzle.Dynamic != 16 {
+		t.Errorf("Expected a secure ID with puzzles of 10 and 16 bits, got %v %+v", config.SecureID, config.Puzzle)
+	}
+}
+
+func TestLoad_RequiresSignaturesUnlessDisabled(t *testing.T) {
+	if config, _ := Load(nil, envMap(nil)); !config.RequireSignatures {
+		t.Error("Expected signatures to be required by default")
+	}
+	config, err := Load([]string{"-require-signatures=false"}, envMap(nil))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RequireSignatures {
+		t.Error("Expected unsigned messages to be accepted")
+	}
+}
+
+func TestLoad_SetsRateLimitAndStoreQuota(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"rate_limit": 5, "rate_burst": 10, "store_quota": "1GiB", "storage_limit": "2GiB"}`), 0o644)
+
+	config, err := Load([]string{"-config", path, "-store-quota", "16MiB"}, envMap(map[string]string{"KADEMLIA_RATE_BURST": "20"}))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RateLimit != 5 || config.RateBurst != 20 || config.StoreQuota != 16<<20 {
+		t.Errorf("Expected 5 requests per second in bursts of 20 and a quota of 16MiB, got %d, %d and %d", config.RateLimit, config.RateBurst, config.StoreQuota)
+	}
+	if config.StorageLimit != 2<<30 {
+		t.Errorf("Expected a storage limit of 2GiB, got %d", config.StorageLimit)
+	}
+	if config, err := Load([]string{"-rate-limit", "0", "-rate-burst", "0"}, envMap(nil)); err != nil || config.RateLimit != 0 {
+		t.Errorf("Expected the rate limit to be disabled, got %d (%v)", config.RateLimit, err)
+	}
+}
@@ -3,24 +3,48 @@ package kademlia
 import (
 	"container/list"
 	"fmt"
+	"sync"
+	"time"
 )
 
+const replacementCacheSize = bucketSize
+const maxContactFailures = 3
+
 // bucket definition
-// contains a List
+// contains a List and a replacement cache of recently seen candidates
+// guarded by a mutex so it can be used concurrently
 type bucket struct {
-	list *list.List
+	list         *list.List
+	replacements *list.List
+	failures     map[KademliaID]int
+	lastTouched  time.Time
+	size         int
+	mutex        sync.RWMutex
 }
 
 // newBucket returns a new instance of a bucket
 func newBucket() *bucket {
+	return newBucketWithSize(bucketSize)
+}
+
+// newBucketWithSize returns a new instance of a bucket holding at most size contacts
+func newBucketWithSize(size int) *bucket {
 	bucket := &bucket{}
+	bucket.size = size
 	bucket.list = list.New()
+	bucket.replacements = list.New()
+	bucket.failures = make(map[KademliaID]int)
+	bucket.lastTouched = time.Now()
 	return bucket
 }
 
 // AddContact adds the Contact to the front of the bucket
-// or moves it to the front of the bucket if it already existed
+// or moves it to the front of the bucket if it already existed,
+// if the bucket is full the Contact is put in the replacement cache instead
 func (bucket *bucket) AddContact(contact Contact) (bool, *Contact) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.lastTouched = time.Now()
 	var element *list.Element
 	for e := bucket.list.Front(); e != nil; e = e.Next() {
 		nodeID := e.Value.(Contact).ID
@@ -32,34 +56,120 @@ func (bucket *bucket) AddContact(contact Contact) (bool, *Contact) {
 
 	if element == nil {
 		//element non existing in bucket
-		if bucket.list.Len() < bucketSize {
+		if bucket.list.Len() < bucket.capacity() {
+			bucket.removeReplacement(contact.ID)
 			bucket.list.PushFront(contact)
 			return false, nil
 		} else {
 			// bucket is full
+			bucket.addReplacement(contact)
 			lastContact := bucket.list.Back().Value.(Contact)
 			return true, &lastContact
 		}
 	} else {
 		//item already exists in bucket
 		bucket.list.MoveToFront(element)
+		delete(bucket.failures, *contact.ID)
 		return false, nil
 	}
 }
 
-// RemoveContact removes the Contact from the bucket
+// addReplacement puts the Contact at the front of the replacement cache,
+// dropping the least recently seen candidate if the cache is full
+func (bucket *bucket) addReplacement(contact Contact) {
+	if bucket.replacements == nil {
+		bucket.replacements = list.New()
+	}
+	bucket.removeReplacement(contact.ID)
+	bucket.replacements.PushFront(contact)
+	if bucket.replacements.Len() > bucket.capacity() {
+		bucket.replacements.Remove(bucket.replacements.Back())
+	}
+}
+
+// promoteReplacement moves the most recently seen candidate from the replacement cache into the bucket,
+// it goes to the front as it was seen more recently than the contacts at the back
+func (bucket *bucket) promoteReplacement() {
+	if bucket.replacements == nil || bucket.replacements.Len() == 0 || bucket.list.Len() >= bucket.capacity() {
+		return
+	}
+	candidate := bucket.replacements.Remove(bucket.replacements.Front()).(Contact)
+	bucket.list.PushFront(candidate)
+}
+
+// RemoveContact removes the Contact from the bucket and promotes a candidate from the replacement cache
 func (bucket *bucket) RemoveContact(contact *Contact) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.removeContact(contact)
+}
+
+// removeContact removes the Contact, the caller must hold the lock
+func (bucket *bucket) removeContact(contact *Contact) {
+	delete(bucket.failures, *contact.ID)
 	for e := bucket.list.Front(); e != nil; e = e.Next() {
 		if e.Value.(Contact).ID.Equals(contact.ID) {
 			bucket.list.Remove(e)
-			break
+			bucket.promoteReplacement()
+			return
+		}
+	}
+	bucket.removeReplacement(contact.ID)
+}
+
+// removeReplacement removes the candidate with the ID from the replacement cache
+func (bucket *bucket) removeReplacement(id *KademliaID) {
+	if bucket.replacements == nil {
+		return
+	}
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(id) {
+			bucket.replacements.Remove(e)
+			return
+		}
+	}
+}
+
+// MarkFailed counts a failed RPC to the Contact, after maxContactFailures failures
+// the Contact is evicted and true is returned
+func (bucket *bucket) MarkFailed(contact *Contact) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.failures == nil {
+		bucket.failures = make(map[KademliaID]int)
+	}
+	for e := bucket.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(contact.ID) {
+			bucket.failures[*contact.ID]++
+			if bucket.failures[*contact.ID] < maxContactFailures {
+				return false
+			}
+			bucket.removeContact(contact)
+			return true
 		}
 	}
+	return false
+}
+
+// Replacements returns a copy of the candidates in the replacement cache, most recently seen first
+func (bucket *bucket) Replacements() []Contact {
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+	var contacts []Contact
+	if bucket.replacements == nil {
+		return contacts
+	}
+	for elt := bucket.replacements.Front(); elt != nil; elt = elt.Next() {
+		contacts = append(contacts, elt.Value.(Contact))
+	}
+	return contacts
 }
 
 // GetContactAndCalcDistance returns an array of Contacts where
 // the distance has already been calculated
 func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
 	var contacts []Contact
 
 	for elt := bucket.list.Front(); elt != nil; elt = elt.Next() {
@@ -71,14 +181,48 @@ func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
 	return contacts
 }
 
+// Contacts returns a copy of the Contacts in the bucket, most recently seen first
+func (bucket *bucket) Contacts() []Contact {
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+	contacts := make([]Contact, 0, bucket.list.Len())
+	for elt := bucket.list.Front(); elt != nil; elt = elt.Next() {
+		contacts = append(contacts, elt.Value.(Contact))
+	}
+	return contacts
+}
+
+// capacity returns the maximum number of contacts in the bucket, the replacement cache holds as many
+func (bucket *bucket) capacity() int {
+	if bucket.size <= 0 {
+		return bucketSize
+	}
+	return bucket.size
+}
+
+// Touch marks the bucket as recently used
+func (bucket *bucket) Touch() {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	bucket.lastTouched = time.Now()
+}
+
+// LastTouched returns when a contact was last added to the bucket or a lookup was done in its range
+func (bucket *bucket) LastTouched() time.Time {
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+	return bucket.lastTouched
+}
+
 // Len return the size of the bucket
 func (bucket *bucket) Len() int {
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
 	return bucket.list.Len()
 }
 
 func (bucket *bucket) PrintAllIP() {
-	for elt := bucket.list.Front(); elt != nil; elt = elt.Next() {
-		contact := elt.Value.(Contact)
+	for _, contact := range bucket.Contacts() {
 		fmt.Println("Address: " + contact.Address + " ID: " + contact.ID.String())
 	}
 }
@@ -123,3 +123,114 @@ func TestPrintAllIPBucket(t *testing.T) {
 		t.Errorf("Expected output to contain contact2's address and ID, got: %s", output)
 	}
 }
+
+func TestContactsBucket(t *testing.T) {
+	bucket := newBucket()
+	contact1 := NewContact(NewRandomKademliaID(), "127.0.0.1:8000")
+	contact2 := NewContact(NewRandomKademliaID(), "127.0.0.1:8001")
+	bucket.AddContact(contact1)
+	bucket.AddContact(contact2)
+
+	contacts := bucket.Contacts()
+	if len(contacts) != 2 {
+		t.Fatalf("Expected 2 contacts, got %d", len(contacts))
+	}
+	if !contacts[0].ID.Equals(contact2.ID) {
+		t.Error("Expected most recently added contact first")
+	}
+}
+
+func TestAddContact_FullBucketCachesReplacement(t *testing.T) {
+	bucket := newBucket()
+	for i := 0; i < bucketTestSize; i++ {
+		bucket.AddContact(NewContact(NewRandomKademliaID(), "127.0.0.1:8000"))
+	}
+	candidate := NewContact(NewRandomKademliaID(), "127.0.0.1:8001")
+
+	bucket.AddContact(candidate)
+
+	replacements := bucket.Replacements()
+	if len(replacements) != 1 || !replacements[0].ID.Equals(candidate.ID) {
+		t.Errorf("Expected candidate in replacement cache, got %v", replacements)
+	}
+	if bucket.Len() != bucketTestSize {
+		t.Errorf("Expected bucket length to stay %d, got %d", bucketTestSize, bucket.Len())
+	}
+}
+
+func TestAddContact_ReplacementCacheIsBounded(t *testing.T) {
+	bucket := newBucket()
+	for i := 0; i < bucketTestSize; i++ {
+		bucket.AddContact(NewContact(NewRandomKademliaID(), "127.0.0.1:8000"))
+	}
+	var newest Contact
+	for i := 0; i < replacementCacheSize+3; i++ {
+		newest = NewContact(NewRandomKademliaID(), "127.0.0.1:8001")
+		bucket.AddContact(newest)
+	}
+
+	replacements := bucket.Replacements()
+	if len(replacements) != replacementCacheSize {
+		t.Errorf("Expected %d replacements, got %d", replacementCacheSize, len(replacements))
+	}
+	if !replacements[0].ID.Equals(newest.ID) {
+		t.Error("Expected most recently seen candidate first")
+	}
+}
+
+func TestRemoveContact_PromotesReplacement(t *testing.T) {
+	bucket := newBucket()
+	var contacts []Contact
+	for i := 0; i < bucketTestSize; i++ {
+		contact := NewContact(NewRandomKademliaID(), "127.0.0.1:8000")
+		contacts = append(contacts, contact)
+		bucket.AddContact(contact)
+	}
+	candidate := NewContact(NewRandomKademliaID(), "127.0.0.1:8001")
+	bucket.AddContact(candidate)
+
+	bucket.RemoveContact(&contacts[0])
+
+	if bucket.Len() != bucketTestSize {
+		t.Errorf("Expected bucket to be refilled, got length %d", bucket.Len())
+	}
+	if !bucket.list.Front().Value.(Contact).ID.Equals(candidate.ID) {
+		t.Error("Expected candidate to be promoted to the most recently seen end of the bucket")
+	}
+	if len(bucket.Replacements()) != 0 {
+		t.Error("Expected replacement cache to be empty after promotion")
+	}
+}
+
+func TestMarkFailed_EvictsAfterRepeatedFailures(t *testing.T) {
+	bucket := newBucket()
+	contact := NewContact(NewRandomKademliaID(), "127.0.0.1:8000")
+	bucket.AddContact(contact)
+
+	for i := 0; i < maxContactFailures-1; i++ {
+		if bucket.MarkFailed(&contact) {
+			t.Fatalf("Expected contact to survive %d failures", i+1)
+		}
+	}
+	if !bucket.MarkFailed(&contact) {
+		t.Fatal("Expected contact to be evicted")
+	}
+	if bucket.Len() != 0 {
+		t.Error("Expected bucket to be empty after eviction")
+	}
+}
+
+func TestMarkFailed_ResetBySeeingContactAgain(t *testing.T) {
+	bucket := newBucket()
+	contact := NewContact(NewRandomKademliaID(), "127.0.0.1:8000")
+	bucket.AddContact(contact)
+
+	for i := 0; i < maxContactFailures-1; i++ {
+		bucket.MarkFailed(&contact)
+	}
+	bucket.AddContact(contact)
+
+	if bucket.MarkFailed(&contact) {
+		t.Error("Expected failure count to be reset when the contact is seen again")
+	}
+}
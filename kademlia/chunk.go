@@ -0,0 +1,285 @@
+package kademlia
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxDatagramSize = 8192                                   // size of the receive buffers, larger packets are sent in chunks
+const chunkHeaderSize = 3 + IDLength + 2*binary.MaxVarintLen32 // magic, version, kind, transfer ID, sequence number and count
+const chunkPayloadSize = maxDatagramSize - chunkHeaderSize     // bytes of the packet carried by one chunk
+const reassemblyTimeout = 30 * time.Second                     // time after which an incomplete transfer is dropped
+const maxTransfers = 256                                       // number of incomplete transfers kept at the same time
+const maxTransfersPerHost = 8                                  // number of incomplete transfers one host may have at the same time
+const maxBufferedBytes = 256 << 20                             // bytes of incomplete transfers kept at the same time, at least four packets
+const socketBufferSize = 4 << 20                               // requested size of the socket buffers so bursts of chunks are not dropped
+const DefaultMaxObjectSize = 64 << 20                          // largest value that is stored or returned by default
+const provenHostTimeout = time.Hour                            // time a host that answered a PING may be sent chunked replies
+const maxProvenHosts = 10000                                   // number of hosts that answered a PING kept at the same time
+
+var (
+	ErrObjectTooLarge = errors.New("object too large")
+	ErrInvalidData    = errors.New("data does not match its key")
+	ErrUnproven       = errors.New("host has not answered a PING")
+)
+
+// HashData returns the key of the data, which is its SHA-1 hash
+func HashData(data []byte) *KademliaID {
+	hash := sha1.Sum(data)
+	return NewKademliaID(hex.EncodeToString(hash[:]))
+}
+
+// VerifyData returns true if the data hashes to the hex encoded key
+func VerifyData(hash string, data []byte) bool {
+	return strings.EqualFold(HashData(data).String(), hash)
+}
+
+// ObjectSizeLimit returns the largest value that is stored, sent or accepted in a reply
+func (network *Network) ObjectSizeLimit() int {
+	if network.MaxObjectSize <= 0 {
+		return DefaultMaxObjectSize
+	}
+	return network.MaxObjectSize
+}
+
+// checkObjectSize returns ErrObjectTooLarge if the data exceeds the object size limit
+func (network *Network) checkObjectSize(data []byte) error {
+	if len(data) > network.ObjectSizeLimit() {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrObjectTooLarge, len(data), network.ObjectSizeLimit())
+	}
+	return nil
+}
+
+// splitPacket returns the packet as is if it fits in one datagram, otherwise it is split into numbered chunks
+func splitPacket(packet []byte) [][]byte {
+	if len(packet) <= maxDatagramSize {
+		return [][]byte{packet}
+	}
+	transferID := NewRandomKademliaID()
+	total := (len(packet) + chunkPayloadSize - 1) / chunkPayloadSize
+	chunks := make([][]byte, 0, total)
+	for seq := 0; seq < total; seq++ {
+		end := min((seq+1)*chunkPayloadSize, len(packet))
+		chunk := []byte{wireMagic, WireVersion, kindChunk}
+		chunk = append(chunk, transferID[:]...)
+		chunk = binary.AppendUvarint(chunk, uint64(seq))
+		chunk = binary.AppendUvarint(chunk, uint64(total))
+		chunk = append(chunk, packet[seq*chunkPayloadSize:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// isChunk returns true if the datagram is one chunk of a larger packet
+func isChunk(datagram []byte) bool {
+	return len(datagram) >= 3 && datagram[0] == wireMagic && datagram[2] == kindChunk
+}
+
+// transfer holds the chunks of a packet received so far
+type transfer struct {
+	chunks   [][]byte
+	received int
+	lastSeen time.Time
+	host     string // host the chunks come from
+	size     int    // bytes of the chunks received so far
+}
+
+// reassembler collects chunks from any number of senders until their packets are complete,
+// every host may only hold a share of the transfers and bytes so it cannot block the others
+type reassembler struct {
+	maxChunks    int
+	maxBytes     int // bytes buffered for all hosts
+	maxHostBytes int // bytes buffered for one host
+	transfers    map[string]*transfer
+	hosts        map[string]*hostUsage
+	buffered     int
+	mutex        sync.Mutex
+}
+
+// hostUsage is what the incomplete transfers of one host hold
+type hostUsage struct {
+	transfers int
+	bytes     int
+}
+
+// newReassembler returns a reassembler that drops packets carrying more than maxObjectSize bytes of data
+func newReassembler(maxObjectSize int) *reassembler {
+	// A packet holds the data and at most one datagram worth of other fields
+	maxPacketSize := maxObjectSize + maxDatagramSize
+	maxBytes := max(maxBufferedBytes, 4*maxPacketSize)
+	return &reassembler{
+		maxChunks:    (maxPacketSize + chunkPayloadSize - 1) / chunkPayloadSize,
+		maxBytes:     maxBytes,
+		maxHostBytes: maxBytes / 4,
+		transfers:    make(map[string]*transfer),
+		hosts:        make(map[string]*hostUsage),
+	}
+}
+
+// add returns the datagram as is if it is not a chunk, the complete packet if it was the last missing chunk
+// of its transfer and nil while chunks are still missing
+func (reassembler *reassembler) add(source string, datagram []byte) ([]byte, error) {
+	if !isChunk(datagram) {
+		return datagram, nil
+	}
+	if _, err := packetEncoding(datagram); err != nil {
+		return nil, err
+	}
+	if len(datagram) < 3+IDLength {
+		return nil, fmt.Errorf("%w: truncated chunk", ErrMalformedPacket)
+	}
+	key := source + "/" + hex.EncodeToString(datagram[3:3+IDLength])
+	rest := datagram[3+IDLength:]
+	seq, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: truncated chunk", ErrMalformedPacket)
+	}
+	rest = rest[n:]
+	total, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: truncated chunk", ErrMalformedPacket)
+	}
+	payload := rest[n:]
+	if total == 0 || seq >= total {
+		return nil, fmt.Errorf("%w: chunk %d of %d", ErrMalformedPacket, seq, total)
+	}
+	if total > uint64(reassembler.maxChunks) {
+		return nil, fmt.Errorf("%w: packet of %d chunks", ErrObjectTooLarge, total)
+	}
+
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	reassembler.dropStale()
+	current, ok := reassembler.transfers[key]
+	if !ok {
+		host := sourceHost(source)
+		if len(reassembler.transfers) >= maxTransfers || reassembler.usage(host).transfers >= maxTransfersPerHost {
+			return nil, fmt.Errorf("too many incomplete transfers, dropping chunk from %s", source)
+		}
+		current = &transfer{chunks: make([][]byte, total), host: host}
+		reassembler.transfers[key] = current
+		reassembler.usage(host).transfers++
+	}
+	if uint64(len(current.chunks)) != total {
+		reassembler.remove(key)
+		return nil, fmt.Errorf("%w: chunk count changed during transfer", ErrMalformedPacket)
+	}
+	current.lastSeen = time.Now()
+	if current.chunks[seq] != nil {
+		return nil, nil
+	}
+	usage := reassembler.usage(current.host)
+	if reassembler.buffered+len(payload) > reassembler.maxBytes || usage.bytes+len(payload) > reassembler.maxHostBytes {
+		return nil, fmt.Errorf("too many bytes in incomplete transfers, dropping chunk from %s", source)
+	}
+	// The datagram buffer is reused by the caller
+	current.chunks[seq] = append([]byte{}, payload...)
+	current.received++
+	current.size += len(payload)
+	usage.bytes += len(payload)
+	reassembler.buffered += len(payload)
+	if current.received < len(current.chunks) {
+		return nil, nil
+	}
+	reassembler.remove(key)
+	var packet []byte
+	for _, chunk := range current.chunks {
+		packet = append(packet, chunk...)
+	}
+	return packet, nil
+}
+
+// dropStale removes transfers that have not received a chunk within the reassembly timeout
+func (reassembler *reassembler) dropStale() {
+	for key, current := range reassembler.transfers {
+		if time.Since(current.lastSeen) > reassemblyTimeout {
+			reassembler.remove(key)
+		}
+	}
+}
+
+// usage returns what the incomplete transfers of the host hold
+func (reassembler *reassembler) usage(host string) *hostUsage {
+	usage, ok := reassembler.hosts[host]
+	if !ok {
+		usage = &hostUsage{}
+		reassembler.hosts[host] = usage
+	}
+	return usage
+}
+
+// remove forgets a transfer and returns what it held to its host
+func (reassembler *reassembler) remove(key string) {
+	current, ok := reassembler.transfers[key]
+	if !ok {
+		return
+	}
+	delete(reassembler.transfers, key)
+	reassembler.buffered -= current.size
+	usage := reassembler.usage(current.host)
+	usage.transfers--
+	usage.bytes -= current.size
+	if usage.transfers == 0 {
+		delete(reassembler.hosts, current.host)
+	}
+}
+
+// sourceHost returns the host of a source address, or the address if it has no port
+func sourceHost(source string) string {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		return source
+	}
+	return host
+}
+
+// setSocketBuffers enlarges the buffers of UDP sockets so a burst of chunks fits in them
+func setSocketBuffers(conn net.PacketConn) {
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		udpConn.SetReadBuffer(socketBufferSize)
+		udpConn.SetWriteBuffer(socketBufferSize)
+	}
+}
+
+// provenHosts remembers the hosts that answered a PING, replies of more than one datagram are only sent
+// to them, so a small request with a spoofed source cannot make the node flood another host with chunks
+type provenHosts struct {
+	mutex sync.Mutex
+	hosts map[string]time.Time // when each host answered last
+}
+
+// add remembers that the host answered, unless the hosts that answered within the
+// provenHostTimeout fill the cache
+func (proven *provenHosts) add(host string, now time.Time) {
+	proven.mutex.Lock()
+	defer proven.mutex.Unlock()
+	if proven.hosts == nil {
+		proven.hosts = make(map[string]time.Time)
+	}
+	if _, ok := proven.hosts[host]; !ok && len(proven.hosts) >= maxProvenHosts {
+		for known, answered := range proven.hosts {
+			if now.Sub(answered) > provenHostTimeout {
+				delete(proven.hosts, known)
+			}
+		}
+		if len(proven.hosts) >= maxProvenHosts {
+			return
+		}
+	}
+	proven.hosts[host] = now
+}
+
+// contains returns true if the host answered a PING within the provenHostTimeout
+func (proven *provenHosts) contains(host string, now time.Time) bool {
+	proven.mutex.Lock()
+	defer proven.mutex.Unlock()
+	answered, ok := proven.hosts[host]
+	return ok && now.Sub(answered) <= provenHostTimeout
+}
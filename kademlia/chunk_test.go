@@ -0,0 +1,224 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSplitPacket_KeepsSmallPacketsWhole(t *testing.T) {
+	packet := []byte("small")
+
+	chunks := splitPacket(packet)
+
+	if len(chunks) != 1 || !bytes.Equal(chunks[0], packet) {
+		t.Errorf("Expected the packet as is, got %d chunks", len(chunks))
+	}
+}
+
+func TestReassembler_ReassemblesChunksInAnyOrder(t *testing.T) {
+	packet := make([]byte, 5*chunkPayloadSize+17)
+	rand.Read(packet)
+	chunks := splitPacket(packet)
+	rand.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+	// A duplicated chunk must not complete the packet early
+	chunks = append([][]byte{chunks[1]}, chunks...)
+	reassembler := newReassembler(DefaultMaxObjectSize)
+
+	var result []byte
+	for i, chunk := range chunks {
+		if len(chunk) > maxDatagramSize {
+			t.Fatalf("Chunk of %d bytes does not fit in a datagram", len(chunk))
+		}
+		reassembled, err := reassembler.add("127.0.0.1:8000", chunk)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reassembled != nil && i != len(chunks)-1 {
+			t.Fatalf("Packet completed after %d of %d chunks", i+1, len(chunks))
+		}
+		result = reassembled
+	}
+
+	if !bytes.Equal(result, packet) {
+		t.Error("Expected the reassembled packet to equal the original")
+	}
+	if len(reassembler.transfers) != 0 {
+		t.Error("Expected the completed transfer to be removed")
+	}
+}
+
+func TestReassembler_RejectsPacketsAboveMaxObjectSize(t *testing.T) {
+	chunks := splitPacket(make([]byte, 4*maxDatagramSize))
+	reassembler := newReassembler(maxDatagramSize)
+
+	_, err := reassembler.add("127.0.0.1:8000", chunks[0])
+
+	if !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("Expected ErrObjectTooLarge, got %v", err)
+	}
+}
+
+func TestReassembler_LimitsTheTransfersOfEveryHost(t *testing.T) {
+	reassembler := newReassembler(DefaultMaxObjectSize)
+	for i := 0; i < maxTransfersPerHost; i++ {
+		// Every transfer comes from another port of the same host
+		if _, err := reassembler.add(fmt.Sprintf("10.0.0.2:%d", 40000+i), splitPacket(make([]byte, 2*maxDatagramSize))[0]); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	_, blocked := reassembler.add("10.0.0.2:8000", splitPacket(make([]byte, 2*maxDatagramSize))[0])
+	_, other := reassembler.add("10.0.0.3:8000", splitPacket(make([]byte, 2*maxDatagramSize))[0])
+
+	if blocked == nil {
+		t.Error("Expected the host to be limited to its transfers")
+	}
+	if other != nil {
+		t.Errorf("Expected another host to start a transfer, got %v", other)
+	}
+}
+
+func TestReassembler_LimitsTheBufferedBytesAndReleasesThemWithTheTransfer(t *testing.T) {
+	reassembler := newReassembler(DefaultMaxObjectSize)
+	reassembler.maxHostBytes = 2 * chunkPayloadSize
+	chunks := splitPacket(make([]byte, 3*chunkPayloadSize))
+	reassembler.add("10.0.0.2:8000", chunks[0])
+	reassembler.add("10.0.0.2:8000", chunks[1])
+
+	_, err := reassembler.add("10.0.0.2:8000", chunks[2])
+
+	if err == nil {
+		t.Fatal("Expected the chunk over the byte limit of the host to be dropped")
+	}
+	reassembler.mutex.Lock()
+	for key := range reassembler.transfers {
+		reassembler.remove(key)
+	}
+	reassembler.mutex.Unlock()
+	if reassembler.buffered != 0 || len(reassembler.hosts) != 0 {
+		t.Errorf("Expected the bytes to be released, %d bytes of %d hosts are left", reassembler.buffered, len(reassembler.hosts))
+	}
+}
+
+func TestVerifyData(t *testing.T) {
+	data := []byte("data1")
+	hash := HashData(data).String()
+
+	if !VerifyData(hash, data) {
+		t.Error("Expected data to match its SHA-1 key")
+	}
+	if VerifyData(hash, []byte("data2")) {
+		t.Error("Expected other data not to match the key")
+	}
+}
+
+func TestSendStoreMessage_StoresAndFindsLargeValue(t *testing.T) {
+	peer := listeningNode(t, nil)
+	// The peer only sends the value in chunks to a node that answers its PING
+	requester := listeningNode(t, nil)
+	network := requester.Network
+	me := requester.RoutingTable.Me
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+	dataID := HashData(data)
+
+	if err := network.SendStoreMessage(context.Background(), &me, &peer.RoutingTable.Me, dataID, data); err != nil {
+		t.Fatalf("Expected STORE_OK, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, ok := peer.getData(dataID.String()); !ok; _, ok = peer.getData(dataID.String()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the peer to store the value")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, found, err := network.SendFindDataMessage(context.Background(), &me, &peer.RoutingTable.Me, dataID.String())
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(found, data) {
+		t.Errorf("Expected the %d byte value, got %d bytes", len(data), len(found))
+	}
+}
+
+func TestHandleFindData_SendsNoChunksToAHostThatDoesNotAnswerPings(t *testing.T) {
+	peer := listeningNode(t, func(k *Kademlia) {
+		k.Network.Timeout = 100 * time.Millisecond
+		k.Network.Retries = 0
+	})
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+	dataID := HashData(data)
+	peer.StoreWithTTL(dataID.String(), data, time.Hour)
+	// The socket stands in for a host whose address a request was spoofed with, it never answers
+	victim, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { victim.Close() })
+	request := Message{
+		RPCID:    NewRandomKademliaID(),
+		Type:     "FIND_DATA",
+		SenderID: NewRandomKademliaID(),
+		SenderIP: victim.LocalAddr().String(),
+		TargetID: dataID.String(),
+	}
+	packet, _ := NewNetwork(nil).encodeMessage(EncodingBinary, request)
+	peerAddr, _ := net.ResolveUDPAddr("udp", peer.RoutingTable.Me.Address)
+
+	victim.WriteTo(packet, peerAddr)
+
+	chunks := 0
+	victim.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		var buf [maxDatagramSize]byte
+		n, _, err := victim.ReadFrom(buf[:])
+		if err != nil {
+			break
+		}
+		if isChunk(buf[:n]) {
+			chunks++
+		}
+	}
+	if chunks != 0 {
+		t.Errorf("Expected no chunks for a host that did not answer a PING, got %d", chunks)
+	}
+}
+
+func TestSendStoreMessage_RejectsDataNotMatchingKey(t *testing.T) {
+	peer := listeningPeer(t)
+	network := NewNetwork(nil)
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:1")
+
+	err := network.SendStoreMessage(context.Background(), &me, &peer, NewRandomKademliaID(), []byte("data1"))
+
+	if !errors.Is(err, ErrInvalidData) {
+		t.Fatalf("Expected ErrInvalidData, got %v", err)
+	}
+}
+
+func TestSendStoreMessage_RejectsValuesAboveMaxObjectSize(t *testing.T) {
+	peer := listeningNode(t, func(k *Kademlia) { k.Network.MaxObjectSize = 1024 })
+	network := NewNetwork(nil)
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:1")
+	data := make([]byte, 2048)
+
+	err := network.SendStoreMessage(context.Background(), &me, &peer.RoutingTable.Me, HashData(data), data)
+	if !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("Expected the receiver to reject the value, got %v", err)
+	}
+
+	network.MaxObjectSize = 1024
+	err = network.SendStoreMessage(context.Background(), &me, &peer.RoutingTable.Me, HashData(data), data)
+	if !errors.Is(err, ErrObjectTooLarge) {
+		t.Fatalf("Expected the sender to refuse the value, got %v", err)
+	}
+}
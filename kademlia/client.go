@@ -0,0 +1,89 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrEmptyData         = errors.New("data is empty")
+	ErrNotEnoughReplicas = errors.New("not enough nodes stored the data")
+	ErrDataNotFound      = errors.New("no node has the data")
+)
+
+// PutResult describes where a PUT stored its data
+type PutResult struct {
+	Contacts []Contact   // the k closest nodes to the key that were asked to store the data
+	StoredOn []Contact   // the nodes that acknowledged the STORE
+	Lookup   LookupStats // work done finding the closest nodes
+}
+
+// GetResult describes how a GET found its data
+type GetResult struct {
+	FoundOn Contact     // the node that returned the data
+	Lookup  LookupStats // work done finding the data
+}
+
+// Put stores the data on the k closest nodes to its SHA-1 hash and keeps republishing it from this node,
+// it returns ErrNotEnoughReplicas if no majority of those nodes acknowledged the STORE
+func (kademlia *Kademlia) Put(ctx context.Context, data []byte) (KademliaID, PutResult, error) {
+	var result PutResult
+	if len(data) == 0 {
+		return KademliaID{}, result, ErrEmptyData
+	}
+	if err := kademlia.Network.checkObjectSize(data); err != nil {
+		return KademliaID{}, result, err
+	}
+
+	key := HashData(data)
+	target := NewContact(key, "")
+	result.Contacts, _, _, result.Lookup = kademlia.NodeLookupWithStats(ctx, &target, "")
+	result.StoredOn = kademlia.storeOnContacts(ctx, key, data, tExpire, result.Contacts)
+	kademlia.Metrics.putDone(len(result.StoredOn), len(result.Contacts))
+	kademlia.Publish(key.String(), data)
+
+	if len(result.StoredOn) <= len(result.Contacts)/2 {
+		return *key, result, fmt.Errorf("%w: stored on %d of %d nodes", ErrNotEnoughReplicas, len(result.StoredOn), len(result.Contacts))
+	}
+	return *key, result, nil
+}
+
+// storeOnContacts sends the data with the TTL to the contacts in parallel and returns the ones that stored it
+func (kademlia *Kademlia) storeOnContacts(ctx context.Context, key *KademliaID, data []byte, ttl time.Duration, contacts []Contact) []Contact {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var stored []Contact
+	me := kademlia.RoutingTable.Me
+	for _, contact := range contacts {
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			if err := kademlia.Network.SendStoreMessageWithTTL(ctx, &me, &contact, key, data, ttl); err != nil {
+				kademlia.storeLogger().Debug("Error storing data", "key", key.String(), "peer", contact.Address, "peer_id", contact.ID.String(), "rpc", "STORE", "err", err)
+				kademlia.reportFailedRPC(contact, err)
+				return
+			}
+			mutex.Lock()
+			stored = append(stored, contact)
+			mutex.Unlock()
+		}(contact)
+	}
+	wg.Wait()
+	return stored
+}
+
+// Get looks up the data stored under the key, it returns ErrDataNotFound if no node returned it
+func (kademlia *Kademlia) Get(ctx context.Context, key KademliaID) ([]byte, GetResult, error) {
+	var result GetResult
+	target := NewContact(&key, "")
+	_, foundOn, data, stats := kademlia.NodeLookupWithStats(ctx, &target, key.String())
+	result.FoundOn = foundOn
+	result.Lookup = stats
+	if data == nil {
+		return nil, result, fmt.Errorf("%w: %s", ErrDataNotFound, key.String())
+	}
+	return data, result, nil
+}
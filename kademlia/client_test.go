@@ -0,0 +1,81 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"d7024e/memnet"
+)
+
+func TestPut_StoresOnClosestNodesAndGetFindsIt(t *testing.T) {
+	// With k + 1 nodes every node except the one doing the PUT stores the value
+	nodes := memnetNodes(t, memnet.New(7), DefaultK+1, 7)
+	data := []byte("client data")
+
+	key, result, err := nodes[0].Put(context.Background(), data)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !key.Equals(HashData(data)) {
+		t.Errorf("Expected the SHA-1 key %s, got %s", HashData(data).String(), key.String())
+	}
+	if len(result.Contacts) != DefaultK || len(result.StoredOn) != DefaultK {
+		t.Errorf("Expected %d replicas, got %d of %d", DefaultK, len(result.StoredOn), len(result.Contacts))
+	}
+	if result.Lookup.RPCs == 0 {
+		t.Error("Expected the lookup statistics of the PUT")
+	}
+
+	found, getResult, err := nodes[DefaultK].Get(context.Background(), key)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(found, data) {
+		t.Errorf("Expected %q, got %q", data, found)
+	}
+	if getResult.FoundOn.ID == nil {
+		t.Error("Expected the contact the data was found on")
+	}
+}
+
+func TestPut_ReturnsErrNotEnoughReplicasWithoutPeers(t *testing.T) {
+	k := joiningNode()
+
+	key, _, err := k.Put(context.Background(), []byte("data"))
+
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("Expected ErrNotEnoughReplicas, got %v", err)
+	}
+	if !key.Equals(HashData([]byte("data"))) {
+		t.Error("Expected the key of the data even when the PUT failed")
+	}
+	if _, ok := k.published[key.String()]; !ok {
+		t.Error("Expected the data to be republished later")
+	}
+}
+
+func TestPut_RejectsEmptyAndOversizedData(t *testing.T) {
+	k := joiningNode()
+	k.Network.MaxObjectSize = 4
+
+	if _, _, err := k.Put(context.Background(), nil); !errors.Is(err, ErrEmptyData) {
+		t.Errorf("Expected ErrEmptyData, got %v", err)
+	}
+	if _, _, err := k.Put(context.Background(), []byte("too large")); !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("Expected ErrObjectTooLarge, got %v", err)
+	}
+}
+
+func TestGet_ReturnsErrDataNotFound(t *testing.T) {
+	nodes := memnetNodes(t, memnet.New(8), 3, 8)
+
+	_, _, err := nodes[0].Get(context.Background(), *NewRandomKademliaID())
+
+	if !errors.Is(err, ErrDataNotFound) {
+		t.Fatalf("Expected ErrDataNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,435 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Binary packets start with wireMagic and the protocol version, JSON packets start with '{'
+const wireMagic = 0xd7
+const WireVersion = 1
+
+// Kinds of binary packets
+const (
+	kindMessage       = 1
+	kindResponse      = 2
+	kindChunk         = 3
+	kindStreamPointer = 4
+)
+
+// Tags of a target ID, which is a hex encoded KademliaID or an arbitrary string
+const (
+	targetEmpty  = 0
+	targetID     = 1
+	targetString = 2
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrMalformedPacket    = errors.New("malformed packet")
+)
+
+// Encoding is the wire format of outgoing packets
+type Encoding int
+
+const (
+	EncodingBinary Encoding = iota // compact versioned binary format
+	EncodingJSON                   // human readable format for debugging
+)
+
+// String returns the name of the encoding
+func (encoding Encoding) String() string {
+	if encoding == EncodingJSON {
+		return "json"
+	}
+	return "binary"
+}
+
+// ParseEncoding returns the encoding with the given name
+func ParseEncoding(name string) (Encoding, error) {
+	switch name {
+	case "binary":
+		return EncodingBinary, nil
+	case "json":
+		return EncodingJSON, nil
+	}
+	return EncodingBinary, fmt.Errorf("unknown encoding %q, expected binary or json", name)
+}
+
+// packetEncoding returns the encoding of a received packet
+func packetEncoding(packet []byte) (Encoding, error) {
+	if len(packet) == 0 {
+		return EncodingBinary, fmt.Errorf("%w: empty packet", ErrMalformedPacket)
+	}
+	switch packet[0] {
+	case '{':
+		return EncodingJSON, nil
+	case wireMagic:
+		if len(packet) < 3 {
+			return EncodingBinary, fmt.Errorf("%w: truncated header", ErrMalformedPacket)
+		}
+		if packet[1] != WireVersion {
+			return EncodingBinary, fmt.Errorf("%w: %d", ErrUnsupportedVersion, packet[1])
+		}
+		return EncodingBinary, nil
+	}
+	return EncodingBinary, fmt.Errorf("%w: unknown magic byte 0x%02x", ErrMalformedPacket, packet[0])
+}
+
+// encodeMessage encodes a message in the given encoding
+func encodeMessage(encoding Encoding, message Message) ([]byte, error) {
+	if encoding == EncodingJSON {
+		return json.Marshal(message)
+	}
+	writer := newPacketWriter(kindMessage)
+	writer.id(message.RPCID)
+	writer.string(message.Type)
+	writer.id(message.SenderID)
+	writer.string(message.SenderIP)
+	writer.target(message.TargetID)
+	writer.string(message.TargetIP)
+	writer.id(message.DataID)
+	writer.bytes(message.Data)
+	writer.varint(int64(message.TTL))
+	// Fields added after version 1 was released are only written when set, older nodes ignore them
+	if message.PublicKey != nil || message.Nonce != nil || message.Signature != nil || message.ObservedIP != "" {
+		writer.bytes(message.PublicKey)
+		writer.bytes(message.Nonce)
+		writer.bytes(message.Signature)
+	}
+	if message.ObservedIP != "" {
+		writer.string(message.ObservedIP)
+	}
+	return writer.buf, nil
+}
+
+// decodeMessage decodes a message in either encoding and records the encoding it was sent in
+func decodeMessage(packet []byte) (Message, error) {
+	encoding, err := packetEncoding(packet)
+	if err != nil {
+		return Message{}, err
+	}
+	var message Message
+	if encoding == EncodingJSON {
+		if err := json.Unmarshal(packet, &message); err != nil {
+			return Message{}, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+		}
+		message.encoding = EncodingJSON
+		return message, nil
+	}
+	reader, err := newPacketReader(packet, kindMessage)
+	if err != nil {
+		return Message{}, err
+	}
+	message.RPCID = reader.id()
+	message.Type = reader.string()
+	message.SenderID = reader.id()
+	message.SenderIP = reader.string()
+	message.TargetID = reader.target()
+	message.TargetIP = reader.string()
+	message.DataID = reader.id()
+	message.Data = reader.bytes()
+	message.TTL = time.Duration(reader.varint())
+	if reader.more() {
+		message.PublicKey = reader.bytes()
+		message.Nonce = reader.bytes()
+		message.Signature = reader.bytes()
+	}
+	if reader.more() {
+		message.ObservedIP = reader.string()
+	}
+	message.encoding = EncodingBinary
+	return message, reader.err
+}
+
+// encodeResponse encodes a response in the given encoding
+func encodeResponse(encoding Encoding, response Response) ([]byte, error) {
+	if encoding == EncodingJSON {
+		return json.Marshal(response)
+	}
+	writer := newPacketWriter(kindResponse)
+	writer.id(response.RPCID)
+	writer.bytes(response.Data)
+	writer.uvarint(uint64(len(response.ClosestContacts)))
+	for _, contact := range response.ClosestContacts {
+		writer.contact(contact)
+	}
+	if response.Target == nil {
+		writer.buf = append(writer.buf, 0)
+	} else {
+		writer.buf = append(writer.buf, 1)
+		writer.contact(*response.Target)
+	}
+	// Like the signature of a message, the signature of a reply is only written when set
+	if response.SenderID != nil || response.PublicKey != nil || response.Signature != nil {
+		writer.id(response.SenderID)
+		writer.bytes(response.PublicKey)
+		writer.bytes(response.Signature)
+	}
+	return writer.buf, nil
+}
+
+// decodeResponse decodes a response in either encoding
+func decodeResponse(packet []byte) (Response, error) {
+	encoding, err := packetEncoding(packet)
+	if err != nil {
+		return Response{}, err
+	}
+	var response Response
+	if encoding == EncodingJSON {
+		if err := json.Unmarshal(packet, &response); err != nil {
+			return Response{}, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+		}
+		return response, checkContacts(response)
+	}
+	reader, err := newPacketReader(packet, kindResponse)
+	if err != nil {
+		return Response{}, err
+	}
+	response.RPCID = reader.id()
+	response.Data = reader.bytes()
+	count := reader.uvarint()
+	// Every contact takes at least two bytes, a larger count can only come from a corrupt packet
+	if count > uint64(len(reader.buf)) {
+		return Response{}, fmt.Errorf("%w: %d contacts in %d bytes", ErrMalformedPacket, count, len(reader.buf))
+	}
+	for i := uint64(0); i < count; i++ {
+		response.ClosestContacts = append(response.ClosestContacts, reader.contact())
+	}
+	if reader.byte() == 1 {
+		target := reader.contact()
+		response.Target = &target
+	}
+	if reader.more() {
+		response.SenderID = reader.id()
+		response.PublicKey = reader.bytes()
+		response.Signature = reader.bytes()
+	}
+	if reader.err != nil {
+		return response, reader.err
+	}
+	return response, checkContacts(response)
+}
+
+// checkContacts returns an error if a contact of the response has no ID or no address
+func checkContacts(response Response) error {
+	contacts := response.ClosestContacts
+	if response.Target != nil {
+		contacts = append(contacts[:len(contacts):len(contacts)], *response.Target)
+	}
+	for _, contact := range contacts {
+		if contact.ID == nil || contact.Address == "" {
+			return fmt.Errorf("%w: contact without ID or address", ErrMalformedPacket)
+		}
+	}
+	return nil
+}
+
+// decodeRPCID returns the RPC ID of a message or response in either encoding
+func decodeRPCID(packet []byte) (*KademliaID, error) {
+	encoding, err := packetEncoding(packet)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == EncodingJSON {
+		var header struct {
+			RPCID *KademliaID `json:"rpc_id"`
+		}
+		if err := json.Unmarshal(packet, &header); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+		}
+		return header.RPCID, nil
+	}
+	reader := &packetReader{buf: packet[3:]}
+	rpcID := reader.id()
+	return rpcID, reader.err
+}
+
+// packetWriter appends the fields of a binary packet to a buffer
+type packetWriter struct {
+	buf []byte
+}
+
+func newPacketWriter(kind byte) *packetWriter {
+	return &packetWriter{buf: []byte{wireMagic, WireVersion, kind}}
+}
+
+func (writer *packetWriter) uvarint(value uint64) {
+	writer.buf = binary.AppendUvarint(writer.buf, value)
+}
+
+func (writer *packetWriter) varint(value int64) {
+	writer.buf = binary.AppendVarint(writer.buf, value)
+}
+
+// bytes writes the length plus one so nil data, which means not found, differs from empty data
+func (writer *packetWriter) bytes(value []byte) {
+	if value == nil {
+		writer.uvarint(0)
+		return
+	}
+	writer.uvarint(uint64(len(value)) + 1)
+	writer.buf = append(writer.buf, value...)
+}
+
+func (writer *packetWriter) string(value string) {
+	writer.uvarint(uint64(len(value)))
+	writer.buf = append(writer.buf, value...)
+}
+
+// id writes a presence byte followed by the raw ID
+func (writer *packetWriter) id(id *KademliaID) {
+	if id == nil {
+		writer.buf = append(writer.buf, 0)
+		return
+	}
+	writer.buf = append(writer.buf, 1)
+	writer.buf = append(writer.buf, id[:]...)
+}
+
+// target writes a hex encoded KademliaID as raw bytes and any other string as is
+func (writer *packetWriter) target(value string) {
+	if value == "" {
+		writer.buf = append(writer.buf, targetEmpty)
+		return
+	}
+	if decoded, err := hex.DecodeString(value); err == nil && len(decoded) == IDLength && hex.EncodeToString(decoded) == value {
+		writer.buf = append(writer.buf, targetID)
+		writer.buf = append(writer.buf, decoded...)
+		return
+	}
+	writer.buf = append(writer.buf, targetString)
+	writer.string(value)
+}
+
+func (writer *packetWriter) contact(contact Contact) {
+	writer.id(contact.ID)
+	writer.string(contact.Address)
+}
+
+// packetReader reads the fields of a binary packet, the first error is kept and ends reading
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+// newPacketReader checks the header of a binary packet and returns a reader for its fields
+func newPacketReader(packet []byte, kind byte) (*packetReader, error) {
+	if packet[2] != kind {
+		return nil, fmt.Errorf("%w: expected packet kind %d, got %d", ErrMalformedPacket, kind, packet[2])
+	}
+	return &packetReader{buf: packet[3:]}, nil
+}
+
+// more returns true if fields are left to read
+func (reader *packetReader) more() bool {
+	return reader.err == nil && len(reader.buf) > 0
+}
+
+// fail records a truncated packet
+func (reader *packetReader) fail() {
+	if reader.err == nil {
+		reader.err = fmt.Errorf("%w: truncated packet", ErrMalformedPacket)
+	}
+	reader.buf = nil
+}
+
+func (reader *packetReader) next(n int) []byte {
+	if reader.err != nil || n < 0 || len(reader.buf) < n {
+		reader.fail()
+		return nil
+	}
+	value := reader.buf[:n]
+	reader.buf = reader.buf[n:]
+	return value
+}
+
+func (reader *packetReader) byte() byte {
+	value := reader.next(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (reader *packetReader) uvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.buf)
+	if n <= 0 {
+		reader.fail()
+		return 0
+	}
+	reader.buf = reader.buf[n:]
+	return value
+}
+
+func (reader *packetReader) varint() int64 {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(reader.buf)
+	if n <= 0 {
+		reader.fail()
+		return 0
+	}
+	reader.buf = reader.buf[n:]
+	return value
+}
+
+func (reader *packetReader) bytes() []byte {
+	length := reader.uvarint()
+	if length == 0 {
+		return nil
+	}
+	if length-1 > uint64(len(reader.buf)) {
+		reader.fail()
+		return nil
+	}
+	return append([]byte{}, reader.next(int(length-1))...)
+}
+
+func (reader *packetReader) string() string {
+	length := reader.uvarint()
+	if length > uint64(len(reader.buf)) {
+		reader.fail()
+		return ""
+	}
+	return string(reader.next(int(length)))
+}
+
+func (reader *packetReader) id() *KademliaID {
+	if reader.byte() == 0 {
+		return nil
+	}
+	value := reader.next(IDLength)
+	if value == nil {
+		return nil
+	}
+	id := KademliaID{}
+	copy(id[:], value)
+	return &id
+}
+
+func (reader *packetReader) target() string {
+	switch reader.byte() {
+	case targetID:
+		value := reader.next(IDLength)
+		if value == nil {
+			return ""
+		}
+		return hex.EncodeToString(value)
+	case targetString:
+		return reader.string()
+	}
+	return ""
+}
+
+func (reader *packetReader) contact() Contact {
+	return Contact{ID: reader.id(), Address: reader.string()}
+}
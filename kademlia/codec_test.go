@@ -0,0 +1,219 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testMessage() Message {
+	return Message{
+		RPCID:    NewRandomKademliaID(),
+		Type:     "STORE",
+		SenderID: NewRandomKademliaID(),
+		SenderIP: "172.20.0.2:8000",
+		TargetID: NewRandomKademliaID().String(),
+		TargetIP: "172.20.0.3:8000",
+		DataID:   NewRandomKademliaID(),
+		Data:     []byte("data1"),
+		TTL:      time.Hour,
+	}
+}
+
+func testResponse(contacts int) Response {
+	response := Response{RPCID: NewRandomKademliaID()}
+	for i := 0; i < contacts; i++ {
+		response.ClosestContacts = append(response.ClosestContacts, NewContact(NewRandomKademliaID(), "172.20.0.10:8000"))
+	}
+	return response
+}
+
+func TestEncodeMessage_RoundTripsInBothEncodings(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingBinary, EncodingJSON} {
+		message := testMessage()
+		packet, err := encodeMessage(encoding, message)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		decoded, err := decodeMessage(packet)
+
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %v: %v", encoding, err)
+		}
+		if decoded.encoding != encoding {
+			t.Errorf("Expected the message to be recorded as %v, got %v", encoding, decoded.encoding)
+		}
+		message.encoding = encoding
+		if !reflect.DeepEqual(decoded, message) {
+			t.Errorf("Expected %+v, got %+v", message, decoded)
+		}
+	}
+}
+
+func TestEncodeMessage_RoundTripsIdentityProofAndStaysReadableWithout(t *testing.T) {
+	message := testMessage()
+	plain, _ := encodeMessage(EncodingBinary, message)
+	message.PublicKey = bytes.Repeat([]byte{1}, 32)
+	message.Nonce = bytes.Repeat([]byte{2}, IDLength)
+	proven, _ := encodeMessage(EncodingBinary, message)
+
+	decoded, err := decodeMessage(proven)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(decoded.PublicKey, message.PublicKey) || !bytes.Equal(decoded.Nonce, message.Nonce) {
+		t.Errorf("Expected the public key and nonce, got %x and %x", decoded.PublicKey, decoded.Nonce)
+	}
+	// A message without a proof is encoded as before the fields were added
+	if !bytes.HasPrefix(proven, plain) {
+		t.Error("Expected the proof to be appended to the fields of version 1")
+	}
+}
+
+func TestEncodeMessage_RoundTripsObservedAddress(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingBinary, EncodingJSON} {
+		message := testMessage()
+		message.ObservedIP = "203.0.113.7:40123"
+		packet, _ := encodeMessage(encoding, message)
+
+		decoded, err := decodeMessage(packet)
+
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %v: %v", encoding, err)
+		}
+		if decoded.ObservedIP != message.ObservedIP {
+			t.Errorf("Expected the observed address in %v, got %q", encoding, decoded.ObservedIP)
+		}
+	}
+}
+
+func TestEncodeMessage_KeepsTargetThatIsNotAnID(t *testing.T) {
+	message := Message{Type: "FIND_DATA", TargetID: "not a hex id"}
+	packet, _ := encodeMessage(EncodingBinary, message)
+
+	decoded, err := decodeMessage(packet)
+
+	if err != nil || decoded.TargetID != message.TargetID {
+		t.Errorf("Expected target %q, got %q (%v)", message.TargetID, decoded.TargetID, err)
+	}
+}
+
+func TestEncodeResponse_RoundTripsContactsAndData(t *testing.T) {
+	response := testResponse(3)
+	response.Data = []byte{}
+	response.Target = &response.ClosestContacts[0]
+	packet, _ := encodeResponse(EncodingBinary, response)
+
+	decoded, err := decodeResponse(packet)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, response) {
+		t.Errorf("Expected %+v, got %+v", response, decoded)
+	}
+	if decoded.Data == nil {
+		t.Error("Expected empty data to stay distinct from no data")
+	}
+}
+
+func TestEncodeResponse_BinaryIsAboutHalfTheSizeOfJSON(t *testing.T) {
+	response := testResponse(bucketSize)
+	binaryPacket, _ := encodeResponse(EncodingBinary, response)
+	jsonPacket, _ := encodeResponse(EncodingJSON, response)
+
+	if len(binaryPacket)*2 > len(jsonPacket) {
+		t.Errorf("Expected binary FIND_NODE reply to be at most half of JSON, got %d and %d bytes", len(binaryPacket), len(jsonPacket))
+	}
+}
+
+func TestDecodeMessage_RejectsUnknownVersion(t *testing.T) {
+	packet, _ := encodeMessage(EncodingBinary, testMessage())
+	packet[1] = WireVersion + 1
+
+	_, err := decodeMessage(packet)
+
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestDecodeMessage_RejectsMalformedPackets(t *testing.T) {
+	packet, _ := encodeMessage(EncodingBinary, testMessage())
+	response, _ := encodeResponse(EncodingBinary, testResponse(1))
+	cases := map[string][]byte{
+		"empty":         {},
+		"unknown magic": {0x00, WireVersion, kindMessage},
+		"truncated":     packet[:len(packet)-4],
+		"wrong kind":    response,
+	}
+	for name, packet := range cases {
+		if _, err := decodeMessage(packet); !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("%s: expected ErrMalformedPacket, got %v", name, err)
+		}
+	}
+}
+
+func TestDecodeResponse_RejectsContactsWithoutIDOrAddress(t *testing.T) {
+	id := NewRandomKademliaID()
+	for _, contact := range []Contact{{Address: "10.0.0.1:8000"}, {ID: id}} {
+		for _, encoding := range []Encoding{EncodingBinary, EncodingJSON} {
+			packet, _ := encodeResponse(encoding, Response{RPCID: id, ClosestContacts: []Contact{contact}})
+
+			if _, err := decodeResponse(packet); !errors.Is(err, ErrMalformedPacket) {
+				t.Errorf("Expected ErrMalformedPacket for %+v in %s, got %v", contact, encoding, err)
+			}
+		}
+	}
+}
+
+func TestReplyMatchesRPC_Binary(t *testing.T) {
+	response := testResponse(1)
+	packet, _ := encodeResponse(EncodingBinary, response)
+
+	if !replyMatchesRPC(packet, response.RPCID) {
+		t.Error("Expected binary reply with the same RPC ID to match")
+	}
+	if replyMatchesRPC(packet, NewRandomKademliaID()) {
+		t.Error("Expected binary reply with another RPC ID not to match")
+	}
+}
+
+func TestSendPingMessage_NodeRepliesInJSONToJSONRequest(t *testing.T) {
+	peer := listeningPeer(t)
+	conn, err := net.Dial("udp", peer.Address)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	ping, _ := NewNetwork(nil).encodeMessage(EncodingJSON, Message{RPCID: NewRandomKademliaID(), Type: "PING", SenderID: NewRandomKademliaID()})
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(ping)
+	buf := make([]byte, 8192)
+	n, err := conn.Read(buf)
+
+	if err != nil {
+		t.Fatalf("Expected PONG, got %v", err)
+	}
+	if !bytes.HasPrefix(buf[:n], []byte("{")) {
+		t.Errorf("Expected a JSON reply, got % x", buf[:n])
+	}
+}
+
+func TestSendPingMessage_JSONEncoding(t *testing.T) {
+	peer := listeningPeer(t)
+	network := NewNetwork(nil)
+	network.Encoding = EncodingJSON
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:1")
+
+	if err := network.SendPingMessage(context.Background(), &me, &peer); err != nil {
+		t.Fatalf("Expected PONG, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every value is a file named by its key:
+//
+//	magic (1) | version (1) | expiry in Unix nanoseconds (8) | CRC-32 of expiry and data (4) | data
+//
+// A file is written under a temporary name, synced and renamed, so a crash leaves either the old
+// or the new value. Temporary files and files that fail the checksum are removed when the store opens.
+const (
+	diskMagic      = 0xD5
+	diskVersion    = 1
+	diskHeaderSize = 2 + 8 + 4
+	diskTempSuffix = ".tmp"
+)
+
+var ErrCorruptEntry = errors.New("stored value is corrupt")
+
+// DiskStore is a Store that keeps every value in a file in a directory, it survives restarts
+type DiskStore struct {
+	dir   string
+	mutex sync.RWMutex
+	index map[string]EntryInfo // what is on disk, so listing does not read the values
+}
+
+// OpenDiskStore opens the store in the directory, creating the directory if it does not exist,
+// and recovers from a crash by removing unfinished writes and corrupt values
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating store directory: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading store directory: %w", err)
+	}
+	store := &DiskStore{dir: dir, index: make(map[string]EntryInfo)}
+	log := slog.Default().With("component", componentStore)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, diskTempSuffix) {
+			log.Info("Removing unfinished write", "file", name)
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if _, err := ParseKademliaID(name); err != nil {
+			continue
+		}
+		entry, err := store.read(name)
+		if err != nil {
+			log.Warn("Removing corrupt value", "key", name, "err", err)
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		store.index[name] = EntryInfo{Key: name, Size: len(entry.Data), ExpiresAt: entry.ExpiresAt}
+	}
+	return store, nil
+}
+
+// Put writes the entry to its file and syncs it before returning
+func (store *DiskStore) Put(key string, entry Entry) error {
+	if _, err := ParseKademliaID(key); err != nil {
+		return ErrInvalidKey
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.write(key, entry); err != nil {
+		return err
+	}
+	store.index[key] = EntryInfo{Key: key, Size: len(entry.Data), ExpiresAt: entry.ExpiresAt}
+	return nil
+}
+
+// Get reads the entry from its file, it returns ErrCorruptEntry if the file fails the checksum
+func (store *DiskStore) Get(key string) (Entry, bool, error) {
+	if _, err := ParseKademliaID(key); err != nil {
+		return Entry{}, false, nil
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if _, ok := store.index[key]; !ok {
+		return Entry{}, false, nil
+	}
+	entry, err := store.read(key)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// Delete removes the file of the key
+func (store *DiskStore) Delete(key string) error {
+	if _, err := ParseKademliaID(key); err != nil {
+		return nil
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := os.Remove(filepath.Join(store.dir, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(store.index, key)
+	return syncDir(store.dir)
+}
+
+// List returns the stored keys with their size and expiry
+func (store *DiskStore) List() ([]EntryInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	infos := make([]EntryInfo, 0, len(store.index))
+	for _, info := range store.index {
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Close releases the store, every write is already synced
+func (store *DiskStore) Close() error {
+	return nil
+}
+
+// write replaces the file of the key with the entry
+func (store *DiskStore) write(key string, entry Entry) error {
+	return writeFileAtomic(filepath.Join(store.dir, key), encodeDiskEntry(entry), 0o644)
+}
+
+// read reads and checks the file of the key
+func (store *DiskStore) read(key string) (Entry, error) {
+	content, err := os.ReadFile(filepath.Join(store.dir, key))
+	if err != nil {
+		return Entry{}, err
+	}
+	return decodeDiskEntry(content)
+}
+
+func encodeDiskEntry(entry Entry) []byte {
+	buf := make([]byte, diskHeaderSize+len(entry.Data))
+	buf[0] = diskMagic
+	buf[1] = diskVersion
+	binary.BigEndian.PutUint64(buf[2:10], uint64(entry.ExpiresAt.UnixNano()))
+	copy(buf[diskHeaderSize:], entry.Data)
+	binary.BigEndian.PutUint32(buf[10:14], diskChecksum(buf))
+	return buf
+}
+
+func decodeDiskEntry(content []byte) (Entry, error) {
+	if len(content) < diskHeaderSize {
+		return Entry{}, fmt.Errorf("%w: %d bytes is shorter than the header", ErrCorruptEntry, len(content))
+	}
+	if content[0] != diskMagic || content[1] != diskVersion {
+		return Entry{}, fmt.Errorf("%w: unknown format %#x version %d", ErrCorruptEntry, content[0], content[1])
+	}
+	if binary.BigEndian.Uint32(content[10:14]) != diskChecksum(content) {
+		return Entry{}, fmt.Errorf("%w: checksum mismatch", ErrCorruptEntry)
+	}
+	return Entry{
+		Data:      content[diskHeaderSize:],
+		ExpiresAt: time.Unix(0, int64(binary.BigEndian.Uint64(content[2:10]))),
+	}, nil
+}
+
+// diskChecksum returns the CRC-32 of the expiry and the data of an encoded entry
+func diskChecksum(content []byte) uint32 {
+	checksum := crc32.ChecksumIEEE(content[2:10])
+	return crc32.Update(checksum, crc32.IEEETable, content[diskHeaderSize:])
+}
+
+// writeFileAtomic replaces the file with the content through a synced temporary file,
+// so after a crash the file holds either the old or the new content
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	temp, err := os.OpenFile(path+diskTempSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(content)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+diskTempSuffix, path)
+	}
+	if err != nil {
+		os.Remove(path + diskTempSuffix)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory so a rename or remove in it survives a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
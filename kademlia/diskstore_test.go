@@ -0,0 +1,125 @@
+package kademlia
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openDiskStore(t *testing.T, dir string) *DiskStore {
+	store, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return store
+}
+
+func TestDiskStore_KeepsValuesAndExpiryAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	key := HashData([]byte("persisted")).String()
+	expiresAt := time.Now().Add(time.Hour)
+	store := openDiskStore(t, dir)
+	if err := store.Put(key, Entry{Data: []byte("persisted"), ExpiresAt: expiresAt}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	store.Close()
+
+	reopened := openDiskStore(t, dir)
+	entry, ok, err := reopened.Get(key)
+
+	if err != nil || !ok {
+		t.Fatalf("Expected the value after reopening, got %v %v", ok, err)
+	}
+	if string(entry.Data) != "persisted" || !entry.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the value and its expiry, got %q expiring at %v", entry.Data, entry.ExpiresAt)
+	}
+	if infos, _ := reopened.List(); len(infos) != 1 || infos[0].Key != key || infos[0].Size != len("persisted") {
+		t.Errorf("Unexpected list %v", infos)
+	}
+}
+
+func TestDiskStore_DeleteRemovesTheFile(t *testing.T) {
+	dir := t.TempDir()
+	key := HashData([]byte("deleted")).String()
+	store := openDiskStore(t, dir)
+	store.Put(key, Entry{Data: []byte("deleted"), ExpiresAt: time.Now().Add(time.Hour)})
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, ok, _ := store.Get(key); ok {
+		t.Error("Expected the value to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, key)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the file to be removed, got %v", err)
+	}
+}
+
+func TestDiskStore_RecoversFromUnfinishedWritesAndCorruptValues(t *testing.T) {
+	dir := t.TempDir()
+	good := HashData([]byte("good")).String()
+	corrupt := HashData([]byte("corrupt")).String()
+	truncated := HashData([]byte("truncated")).String()
+	store := openDiskStore(t, dir)
+	for _, key := range []string{good, corrupt, truncated} {
+		store.Put(key, Entry{Data: []byte(key), ExpiresAt: time.Now().Add(time.Hour)})
+	}
+	// A crash in the middle of a write leaves a temporary file, bit rot flips a byte of the data
+	os.WriteFile(filepath.Join(dir, good+diskTempSuffix), []byte("half a value"), 0o644)
+	content, _ := os.ReadFile(filepath.Join(dir, corrupt))
+	content[len(content)-1] ^= 0xff
+	os.WriteFile(filepath.Join(dir, corrupt), content, 0o644)
+	os.Truncate(filepath.Join(dir, truncated), diskHeaderSize-1)
+
+	reopened := openDiskStore(t, dir)
+
+	if entry, ok, _ := reopened.Get(good); !ok || string(entry.Data) != good {
+		t.Errorf("Expected the intact value to survive, got %q", entry.Data)
+	}
+	for _, key := range []string{corrupt, truncated} {
+		if _, ok, _ := reopened.Get(key); ok {
+			t.Errorf("Expected %s to be dropped", key)
+		}
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected only the intact value to be left on disk, got %d files", len(files))
+	}
+}
+
+func TestDiskStore_RejectsKeysThatAreNotIDs(t *testing.T) {
+	store := openDiskStore(t, t.TempDir())
+
+	if err := store.Put("../escape", Entry{Data: []byte("data")}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestDiskStore_TTLSurvivesNodeRestart(t *testing.T) {
+	dir := t.TempDir()
+	alive := HashData([]byte("alive")).String()
+	expired := HashData([]byte("expired")).String()
+	k := joiningNode()
+	k.Storage = openDiskStore(t, dir)
+	k.StoreWithTTL(alive, []byte("alive"), time.Hour)
+	k.StoreWithTTL(expired, []byte("expired"), time.Nanosecond)
+	k.Storage.Close()
+	time.Sleep(time.Millisecond)
+
+	restarted := joiningNode()
+	restarted.Storage = openDiskStore(t, dir)
+	restarted.ExpireData()
+
+	if data, ok := restarted.getData(alive); !ok || string(data) != "alive" {
+		t.Errorf("Expected the value to survive the restart, got %q", data)
+	}
+	if ttl := restarted.remainingTTL(alive); ttl > time.Hour || ttl < time.Hour-time.Minute {
+		t.Errorf("Expected the remaining TTL to be kept, got %v", ttl)
+	}
+	if _, ok, _ := restarted.Storage.Get(expired); ok {
+		t.Error("Expected the expired value to be deleted")
+	}
+}
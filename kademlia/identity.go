@@ -0,0 +1,132 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// S/Kademlia node IDs: the ID of a node is the SHA-1 of its Ed25519 public key, so a node cannot pick
+// where it lands in the ID space. The static puzzle makes a key expensive to generate, the SHA-1 of the ID
+// must start with Static zero bits. The dynamic puzzle makes the ID expensive to use, the SHA-1 of the ID
+// XOR a nonce must start with Dynamic zero bits. Both are cheap to check for the nodes that admit the ID.
+
+// MaxPuzzleBits bounds the difficulty of a puzzle, every bit doubles the time to solve it
+const MaxPuzzleBits = 24
+
+// DefaultPuzzle takes a fraction of a second to solve
+var DefaultPuzzle = PuzzleDifficulty{Static: 8, Dynamic: 12}
+
+var ErrInvalidIdentity = errors.New("invalid node identity")
+
+// PuzzleDifficulty is the number of leading zero bits the puzzles of a node ID require
+type PuzzleDifficulty struct {
+	Static  int
+	Dynamic int
+}
+
+// Identity is the key pair a node ID is derived from and the solution of the dynamic puzzle of the ID
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	Nonce      KademliaID
+}
+
+// NewIdentity generates key pairs until one solves the static puzzle and then solves the dynamic puzzle
+func NewIdentity(difficulty PuzzleDifficulty) (*Identity, error) {
+	if err := difficulty.Validate(); err != nil {
+		return nil, err
+	}
+	for {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error generating key: %w", err)
+		}
+		id := KademliaID(sha1.Sum(publicKey))
+		if leadingZeroBits(sha1.Sum(id[:])) < difficulty.Static {
+			continue
+		}
+		return &Identity{PublicKey: publicKey, PrivateKey: privateKey, Nonce: solveDynamicPuzzle(&id, difficulty.Dynamic)}, nil
+	}
+}
+
+// NewIdentityFromSeed returns the identity of the Ed25519 seed and nonce saved by an earlier run
+func NewIdentityFromSeed(seed []byte, nonce *KademliaID) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: key seed must be %d bytes", ErrInvalidIdentity, ed25519.SeedSize)
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	return &Identity{
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		PrivateKey: privateKey,
+		Nonce:      *nonce,
+	}, nil
+}
+
+// ID returns the node ID of the identity
+func (identity *Identity) ID() *KademliaID {
+	return KeyID(identity.PublicKey)
+}
+
+// Seed returns the seed the private key is derived from
+func (identity *Identity) Seed() []byte {
+	return identity.PrivateKey.Seed()
+}
+
+// VerifyIdentity checks that the ID is derived from the public key and that it solves both puzzles
+func VerifyIdentity(id *KademliaID, publicKey []byte, nonce []byte, difficulty PuzzleDifficulty) error {
+	if id == nil {
+		return fmt.Errorf("%w: no node ID", ErrInvalidIdentity)
+	}
+	if len(publicKey) != ed25519.PublicKeySize || len(nonce) != IDLength {
+		return fmt.Errorf("%w: no public key and nonce", ErrInvalidIdentity)
+	}
+	if KademliaID(sha1.Sum(publicKey)) != *id {
+		return fmt.Errorf("%w: ID is not derived from the public key", ErrInvalidIdentity)
+	}
+	if leadingZeroBits(sha1.Sum(id[:])) < difficulty.Static {
+		return fmt.Errorf("%w: static puzzle not solved", ErrInvalidIdentity)
+	}
+	if leadingZeroBits(dynamicPuzzleHash(id, (*KademliaID)(nonce))) < difficulty.Dynamic {
+		return fmt.Errorf("%w: dynamic puzzle not solved", ErrInvalidIdentity)
+	}
+	return nil
+}
+
+// Validate checks that solving the puzzles takes a bounded time
+func (difficulty PuzzleDifficulty) Validate() error {
+	if difficulty.Static < 0 || difficulty.Static > MaxPuzzleBits || difficulty.Dynamic < 0 || difficulty.Dynamic > MaxPuzzleBits {
+		return fmt.Errorf("puzzle difficulty must be between 0 and %d bits", MaxPuzzleBits)
+	}
+	return nil
+}
+
+// solveDynamicPuzzle tries nonces until the hash of the ID XOR the nonce starts with enough zero bits
+func solveDynamicPuzzle(id *KademliaID, zeroBits int) KademliaID {
+	var nonce KademliaID
+	for {
+		rand.Read(nonce[:])
+		if leadingZeroBits(dynamicPuzzleHash(id, &nonce)) >= zeroBits {
+			return nonce
+		}
+	}
+}
+
+func dynamicPuzzleHash(id *KademliaID, nonce *KademliaID) [IDLength]byte {
+	return sha1.Sum(id.CalcDistance(nonce)[:])
+}
+
+// leadingZeroBits returns the number of zero bits the hash starts with
+func leadingZeroBits(hash [IDLength]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
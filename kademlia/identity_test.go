@@ -0,0 +1,104 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+var testPuzzle = PuzzleDifficulty{Static: 4, Dynamic: 6}
+
+func testIdentity(t *testing.T) *Identity {
+	identity, err := NewIdentity(testPuzzle)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return identity
+}
+
+func TestNewIdentity_SolvesBothPuzzles(t *testing.T) {
+	identity := testIdentity(t)
+
+	if err := VerifyIdentity(identity.ID(), identity.PublicKey, identity.Nonce[:], testPuzzle); err != nil {
+		t.Errorf("Expected the new identity to verify, got %v", err)
+	}
+	id := identity.ID()
+	if zeros := leadingZeroBits(dynamicPuzzleHash(id, &identity.Nonce)); zeros < testPuzzle.Dynamic {
+		t.Errorf("Expected at least %d zero bits, got %d", testPuzzle.Dynamic, zeros)
+	}
+}
+
+func TestVerifyIdentity_RejectsClaimedIDsAndUnsolvedPuzzles(t *testing.T) {
+	identity := testIdentity(t)
+	cases := map[string]error{
+		"foreign ID":   VerifyIdentity(NewRandomKademliaID(), identity.PublicKey, identity.Nonce[:], testPuzzle),
+		"no proof":     VerifyIdentity(identity.ID(), nil, nil, testPuzzle),
+		"harder":       VerifyIdentity(identity.ID(), identity.PublicKey, identity.Nonce[:], PuzzleDifficulty{Static: 4, Dynamic: MaxPuzzleBits}),
+		"random nonce": VerifyIdentity(identity.ID(), identity.PublicKey, NewRandomKademliaID()[:], PuzzleDifficulty{Dynamic: MaxPuzzleBits}),
+	}
+	for name, err := range cases {
+		if !errors.Is(err, ErrInvalidIdentity) {
+			t.Errorf("%s: expected ErrInvalidIdentity, got %v", name, err)
+		}
+	}
+}
+
+func TestNewIdentityFromSeed_RestoresTheID(t *testing.T) {
+	identity := testIdentity(t)
+
+	restored, err := NewIdentityFromSeed(identity.Seed(), &identity.Nonce)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !restored.ID().Equals(identity.ID()) || restored.Nonce != identity.Nonce {
+		t.Error("Expected the same ID and nonce")
+	}
+}
+
+// secureNode creates a started node on the in-memory network that requires contacts to prove their ID
+func secureNode(t *testing.T, network *memnet.Network, address string, identity *Identity) *Kademlia {
+	k := memnetNode(t, network, address)
+	if identity != nil {
+		k.RoutingTable = NewRoutingTable(NewContact(identity.ID(), address))
+		k.Network.Identity = identity
+	}
+	puzzle := testPuzzle
+	k.Network.Puzzle = &puzzle
+	k.Start(context.Background())
+	t.Cleanup(func() { k.Stop() })
+	return k
+}
+
+func TestPuzzle_AdmitsOnlyContactsThatProveTheirID(t *testing.T) {
+	network := memnet.New(1)
+	secure := secureNode(t, network, "10.0.0.1:8000", testIdentity(t))
+	proven := secureNode(t, network, "10.0.0.2:8000", testIdentity(t))
+	plain := memnetNode(t, network, "10.0.0.3:8000")
+	plain.Start(context.Background())
+	t.Cleanup(func() { plain.Stop() })
+
+	// A plain node is answered but not admitted, a proven one is admitted
+	if err := plain.Network.SendPingMessage(context.Background(), &plain.RoutingTable.Me, &secure.RoutingTable.Me); err != nil {
+		t.Fatalf("Expected the plain node to get an answer, got %v", err)
+	}
+	if err := proven.Network.SendPingMessage(context.Background(), &proven.RoutingTable.Me, &secure.RoutingTable.Me); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The PING is answered before the contact is added
+	deadline := time.Now().Add(time.Second)
+	for len(secure.RoutingTable.AllContacts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	contacts := secure.RoutingTable.AllContacts()
+	if len(contacts) != 1 || !contacts[0].ID.Equals(proven.RoutingTable.Me.ID) {
+		t.Errorf("Expected only the proven node in the routing table, got %v", contacts)
+	}
+	if _, err := secure.Network.Ping(context.Background(), &secure.RoutingTable.Me, &plain.RoutingTable.Me); !errors.Is(err, ErrInvalidIdentity) {
+		t.Errorf("Expected the PONG of the plain node to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const rejoinCheckInterval = 10 * time.Second // how often the routing table is checked for being empty
+const rejoinMinBackoff = time.Second         // delay before the first retry of a failed rejoin
+const rejoinMaxBackoff = 5 * time.Minute     // upper bound of the delay between rejoin attempts
+
+var ErrNoSeedAnswered = errors.New("no bootstrap contact answered")
+
+// Join pings the seeds in parallel, adds the ones that answer to the routing table
+// and does a lookup on itself through them, returns the number of seeds that answered
+func (kademlia *Kademlia) Join(ctx context.Context, seeds []Contact) (int, error) {
+	answered := kademlia.pingSeeds(ctx, seeds)
+	if len(answered) == 0 {
+		return 0, ErrNoSeedAnswered
+	}
+	for _, contact := range answered {
+		kademlia.RoutingTable.AddContact(contact)
+	}
+	kademlia.routingLogger().Info("Joined the network", "answered", len(answered), "seeds", len(seeds))
+	me := kademlia.RoutingTable.Me
+	kademlia.NodeLookup(ctx, &me, "")
+	return len(answered), nil
+}
+
+// pingSeeds pings all seeds except this node in parallel and returns the contacts that answered
+func (kademlia *Kademlia) pingSeeds(ctx context.Context, seeds []Contact) []Contact {
+	me := kademlia.RoutingTable.Me
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var answered []Contact
+	for _, seed := range seeds {
+		if seed.Address == me.Address || (seed.ID != nil && seed.ID.Equals(me.ID)) {
+			continue
+		}
+		wg.Add(1)
+		go func(seed Contact) {
+			defer wg.Done()
+			contact, err := kademlia.Network.Ping(ctx, &me, &seed)
+			if err != nil {
+				kademlia.routingLogger().Warn("Bootstrap contact did not answer", "peer", seed.Address, "rpc", "PING", "err", err)
+				return
+			}
+			if contact.ID.Equals(me.ID) {
+				return
+			}
+			mutex.Lock()
+			answered = append(answered, contact)
+			mutex.Unlock()
+		}(seed)
+	}
+	wg.Wait()
+	return answered
+}
+
+// DiscoverAddress pings the seeds in parallel and returns the address they see this node at: the IP its PING
+// came from with the port of its own address, so a node behind NAT learns its public endpoint.
+// It must be called before the node starts, the address then replaces the one of RoutingTable.Me
+func (kademlia *Kademlia) DiscoverAddress(ctx context.Context, seeds []Contact) (string, error) {
+	me := kademlia.RoutingTable.Me
+	_, port, err := net.SplitHostPort(me.Address)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	observed := make(chan string, len(seeds))
+	var wg sync.WaitGroup
+	for _, seed := range seeds {
+		if seed.Address == me.Address {
+			continue
+		}
+		wg.Add(1)
+		go func(seed Contact) {
+			defer wg.Done()
+			_, address, err := kademlia.Network.ping(ctx, &me, &seed)
+			if err != nil {
+				kademlia.routingLogger().Debug("Bootstrap contact did not answer", "peer", seed.Address, "rpc", "PING", "err", err)
+				return
+			}
+			// Nodes of an older version do not tell the address they saw
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				observed <- host
+			}
+		}(seed)
+	}
+	go func() {
+		wg.Wait()
+		close(observed)
+	}()
+	host, ok := <-observed
+	if !ok {
+		return "", ErrNoSeedAnswered
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// ListenRejoin joins the network again through the seeds whenever the routing table has become empty,
+// failed attempts are retried with exponential backoff until the context is cancelled
+func (kademlia *Kademlia) ListenRejoin(ctx context.Context, seeds []Contact) {
+	if len(seeds) == 0 {
+		return
+	}
+	backoff := rejoinMinBackoff
+	timer := time.NewTimer(rejoinCheckInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		var delay time.Duration
+		delay, backoff = kademlia.rejoinIfEmpty(ctx, seeds, backoff)
+		timer.Reset(delay)
+	}
+}
+
+// rejoinIfEmpty joins through the seeds if the routing table is empty,
+// returns the delay until the next check and the backoff to use after the next failure
+func (kademlia *Kademlia) rejoinIfEmpty(ctx context.Context, seeds []Contact, backoff time.Duration) (time.Duration, time.Duration) {
+	if len(kademlia.RoutingTable.AllContacts()) > 0 {
+		return rejoinCheckInterval, rejoinMinBackoff
+	}
+	kademlia.routingLogger().Warn("Routing table is empty, rejoining the network")
+	if _, err := kademlia.Join(ctx, seeds); err != nil {
+		kademlia.routingLogger().Warn("Rejoin failed", "retry_in", backoff, "err", err)
+		return backoff, min(backoff*2, rejoinMaxBackoff)
+	}
+	return rejoinCheckInterval, rejoinMinBackoff
+}
@@ -0,0 +1,140 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+// listeningPeer starts a node on a loopback UDP socket and returns its contact
+func listeningPeer(t *testing.T) Contact {
+	return listeningNode(t, nil).RoutingTable.Me
+}
+
+// listeningNode starts a node on a loopback UDP socket, configure is applied before it starts listening
+func listeningNode(t *testing.T, configure func(k *Kademlia)) *Kademlia {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	peer := NewContact(NewRandomKademliaID(), conn.LocalAddr().String())
+	k := NewKademlia(NewRoutingTable(peer), conn)
+	if configure != nil {
+		configure(k)
+	}
+	go k.ListenActionChannel()
+	go k.Network.Listen(k)
+	return k
+}
+
+// joiningNode returns a node with a short RPC timeout that is not listening
+func joiningNode() *Kademlia {
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:1")
+	k := NewKademlia(NewRoutingTable(me), nil)
+	k.Network.Timeout = 50 * time.Millisecond
+	k.Network.Retries = 0
+	return k
+}
+
+func TestJoin_AddsAnsweringSeedsWithIDFromPong(t *testing.T) {
+	peer := listeningPeer(t)
+	silent, _ := silentPeer(t)
+	k := joiningNode()
+	seeds := []Contact{NewContact(nil, peer.Address), silent}
+
+	answered, err := k.Join(context.Background(), seeds)
+
+	if err != nil || answered != 1 {
+		t.Fatalf("Expected one answering seed, got %d (%v)", answered, err)
+	}
+	contacts := k.RoutingTable.AllContacts()
+	if len(contacts) != 1 || !contacts[0].ID.Equals(peer.ID) {
+		t.Errorf("Expected the answering seed with its own ID, got %v", contacts)
+	}
+}
+
+func TestJoin_ReturnsErrorWhenNoSeedAnswers(t *testing.T) {
+	silent, _ := silentPeer(t)
+	k := joiningNode()
+
+	_, err := k.Join(context.Background(), []Contact{silent})
+
+	if !errors.Is(err, ErrNoSeedAnswered) {
+		t.Fatalf("Expected ErrNoSeedAnswered, got %v", err)
+	}
+}
+
+func TestJoin_SkipsSelf(t *testing.T) {
+	k := joiningNode()
+
+	_, err := k.Join(context.Background(), []Contact{k.RoutingTable.Me})
+
+	if !errors.Is(err, ErrNoSeedAnswered) {
+		t.Fatalf("Expected ErrNoSeedAnswered, got %v", err)
+	}
+}
+
+func TestRejoinIfEmpty_BacksOffWhileJoinFails(t *testing.T) {
+	silent, _ := silentPeer(t)
+	k := joiningNode()
+
+	delay, backoff := k.rejoinIfEmpty(context.Background(), []Contact{silent}, time.Second)
+	if delay != time.Second || backoff != 2*time.Second {
+		t.Errorf("Expected to retry after 1s and back off to 2s, got %v and %v", delay, backoff)
+	}
+
+	_, backoff = k.rejoinIfEmpty(context.Background(), []Contact{silent}, rejoinMaxBackoff)
+	if backoff != rejoinMaxBackoff {
+		t.Errorf("Expected backoff to be capped at %v, got %v", rejoinMaxBackoff, backoff)
+	}
+}
+
+func TestRejoinIfEmpty_DoesNothingWithContacts(t *testing.T) {
+	silent, received := silentPeer(t)
+	k := joiningNode()
+	k.RoutingTable.AddContact(NewContact(NewRandomKademliaID(), "127.0.0.1:2"))
+
+	delay, backoff := k.rejoinIfEmpty(context.Background(), []Contact{silent}, time.Minute)
+
+	if delay != rejoinCheckInterval || backoff != rejoinMinBackoff {
+		t.Errorf("Expected the check interval and a reset backoff, got %v and %v", delay, backoff)
+	}
+	if atomic.LoadInt32(received) != 0 {
+		t.Error("Expected no seed to be pinged")
+	}
+}
+
+func TestDiscoverAddress_ReturnsTheIPSeenBySeedsWithTheOwnPort(t *testing.T) {
+	network := memnet.New(1)
+	seed := memnetNode(t, network, "10.0.0.1:8000")
+	seed.Start(context.Background())
+	t.Cleanup(func() { seed.Stop() })
+	// The node guessed the address of an interface the seed cannot see
+	k := memnetNode(t, network, "10.0.0.2:8000")
+	k.RoutingTable.Me.Address = "192.168.1.5:8000"
+
+	address, err := k.DiscoverAddress(context.Background(), []Contact{NewContact(nil, "10.0.0.1:8000")})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if address != "10.0.0.2:8000" {
+		t.Errorf("Expected 10.0.0.2:8000, got %q", address)
+	}
+}
+
+func TestDiscoverAddress_ReturnsErrorWhenNoSeedAnswers(t *testing.T) {
+	silent, _ := silentPeer(t)
+
+	_, err := joiningNode().DiscoverAddress(context.Background(), []Contact{silent})
+
+	if !errors.Is(err, ErrNoSeedAnswered) {
+		t.Errorf("Expected ErrNoSeedAnswered, got %v", err)
+	}
+}
@@ -1,17 +1,41 @@
 package kademlia
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"sort"
 	"sync"
+	"time"
 )
 
 type Kademlia struct {
-	RoutingTable  *RoutingTable
-	Network       *Network
-	Data          *map[string][]byte
-	ActionChannel chan Action
+	RoutingTable    *RoutingTable
+	Network         *Network
+	Storage         Store // values stored for other nodes, in memory unless replaced before the node starts
+	ActionChannel   chan Action
+	RefreshInterval time.Duration              // how long a bucket may go untouched before it is refreshed
+	Alpha           int                        // number of contacts probed in parallel during a lookup
+	K               int                        // number of contacts returned by a lookup and replicas per value
+	published       map[string]*publishedValue // values originally PUT by this node
+	dataMutex       sync.RWMutex               // guards published and read-modify-writes of Storage
+	stateMutex      sync.Mutex                 // serializes SaveState
+	routingLog      *slog.Logger
+	storeLog        *slog.Logger
+	lookupLog       *slog.Logger
+	Metrics         *Metrics
+	StateFile       string        // where the state is saved while the node runs and when it stops, empty to not save it
+	StateInterval   time.Duration // how often the state is saved while the node runs
+	HandoffOnStop   bool          // hand the stored values to the closest nodes before stopping
+	StreamListener  net.Listener  // TCP listener Start serves large packets on, they are sent in chunks if nil
+	StoreQuota      int           // bytes of values one publisher or one IP may have stored on the node, 0 for no limit
+	StorageLimit    int           // bytes of values all other nodes may have stored on the node, 0 for no limit
+	quota           storeQuota
+	lifecycle       lifecycle
+
+	// BeforeStop is called first by Stop, such as to shut down the HTTP API so the requests it serves finish
+	BeforeStop func(ctx context.Context) error
 }
 
 type Action struct {
@@ -21,6 +45,8 @@ type Action struct {
 	Data     []byte
 	SenderId *KademliaID
 	SenderIp string
+	TTL      time.Duration
+	RPCID    *KademliaID // ID the response is routed back on
 }
 
 type ShortListItem struct {
@@ -29,26 +55,47 @@ type ShortListItem struct {
 	Probed           bool
 }
 
-const alpha = 3
-const k = 5
+// DefaultAlpha is the number of parallel lookups and DefaultK the replication parameter,
+// a node can override them with its Alpha and K fields
+const DefaultAlpha = 3
+const DefaultK = 5
 
 // Constructor for Kademlia
 func NewKademlia(table *RoutingTable, conn net.PacketConn) *Kademlia {
-	network := NewNetwork(conn)
-	data := make(map[string][]byte)
+	return NewKademliaWithTransport(table, NewUDPTransport(conn))
+}
+
+// NewKademliaWithTransport creates a Kademlia instance whose network runs over the transport
+func NewKademliaWithTransport(table *RoutingTable, transport Transport) *Kademlia {
+	network := NewNetworkWithTransport(transport)
+	network.metrics = newMetrics()
 	actionChannel := make(chan Action)
-	return &Kademlia{table, network, &data, actionChannel}
+	kademlia := &Kademlia{
+		RoutingTable:    table,
+		Network:         network,
+		Storage:         NewMemoryStore(),
+		ActionChannel:   actionChannel,
+		RefreshInterval: DefaultRefreshInterval,
+		Alpha:           DefaultAlpha,
+		K:               DefaultK,
+		published:       make(map[string]*publishedValue),
+		Metrics:         network.metrics,
+		StoreQuota:      DefaultStoreQuota,
+		StorageLimit:    DefaultStorageLimit,
+	}
+	kademlia.SetLogger(slog.Default())
+	return kademlia
 }
 
 // FIND_NODE
 func (kademlia *Kademlia) LookupContact(target *Contact) []Contact {
-	closestContacts := kademlia.RoutingTable.FindClosestContacts(target.ID, k)
+	closestContacts := kademlia.RoutingTable.FindClosestContacts(target.ID, kademlia.kValue())
 	return closestContacts
 }
 
 // FIND_VALUE
 func (kademlia *Kademlia) LookupData(hash string) ([]byte, []Contact) {
-	if data, ok := (*kademlia.Data)[hash]; ok {
+	if data, ok := kademlia.getData(hash); ok {
 		return data, nil
 	}
 
@@ -58,53 +105,87 @@ func (kademlia *Kademlia) LookupData(hash string) ([]byte, []Contact) {
 }
 
 // STORE
-func (kademlia *Kademlia) Store(hash string, data []byte) {
-	(*kademlia.Data)[hash] = data
+func (kademlia *Kademlia) Store(hash string, data []byte) error {
+	return kademlia.StoreWithTTL(hash, data, tExpire)
+}
+
+// LookupStats counts the work done by one node lookup
+type LookupStats struct {
+	Rounds int // rounds of parallel FIND_NODE or FIND_DATA RPCs, the hop count of the lookup
+	RPCs   int // FIND_NODE or FIND_DATA RPCs sent
 }
 
 // NodeLookup is the main function for the NodeLookup algorithm
-func (kademlia *Kademlia) NodeLookup(target *Contact, hash string) ([]Contact, Contact, []byte) {
+func (kademlia *Kademlia) NodeLookup(ctx context.Context, target *Contact, hash string) ([]Contact, Contact, []byte) {
+	contacts, foundOn, data, _ := kademlia.NodeLookupWithStats(ctx, target, hash)
+	return contacts, foundOn, data
+}
+
+// NodeLookupWithStats is NodeLookup that also returns how many rounds and RPCs the lookup took
+func (kademlia *Kademlia) NodeLookupWithStats(ctx context.Context, target *Contact, hash string) ([]Contact, Contact, []byte, LookupStats) {
+	var stats LookupStats
+	kind := lookupKindNode
+	if hash != "" {
+		kind = lookupKindData
+	}
+	start := time.Now()
+	defer func() { kademlia.Metrics.lookupDone(kind, time.Since(start), stats) }()
+
+	// A lookup in the range of a bucket counts as using it
+	kademlia.RoutingTable.TouchBucket(target.ID)
 
 	// Initialize the shortlist with the alpha closest contacts
-	alphaContacts := kademlia.RoutingTable.FindClosestContacts(target.ID, alpha)
+	alphaContacts := kademlia.RoutingTable.FindClosestContacts(target.ID, kademlia.alphaValue())
 	var shortList []ShortListItem
 	for _, contact := range alphaContacts {
-		shortList = UpdateShortList(shortList, contact, target.ID)
+		shortList = UpdateShortList(shortList, contact, target.ID, kademlia.kValue())
+	}
+	if len(shortList) == 0 {
+		return nil, Contact{}, nil, stats
 	}
 
 	closestNode := shortList[0]
 
 	// Loop until k nodes are probed or no more unprobed nodes
 	for {
+		// Stop probing when the caller gives up on the lookup
+		if ctx.Err() != nil {
+			return GetAllContactsFromShortList(shortList), Contact{}, nil, stats
+		}
 		// Get the alpha closest unprobed contacts in the shortlist
 		temp := kademlia.GetAlphaNodes(shortList)
 		// If there are no unprobed contacts left (or k probed), return the shortlist
 		if len(temp) == 0 {
-			return GetAllContactsFromShortList(shortList), Contact{}, nil
+			return GetAllContactsFromShortList(shortList), Contact{}, nil, stats
 		}
 		notProbed := kademlia.GetAlphaNodes(shortList)
 		var contactFoundDataOn Contact
 		var foundData []byte
 
 		// Call to send alpha FIND_NODE messages
-		shortList, contactFoundDataOn, foundData = kademlia.SendAlphaFindNodeMessages(shortList, target, hash, notProbed)
-		//fmt.Println("DEBUG: Shortlist after sending messages", shortList)
+		stats.Rounds++
+		stats.RPCs += len(notProbed)
+		shortList, contactFoundDataOn, foundData = kademlia.SendAlphaFindNodeMessages(ctx, shortList, target, hash, notProbed)
 		// If data is found on a contact, return the contact and data
 		if foundData != nil {
-			fmt.Println("Done with Node lookup, found data")
-			return GetAllContactsFromShortList(shortList), contactFoundDataOn, foundData
+			kademlia.lookupLogger().Debug("Lookup found data", "target", target.ID.String(), "peer", contactFoundDataOn.Address, "rounds", stats.Rounds, "rpcs", stats.RPCs)
+			return GetAllContactsFromShortList(shortList), contactFoundDataOn, foundData, stats
 		}
 		newClosestNode := shortList[0]
 
 		// If the closest node is the same as before, check that k nodes have been probed or no more unprobed
 		if closestNode.Contact.ID.Equals(newClosestNode.Contact.ID) {
 			temp2 := kademlia.GetAlphaNodes(shortList)
-			if CountProbedInShortList(shortList) >= k || len(temp2) == 0 {
+			if CountProbedInShortList(shortList) >= kademlia.kValue() || len(temp2) == 0 {
 				break
 				// If there are unprobed nodes left, get alpha nodes from own routing table and send FIND_NODE messages
 			} else {
 				notProbedKClosest := kademlia.GetAlphaNodesFromKClosest(shortList, target)
-				newShortList, _, _ := kademlia.SendAlphaFindNodeMessages(shortList, target, hash, notProbedKClosest)
+				if len(notProbedKClosest) > 0 {
+					stats.Rounds++
+					stats.RPCs += len(notProbedKClosest)
+				}
+				newShortList, _, _ := kademlia.SendAlphaFindNodeMessages(ctx, shortList, target, hash, notProbedKClosest)
 				shortList = newShortList
 			}
 		} else {
@@ -113,35 +194,53 @@ func (kademlia *Kademlia) NodeLookup(target *Contact, hash string) ([]Contact, C
 		}
 
 	}
-	fmt.Println("Done with Node lookup ")
-	return GetAllContactsFromShortList(shortList), Contact{}, nil
+	kademlia.lookupLogger().Debug("Lookup done", "target", target.ID.String(), "rounds", stats.Rounds, "rpcs", stats.RPCs)
+	return GetAllContactsFromShortList(shortList), Contact{}, nil, stats
 }
 
 // UpdateRT updates the routing table with a new contact
 func (kademlia *Kademlia) UpdateRT(id *KademliaID, ip string) {
 	NewDiscoveredContact := NewContact(id, ip)
 	if !(NewDiscoveredContact.ID.Equals(kademlia.RoutingTable.Me.ID)) {
-		fmt.Println("Adding contact to routing table with ID: ", NewDiscoveredContact.ID.String()+" and IP: "+NewDiscoveredContact.Address+" on"+kademlia.RoutingTable.Me.Address)
+		log := kademlia.routingLogger().With("peer", NewDiscoveredContact.Address, "peer_id", NewDiscoveredContact.ID.String())
+		log.Debug("Adding contact to routing table")
 		NewDiscoveredContact.CalcDistance(kademlia.RoutingTable.Me.ID)
 
 		// Check if bucket is full
 		bucketIsFull, lastContact := kademlia.RoutingTable.AddContact(NewDiscoveredContact)
 		if bucketIsFull {
 			// If so, send ping to lastContact to see if it is alive
-			if kademlia.Network.SendPingMessage(&kademlia.RoutingTable.Me, lastContact) {
-				fmt.Println("Last contact is alive, discard new contact")
-			} else {
-				// If not, replace lastContact with new contact
-				fmt.Println("Last contact is dead, replace with new contact")
+			err := kademlia.Network.SendPingMessage(context.Background(), &kademlia.RoutingTable.Me, lastContact)
+			switch {
+			case err == nil:
+				// The new contact stays in the replacement cache of the bucket
+				log.Debug("Bucket is full and its oldest contact is alive, keeping the new contact as replacement", "oldest", lastContact.Address)
+				kademlia.RoutingTable.AddContact(*lastContact)
+			case errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnreachable):
+				// If not, remove lastContact so the newest replacement, the new contact, takes its place
+				log.Info("Replacing unresponsive oldest contact of a full bucket", "oldest", lastContact.Address)
 				kademlia.RoutingTable.RemoveContact(lastContact)
-				kademlia.RoutingTable.AddContact(NewDiscoveredContact)
+			default:
+				log.Warn("Could not tell if the oldest contact of a full bucket is alive, keeping it", "oldest", lastContact.Address, "err", err)
 			}
 		}
 	}
 }
 
-// UpdateShortList updates the shortlist with the new contact, list sorted by distance to target
-func UpdateShortList(shortList []ShortListItem, newContact Contact, target *KademliaID) []ShortListItem {
+// reportFailedRPC counts a timed out or unreachable RPC against the contact,
+// contacts that fail repeatedly are replaced by a candidate from the replacement cache
+func (kademlia *Kademlia) reportFailedRPC(contact Contact, err error) {
+	if kademlia.RoutingTable == nil || !(errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnreachable)) {
+		return
+	}
+	if kademlia.RoutingTable.MarkFailed(&contact) {
+		kademlia.routingLogger().Info("Evicted unresponsive contact", "peer", contact.Address, "peer_id", contact.ID.String(), "err", err)
+	}
+}
+
+// UpdateShortList updates the shortlist with the new contact, sorted by distance to the target,
+// and keeps at most size contacts, the K of the node doing the lookup
+func UpdateShortList(shortList []ShortListItem, newContact Contact, target *KademliaID, size int) []ShortListItem {
 	// If the new contact is already in the shortlist, don't add it
 	for _, item := range shortList {
 		if item.Contact.ID.Equals(newContact.ID) {
@@ -157,10 +256,10 @@ func UpdateShortList(shortList []ShortListItem, newContact Contact, target *Kade
 	sort.Slice(shortList, func(i, j int) bool {
 		return shortList[i].DistanceToTarget.Less(shortList[j].DistanceToTarget)
 	})
-	if len(shortList) < k {
+	if len(shortList) < size {
 		return shortList
 	}
-	return shortList[:k]
+	return shortList[:size]
 }
 
 // GetAllContactsFromShortList returns all contacts from the shortlist
@@ -173,7 +272,7 @@ func GetAllContactsFromShortList(shortList []ShortListItem) []Contact {
 }
 
 // probeContacts probes the contacts in the shortlist concurrently performing either FIND_NODE or FIND_DATA
-func (kademlia *Kademlia) probeContacts(notProbed []ShortListItem, target *Contact, hash string, contactsChan chan Contact, dataChan chan []byte, contactChanFoundDataOn chan Contact) {
+func (kademlia *Kademlia) probeContacts(ctx context.Context, notProbed []ShortListItem, target *Contact, hash string, contactsChan chan Contact, dataChan chan []byte, contactChanFoundDataOn chan Contact) {
 	var wg sync.WaitGroup
 	for _, contact := range notProbed {
 		wg.Add(1)
@@ -181,11 +280,10 @@ func (kademlia *Kademlia) probeContacts(notProbed []ShortListItem, target *Conta
 			defer wg.Done()
 			// If there is no hashed value to look for, do a FIND_NODE
 			if hash == "" {
-				kademlia.findContact(contact, target, contactsChan, dataChan, contactChanFoundDataOn)
+				kademlia.findContact(ctx, contact, target, contactsChan, dataChan, contactChanFoundDataOn)
 				// If there is a hashed value, do FIND_DATA
 			} else {
-				kademlia.findData(contact, hash, dataChan, contactChanFoundDataOn)
-				fmt.Println("DEBUG: Done with FindData")
+				kademlia.findData(ctx, contact, hash, dataChan, contactChanFoundDataOn)
 			}
 		}(contact.Contact)
 	}
@@ -209,11 +307,9 @@ func closeChannels(contactsChan chan Contact, dataChan chan []byte, contactChanF
 func handleFoundData(dataChan chan []byte, contactChanFoundDataOn chan Contact) (Contact, []byte) {
 	select {
 	case data := <-dataChan:
-		//fmt.Println("DEBUG: Data received from dataChan")
 		if data != nil {
 			foundContact := <-contactChanFoundDataOn
 			if foundContact.ID != nil {
-				//fmt.Println("DEBUG: Returning data and found contact")
 				return foundContact, data
 			}
 		}
@@ -224,6 +320,10 @@ func handleFoundData(dataChan chan []byte, contactChanFoundDataOn chan Contact)
 // updateShortListWithContacts updates the shortlist with the received contacts
 func (kademlia *Kademlia) updateShortListWithContacts(shortList []ShortListItem, target *Contact, contactsChan chan Contact) []ShortListItem {
 	for contact := range contactsChan {
+		// A contact that cannot be compared or reached has no place in the shortlist
+		if contact.ID == nil || contact.Address == "" {
+			continue
+		}
 		updated := false
 		for i, item := range shortList {
 			if item.Contact.ID.Equals(contact.ID) {
@@ -233,7 +333,7 @@ func (kademlia *Kademlia) updateShortListWithContacts(shortList []ShortListItem,
 			}
 		}
 		if !updated {
-			shortList = UpdateShortList(shortList, contact, target.ID)
+			shortList = UpdateShortList(shortList, contact, target.ID, kademlia.kValue())
 		}
 	}
 	return shortList
@@ -252,17 +352,17 @@ func markProbedContacts(shortList []ShortListItem, notProbed []ShortListItem) []
 }
 
 // SendAlphaFindNodeMessages sends alpha FIND_NODE messages to the contacts in the shortlist
-func (kademlia *Kademlia) SendAlphaFindNodeMessages(shortList []ShortListItem, target *Contact, hash string, notProbed []ShortListItem) ([]ShortListItem, Contact, []byte) {
-	contactsChan := make(chan Contact, alpha*k)
-	dataChan := make(chan []byte, alpha*k)
-	contactChanFoundDataOn := make(chan Contact, alpha*k)
+func (kademlia *Kademlia) SendAlphaFindNodeMessages(ctx context.Context, shortList []ShortListItem, target *Contact, hash string, notProbed []ShortListItem) ([]ShortListItem, Contact, []byte) {
+	bufferSize := kademlia.alphaValue() * kademlia.kValue()
+	contactsChan := make(chan Contact, bufferSize)
+	dataChan := make(chan []byte, bufferSize)
+	contactChanFoundDataOn := make(chan Contact, bufferSize)
 
 	// Probe the contacts concurrently
-	kademlia.probeContacts(notProbed, target, hash, contactsChan, dataChan, contactChanFoundDataOn)
+	kademlia.probeContacts(ctx, notProbed, target, hash, contactsChan, dataChan, contactChanFoundDataOn)
 
 	// Close channels after probing
 	closeChannels(contactsChan, dataChan, contactChanFoundDataOn)
-	fmt.Println("DEBUG: Done waiting for all contacts")
 
 	// Handle found data if any
 	foundContact, foundData := handleFoundData(dataChan, contactChanFoundDataOn)
@@ -280,10 +380,11 @@ func (kademlia *Kademlia) SendAlphaFindNodeMessages(shortList []ShortListItem, t
 }
 
 // findContact sends a FIND_NODE message to a contact and returns the contacts found
-func (kademlia *Kademlia) findContact(contact Contact, target *Contact, contactsChan chan Contact, dataChan chan []byte, contactChanFoundDataOn chan Contact) {
-	contacts, err := kademlia.Network.SendFindContactMessage(&kademlia.RoutingTable.Me, &contact, target)
+func (kademlia *Kademlia) findContact(ctx context.Context, contact Contact, target *Contact, contactsChan chan Contact, dataChan chan []byte, contactChanFoundDataOn chan Contact) {
+	contacts, err := kademlia.Network.SendFindContactMessage(ctx, &kademlia.RoutingTable.Me, &contact, target)
 	if err != nil {
-		fmt.Println(err)
+		kademlia.lookupLogger().Debug("FIND_NODE failed", "peer", contact.Address, "rpc", "FIND_NODE", "err", err)
+		kademlia.reportFailedRPC(contact, err)
 		return
 	}
 	for _, foundContact := range contacts {
@@ -292,19 +393,21 @@ func (kademlia *Kademlia) findContact(contact Contact, target *Contact, contacts
 			dataChan <- nil
 			contactChanFoundDataOn <- Contact{}
 		default:
-			fmt.Println("DEBUG: Channel is full, contact not sent:", foundContact.String())
+			kademlia.lookupLogger().Debug("Shortlist channel is full, dropping contact", "peer", foundContact.Address)
 		}
 	}
 }
 
 // findData sends a FIND_DATA message to a contact and returns the data if found
-func (kademlia *Kademlia) findData(contact Contact, hash string, dataChan chan []byte, contactChanFoundDataOn chan Contact) {
-	_, data, err := kademlia.Network.SendFindDataMessage(&kademlia.RoutingTable.Me, &contact, hash)
+func (kademlia *Kademlia) findData(ctx context.Context, contact Contact, hash string, dataChan chan []byte, contactChanFoundDataOn chan Contact) {
+	_, data, err := kademlia.Network.SendFindDataMessage(ctx, &kademlia.RoutingTable.Me, &contact, hash)
 	if err != nil {
+		kademlia.lookupLogger().Debug("FIND_DATA failed", "peer", contact.Address, "rpc", "FIND_DATA", "err", err)
+		kademlia.reportFailedRPC(contact, err)
 		return
 	}
 	if data != nil {
-		fmt.Println("DEBUG: Found data INSIDE NODE LOOKUP on contact", contact.String())
+		kademlia.lookupLogger().Debug("Found data", "peer", contact.Address, "key", hash)
 		dataChan <- data
 		contactChanFoundDataOn <- contact
 	}
@@ -318,64 +421,91 @@ func (kademlia *Kademlia) GetAlphaNodes(shortList []ShortListItem) []ShortListIt
 			notProbed = append(notProbed, item)
 		}
 	}
-	if len(notProbed) < alpha {
+	if len(notProbed) < kademlia.alphaValue() {
 		return notProbed
 	}
-	return notProbed[:alpha]
+	return notProbed[:kademlia.alphaValue()]
 }
 
 // GetAlphaNodesFromKClosest returns the alpha closest unprobed contacts from the k closest contacts of the target in the routing table
 func (kademlia *Kademlia) GetAlphaNodesFromKClosest(shortList []ShortListItem, target *Contact) []ShortListItem {
 	var notProbed []ShortListItem
-	alphaContacts := kademlia.RoutingTable.FindClosestContacts(target.ID, k)
+	alphaContacts := kademlia.RoutingTable.FindClosestContacts(target.ID, kademlia.kValue())
 
 	for _, item := range alphaContacts {
 		//if the new contact is already in the shortlist, don't add it
 		for _, shortItem := range shortList {
-			if item.ID.Equals(shortItem.Contact.ID) || len(notProbed) >= alpha {
+			if item.ID.Equals(shortItem.Contact.ID) || len(notProbed) >= kademlia.alphaValue() {
 				continue
 			} else {
 				notProbed = append(notProbed, ShortListItem{item, item.ID.CalcDistance(target.ID), false})
 			}
 		}
 	}
-	if len(notProbed) < alpha {
+	if len(notProbed) < kademlia.alphaValue() {
 		return notProbed
 	}
-	return notProbed[:alpha]
+	return notProbed[:kademlia.alphaValue()]
+}
+
+// alphaValue returns the number of contacts probed in parallel during a lookup
+func (kademlia *Kademlia) alphaValue() int {
+	if kademlia.Alpha <= 0 {
+		return DefaultAlpha
+	}
+	return kademlia.Alpha
+}
+
+// kValue returns the number of contacts returned by a lookup
+func (kademlia *Kademlia) kValue() int {
+	if kademlia.K <= 0 {
+		return DefaultK
+	}
+	return kademlia.K
 }
 
 // ListenActionChannel listens to the action channel and performs the action received
 func (kademlia *Kademlia) ListenActionChannel() {
-	fmt.Println("DEBUG: Listening to action channel")
+	kademlia.listenActions(context.Background())
+}
+
+// listenActions performs the actions received on the action channel until the context is cancelled
+func (kademlia *Kademlia) listenActions(ctx context.Context) {
 	for {
-		action := <-kademlia.ActionChannel
-		fmt.Println("DEBUG: Received action", action)
-		switch action.Action {
-		case "UpdateRT":
-			fmt.Println("DEBUG: Updating RT")
-			kademlia.UpdateRT(action.SenderId, action.SenderIp)
-		case "Store":
-			kademlia.Store(action.Hash, action.Data)
-		case "LookupContact":
-			fmt.Println("DEBUG: Looking up contact")
-			contacts := kademlia.LookupContact(action.Target)
-			//send contacts back to channel
-			response := Response{
-				ClosestContacts: contacts,
-			}
-			fmt.Println("DEBUG: Sending response", response)
-			kademlia.Network.responseChan <- response
-		case "LookupData":
-			data, contacts := kademlia.LookupData(action.Hash)
-			response := Response{
-				Data:            data,
-				ClosestContacts: contacts,
-			}
-			kademlia.Network.responseChan <- response
-		case "PRINT":
-			kademlia.RoutingTable.PrintAllIP()
+		select {
+		case <-ctx.Done():
+			return
+		case action := <-kademlia.ActionChannel:
+			kademlia.performAction(action)
+		}
+	}
+}
+
+// performAction performs an action received on the action channel
+func (kademlia *Kademlia) performAction(action Action) {
+	// The data is left out, values can be megabytes large
+	kademlia.routingLogger().Debug("Received action", "action", action.Action, "key", action.Hash)
+	switch action.Action {
+	case "UpdateRT":
+		kademlia.UpdateRT(action.SenderId, action.SenderIp)
+	case "Store", "StoreIfMissing":
+		kademlia.storeForPeer(action)
+	case "LookupContact":
+		contacts := kademlia.LookupContact(action.Target)
+		//send contacts back to channel
+		response := Response{
+			ClosestContacts: contacts,
+		}
+		kademlia.Network.deliverResponse(action.RPCID, response)
+	case "LookupData":
+		data, contacts := kademlia.LookupData(action.Hash)
+		response := Response{
+			Data:            data,
+			ClosestContacts: contacts,
 		}
+		kademlia.Network.deliverResponse(action.RPCID, response)
+	case "PRINT":
+		kademlia.RoutingTable.PrintAllIP()
 	}
 }
 
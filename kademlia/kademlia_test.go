@@ -20,8 +20,8 @@ func TestKademlia_CreatesNewInstance(t *testing.T) {
 	if k.Network == nil {
 		t.Error("Expected Network to be initialized, got nil")
 	}
-	if k.Data == nil {
-		t.Error("Expected Data to be initialized, got nil")
+	if k.Storage == nil {
+		t.Error("Expected Storage to be initialized, got nil")
 	}
 	if k.ActionChannel == nil {
 		t.Error("Expected ActionChannel to be initialized, got nil")
@@ -75,7 +75,8 @@ func TestLookupContact_ReturnsEmptyWhenNoContacts(t *testing.T) {
 	}
 }
 func TestLookupData_ReturnsDataWhenExists(t *testing.T) {
-	kademlia := &Kademlia{Data: &map[string][]byte{"hash1": []byte("data1")}}
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+	kademlia.Store("hash1", []byte("data1"))
 	data, contacts := kademlia.LookupData("hash1")
 
 	if data == nil || string(data) != "data1" {
@@ -88,7 +89,7 @@ func TestLookupData_ReturnsDataWhenExists(t *testing.T) {
 
 func TestLookupData_ReturnsClosestContactsWhenDataNotExists(t *testing.T) {
 	kademlia := &Kademlia{
-		Data:         &map[string][]byte{},
+		Storage:      NewMemoryStore(),
 		RoutingTable: NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000")),
 	}
 	hasher := sha1.New()
@@ -114,7 +115,7 @@ func TestLookupData_ReturnsClosestContactsWhenDataNotExists(t *testing.T) {
 
 func TestLookupData_ReturnsEmptyContactsWhenNoClosestContacts(t *testing.T) {
 	kademlia := &Kademlia{
-		Data:         &map[string][]byte{},
+		Storage:      NewMemoryStore(),
 		RoutingTable: NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000")),
 	}
 	hasher := sha1.New()
@@ -133,50 +134,55 @@ func TestLookupData_ReturnsEmptyContactsWhenNoClosestContacts(t *testing.T) {
 }
 
 func TestStore_SavesDataCorrectly(t *testing.T) {
-	kademlia := &Kademlia{Data: &map[string][]byte{}}
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
 	hash := "hash1"
 	data := []byte("data1")
 
 	kademlia.Store(hash, data)
 
-	if storedData, ok := (*kademlia.Data)[hash]; !ok || string(storedData) != "data1" {
-		t.Errorf("Expected data 'data1' to be stored, got %s", string(storedData))
+	entry, ok, _ := kademlia.Storage.Get(hash)
+	if !ok || string(entry.Data) != "data1" {
+		t.Errorf("Expected data 'data1' to be stored, got %s", string(entry.Data))
 	}
 }
 
 func TestStore_OverwritesExistingData(t *testing.T) {
-	kademlia := &Kademlia{Data: &map[string][]byte{"hash1": []byte("oldData")}}
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+	kademlia.Store("hash1", []byte("oldData"))
 	hash := "hash1"
 	data := []byte("newData")
 
 	kademlia.Store(hash, data)
 
-	if storedData, ok := (*kademlia.Data)[hash]; !ok || string(storedData) != "newData" {
-		t.Errorf("Expected data 'newData' to be stored, got %s", string(storedData))
+	entry, ok, _ := kademlia.Storage.Get(hash)
+	if !ok || string(entry.Data) != "newData" {
+		t.Errorf("Expected data 'newData' to be stored, got %s", string(entry.Data))
 	}
 }
 
 func TestStore_HandlesEmptyData(t *testing.T) {
-	kademlia := &Kademlia{Data: &map[string][]byte{}}
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
 	hash := "hash1"
 	data := []byte("")
 
 	kademlia.Store(hash, data)
 
-	if storedData, ok := (*kademlia.Data)[hash]; !ok || string(storedData) != "" {
-		t.Errorf("Expected empty data to be stored, got %s", string(storedData))
+	entry, ok, _ := kademlia.Storage.Get(hash)
+	if !ok || string(entry.Data) != "" {
+		t.Errorf("Expected empty data to be stored, got %s", string(entry.Data))
 	}
 }
 
 func TestStore_HandlesNilData(t *testing.T) {
-	kademlia := &Kademlia{Data: &map[string][]byte{}}
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
 	hash := "hash1"
 	var data []byte = nil
 
 	kademlia.Store(hash, data)
 
-	if storedData, ok := (*kademlia.Data)[hash]; !ok || storedData != nil {
-		t.Errorf("Expected nil data to be stored, got %v", storedData)
+	entry, ok, _ := kademlia.Storage.Get(hash)
+	if !ok || entry.Data != nil {
+		t.Errorf("Expected nil data to be stored, got %v", entry.Data)
 	}
 }
 func TestKademlia_UpdateRT(t *testing.T) {
@@ -250,7 +256,7 @@ func TestUpdateShortList_AddsNewContact(t *testing.T) {
 	contact := NewContact(NewRandomKademliaID(), "172.20.0.10:8000")
 	shortList := []ShortListItem{}
 
-	updatedShortList := UpdateShortList(shortList, contact, targetID)
+	updatedShortList := UpdateShortList(shortList, contact, targetID, DefaultK)
 
 	if len(updatedShortList) != 1 {
 		t.Errorf("Expected 1 contact in shortlist, got %d", len(updatedShortList))
@@ -306,7 +312,7 @@ func TestGetAlphaNodesFromKClosest_StopsAtAlpha(t *testing.T) {
 	shortList := []ShortListItem{}
 	target := NewContact(NewRandomKademliaID(), "172.20.0.12:8000")
 
-	for i := 0; i < alpha+1; i++ {
+	for i := 0; i < DefaultAlpha+1; i++ {
 		contact := NewContact(NewRandomKademliaID(), fmt.Sprintf("172.20.0.%d:8000", i))
 		kademlia.RoutingTable.AddContact(contact)
 		shortList = append(shortList, ShortListItem{Contact: contact, Probed: false})
@@ -314,8 +320,8 @@ func TestGetAlphaNodesFromKClosest_StopsAtAlpha(t *testing.T) {
 
 	notProbed := kademlia.GetAlphaNodesFromKClosest(shortList, &target)
 
-	if len(notProbed) != alpha {
-		t.Errorf("Expected %d not probed contacts, got %d", alpha, len(notProbed))
+	if len(notProbed) != DefaultAlpha {
+		t.Errorf("Expected %d not probed contacts, got %d", DefaultAlpha, len(notProbed))
 	}
 }
 
@@ -326,7 +332,7 @@ func TestUpdateShortList_DoesNotAddDuplicateContact(t *testing.T) {
 		{Contact: contact, DistanceToTarget: contact.ID.CalcDistance(targetID), Probed: false},
 	}
 
-	updatedShortList := UpdateShortList(shortList, contact, targetID)
+	updatedShortList := UpdateShortList(shortList, contact, targetID, DefaultK)
 
 	if len(updatedShortList) != 1 {
 		t.Errorf("Expected 1 contact in shortlist, got %d", len(updatedShortList))
@@ -336,16 +342,16 @@ func TestUpdateShortList_DoesNotAddDuplicateContact(t *testing.T) {
 func TestUpdateShortList_RespectsMaxK(t *testing.T) {
 	targetID := NewRandomKademliaID()
 	shortList := []ShortListItem{}
-	for i := 0; i < k; i++ {
+	for i := 0; i < DefaultK; i++ {
 		contact := NewContact(NewRandomKademliaID(), fmt.Sprintf("172.20.0.%d:8000", i))
 		shortList = append(shortList, ShortListItem{Contact: contact, DistanceToTarget: contact.ID.CalcDistance(targetID), Probed: false})
 	}
 	newContact := NewContact(NewRandomKademliaID(), "172.20.0.100:8000")
 
-	updatedShortList := UpdateShortList(shortList, newContact, targetID)
+	updatedShortList := UpdateShortList(shortList, newContact, targetID, DefaultK)
 
-	if len(updatedShortList) != k {
-		t.Errorf("Expected %d contacts in shortlist, got %d", k, len(updatedShortList))
+	if len(updatedShortList) != DefaultK {
+		t.Errorf("Expected %d contacts in shortlist, got %d", DefaultK, len(updatedShortList))
 	}
 }
 
@@ -357,12 +363,30 @@ func TestUpdateShortList_SortsByDistance(t *testing.T) {
 		{Contact: contact1, DistanceToTarget: contact1.ID.CalcDistance(targetID), Probed: false},
 	}
 
-	updatedShortList := UpdateShortList(shortList, contact2, targetID)
+	updatedShortList := UpdateShortList(shortList, contact2, targetID, DefaultK)
 
 	if !updatedShortList[0].DistanceToTarget.Less(updatedShortList[1].DistanceToTarget) {
 		t.Error("Expected contacts to be sorted by distance to target")
 	}
 }
+
+func TestUpdateShortListWithContacts_SkipsContactsWithoutIDOrAddress(t *testing.T) {
+	k := NewKademlia(NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000")), nil)
+	target := NewContact(NewRandomKademliaID(), "")
+	valid := NewContact(NewRandomKademliaID(), "172.20.0.10:8000")
+	shortList := []ShortListItem{{Contact: valid, DistanceToTarget: valid.ID.CalcDistance(target.ID)}}
+	contacts := make(chan Contact, 2)
+	contacts <- Contact{Address: "172.20.0.11:8000"}
+	contacts <- Contact{ID: NewRandomKademliaID()}
+	close(contacts)
+
+	updatedShortList := k.updateShortListWithContacts(shortList, &target, contacts)
+
+	if len(updatedShortList) != 1 {
+		t.Errorf("Expected only the valid contact in the shortlist, got %v", updatedShortList)
+	}
+}
+
 func TestGetAllContactsFromShortList_ReturnsAllContacts(t *testing.T) {
 	shortList := []ShortListItem{
 		{Contact: NewContact(NewRandomKademliaID(), "172.20.0.10:8000")},
@@ -453,8 +477,8 @@ func TestGetAlphaNodes_ReturnsUpToAlphaContacts(t *testing.T) {
 
 	notProbed := kademlia.GetAlphaNodes(shortList)
 
-	if len(notProbed) != alpha {
-		t.Errorf("Expected %d not probed contacts, got %d", alpha, len(notProbed))
+	if len(notProbed) != DefaultAlpha {
+		t.Errorf("Expected %d not probed contacts, got %d", DefaultAlpha, len(notProbed))
 	}
 }
 
@@ -577,14 +601,14 @@ func TestListenActionChannel_UpdatesRT(t *testing.T) {
 }
 
 func TestListenActionChannel_StoresData(t *testing.T) {
-	kademlia := &Kademlia{Data: &map[string][]byte{}, ActionChannel: make(chan Action, 1)}
+	kademlia := &Kademlia{Storage: NewMemoryStore(), ActionChannel: make(chan Action, 1)}
 	action := Action{Action: "Store", Hash: "hash1", Data: []byte("data1")}
 
 	go kademlia.ListenActionChannel()
 	kademlia.ActionChannel <- action
 	time.Sleep(1 * time.Second)
 
-	if storedData, ok := (*kademlia.Data)[action.Hash]; !ok || string(storedData) != "data1" {
+	if storedData, ok := kademlia.getData(action.Hash); !ok || string(storedData) != "data1" {
 		t.Errorf("Expected data 'data1' to be stored, got %s", string(storedData))
 	}
 }
@@ -593,14 +617,16 @@ func TestListenActionChannel_LookupContact(t *testing.T) {
 	rt := NewRoutingTable(me)
 	conn := &net.UDPConn{}
 	kademlia := NewKademlia(rt, conn)
-	kademlia.Network = &Network{responseChan: make(chan Response, 1)}
+	kademlia.Network = NewNetwork(nil)
 	target := NewContact(NewRandomKademliaID(), "172.20.11:8000")
 	kademlia.RoutingTable.AddContact(target)
-	action := Action{Action: "LookupContact", Target: &target}
+	rpcID := NewRandomKademliaID()
+	responseChan := kademlia.Network.registerRPC(rpcID)
+	action := Action{Action: "LookupContact", Target: &target, RPCID: rpcID}
 	go kademlia.ListenActionChannel()
 	kademlia.ActionChannel <- action
 	time.Sleep(1 * time.Second)
-	response := <-kademlia.Network.responseChan
+	response := <-responseChan
 	fmt.Print(response, "response")
 	if len(response.ClosestContacts) != 1 || !response.ClosestContacts[0].ID.Equals(target.ID) {
 		t.Errorf("Expected contact ID %s, got %v", target.ID.String(), response.ClosestContacts)
@@ -611,14 +637,17 @@ func TestListenActionChannel_LookupData(t *testing.T) {
 	hasher.Write([]byte("hash1"))
 	hash := hasher.Sum(nil)
 	hashString := hex.EncodeToString(hash)
-	kademlia := &Kademlia{Data: &map[string][]byte{hashString: []byte("data1")}, ActionChannel: make(chan Action, 1)}
-	kademlia.Network = &Network{responseChan: make(chan Response, 1)}
-	action := Action{Action: "LookupData", Hash: hashString}
+	kademlia := &Kademlia{Storage: NewMemoryStore(), ActionChannel: make(chan Action, 1)}
+	kademlia.Store(hashString, []byte("data1"))
+	kademlia.Network = NewNetwork(nil)
+	rpcID := NewRandomKademliaID()
+	responseChan := kademlia.Network.registerRPC(rpcID)
+	action := Action{Action: "LookupData", Hash: hashString, RPCID: rpcID}
 	go kademlia.ListenActionChannel()
 	kademlia.ActionChannel <- action
 	time.Sleep(1 * time.Second)
 
-	response := <-kademlia.Network.responseChan
+	response := <-responseChan
 	if response.Data == nil || string(response.Data) != "data1" {
 		t.Errorf("Expected data 'data1', got %s", string(response.Data))
 	}
@@ -719,7 +748,7 @@ func TestUpdateShortListWithContacts_AddsNewContacts(t *testing.T) {
 		close(contactsChan)
 	}()
 	kademlia := &Kademlia{ActionChannel: make(chan Action, 1)}
-	kademlia.Network = &Network{responseChan: make(chan Response, 1)}
+	kademlia.Network = NewNetwork(nil)
 	updatedShortList := kademlia.updateShortListWithContacts(shortList, &target, contactsChan)
 
 	if len(updatedShortList) != 1 {
@@ -737,7 +766,7 @@ func TestUpdateShortListWithContacts_HandlesEmptyChannel(t *testing.T) {
 
 	close(contactsChan)
 	kademlia := &Kademlia{ActionChannel: make(chan Action, 1)}
-	kademlia.Network = &Network{responseChan: make(chan Response, 1)}
+	kademlia.Network = NewNetwork(nil)
 	updatedShortList := kademlia.updateShortListWithContacts(shortList, &target, contactsChan)
 
 	if len(updatedShortList) != 0 {
@@ -759,7 +788,7 @@ func TestUpdateShortListWithContacts_UpdatesExistingContacts(t *testing.T) {
 		close(contactsChan)
 	}()
 	kademlia := &Kademlia{ActionChannel: make(chan Action, 1)}
-	kademlia.Network = &Network{responseChan: make(chan Response, 1)}
+	kademlia.Network = NewNetwork(nil)
 	updatedShortList := kademlia.updateShortListWithContacts(shortList, &target, contactsChan)
 
 	if len(updatedShortList) != 1 {
@@ -839,3 +868,32 @@ func TestMarkProbedContacts_HandlesNilNotProbedList(t *testing.T) {
 		t.Errorf("Expected contact %s to not be probed", updatedShortList[0].Contact.ID.String())
 	}
 }
+
+func TestKademlia_UpdateRT_ReplacesDeadLastContact(t *testing.T) {
+	me := NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "127.0.0.1:8000")
+	network := NewNetwork(nil)
+	network.Timeout = 50 * time.Millisecond
+	network.Retries = 0
+	kademlia := &Kademlia{RoutingTable: NewRoutingTable(me), Network: network}
+	// All contacts share bucket 0 and point to a closed port, so the last contact is dead
+	for i := 0; i < bucketSize; i++ {
+		kademlia.RoutingTable.AddContact(NewContact(NewKademliaID(fmt.Sprintf("%040x", i+1)), "127.0.0.1:1"))
+	}
+	newID := NewKademliaID(fmt.Sprintf("%040x", bucketSize+1))
+
+	kademlia.UpdateRT(newID, "127.0.0.1:8001")
+
+	contacts := kademlia.RoutingTable.BucketContacts(0)
+	found := false
+	for _, contact := range contacts {
+		if contact.ID.Equals(newID) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected new contact to replace the dead last contact, got %v", contacts)
+	}
+	if len(contacts) != bucketSize {
+		t.Errorf("Expected bucket to stay full, got %d contacts", len(contacts))
+	}
+}
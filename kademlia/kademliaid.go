@@ -1,34 +1,38 @@
 package kademlia
 
 import (
+	"crypto/rand"
 	"encoding/hex"
-	"math/rand"
+	"errors"
+	"fmt"
 )
 
 // the static number of bytes in a KademliaID
 const IDLength = 20
 
+var ErrInvalidID = errors.New("invalid KademliaID")
+
 // type definition of a KademliaID
 type KademliaID [IDLength]byte
 
-// NewKademliaID returns a new instance of a KademliaID based on the string input
+// NewKademliaID returns a new instance of a KademliaID based on the string input, input that is not
+// a hex encoded KademliaID gives a zero padded ID, values received from other nodes go through ParseKademliaID
 func NewKademliaID(data string) *KademliaID {
 	decoded, _ := hex.DecodeString(data)
 
 	newKademliaID := KademliaID{}
-	for i := 0; i < IDLength; i++ {
-		newKademliaID[i] = decoded[i]
-	}
+	copy(newKademliaID[:], decoded)
 
 	return &newKademliaID
 }
 
-// NewRandomKademliaID returns a new instance of a random KademliaID,
-// change this to a better version if you like
+// NewRandomKademliaID returns a new instance of a random KademliaID read from crypto/rand,
+// so IDs cannot be predicted from earlier ones
 func NewRandomKademliaID() *KademliaID {
 	newKademliaID := KademliaID{}
-	for i := 0; i < IDLength; i++ {
-		newKademliaID[i] = uint8(rand.Intn(256))
+	// crypto/rand only fails if the system has no source of randomness, no ID is safe without one
+	if _, err := rand.Read(newKademliaID[:]); err != nil {
+		panic(fmt.Sprintf("error reading random bytes: %v", err))
 	}
 	return &newKademliaID
 }
@@ -67,3 +71,15 @@ func (kademliaID KademliaID) CalcDistance(target *KademliaID) *KademliaID {
 func (kademliaID *KademliaID) String() string {
 	return hex.EncodeToString(kademliaID[0:IDLength])
 }
+
+// ParseKademliaID decodes a KademliaID from IDLength*2 hex characters of either case,
+// a value it accepts is also a safe file name
+func ParseKademliaID(value string) (*KademliaID, error) {
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != IDLength {
+		return nil, fmt.Errorf("%w: %q must be %d hex characters", ErrInvalidID, value, IDLength*2)
+	}
+	id := KademliaID{}
+	copy(id[:], decoded)
+	return &id, nil
+}
@@ -0,0 +1,34 @@
+package kademlia
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseKademliaID_AcceptsEitherCase(t *testing.T) {
+	id := NewRandomKademliaID()
+
+	for _, value := range []string{id.String(), strings.ToUpper(id.String())} {
+		parsed, err := ParseKademliaID(value)
+		if err != nil || !parsed.Equals(id) {
+			t.Errorf("Expected %s to parse as %s, got %v, %v", value, id, parsed, err)
+		}
+	}
+}
+
+func TestParseKademliaID_RejectsInvalidIDs(t *testing.T) {
+	for _, value := range []string{"", "abc", strings.Repeat("g", IDLength*2), strings.Repeat("a", IDLength*2+2)} {
+		if _, err := ParseKademliaID(value); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("Expected ErrInvalidID for %q, got %v", value, err)
+		}
+	}
+}
+
+func TestNewKademliaID_PadsShortInput(t *testing.T) {
+	id := NewKademliaID("ab")
+
+	if id[0] != 0xab || *id != (KademliaID{0xab}) {
+		t.Errorf("Expected a zero padded ID, got %s", id)
+	}
+}
@@ -0,0 +1,172 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// handoffTimeout bounds the time Stop spends handing the stored values to other nodes
+const handoffTimeout = 30 * time.Second
+
+// beforeStopTimeout bounds the time Stop waits for BeforeStop
+const beforeStopTimeout = 10 * time.Second
+
+var (
+	ErrAlreadyStarted = errors.New("node already started")
+	ErrStopped        = errors.New("node stopped")
+)
+
+// lifecycle tracks the goroutines of a node started by Start
+type lifecycle struct {
+	mutex       sync.Mutex
+	started     bool
+	stopped     bool
+	cancel      context.CancelFunc // stops the tickers and the state saver
+	stopActions context.CancelFunc // stops the action loop once nothing sends to it anymore
+	listening   chan struct{}      // closed when Network.Listen returns
+	loops       sync.WaitGroup
+	stopOnce    sync.Once
+	stopErr     error
+}
+
+// Start runs the node in the background: it listens for messages, performs the actions they ask for,
+// serves streams on StreamListener, republishes and refreshes, and saves its state every StateInterval if StateFile is set.
+// The node stops as if Stop was called when the context is cancelled
+func (kademlia *Kademlia) Start(ctx context.Context) error {
+	lc := &kademlia.lifecycle
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if lc.stopped {
+		return ErrStopped
+	}
+	if lc.started {
+		return ErrAlreadyStarted
+	}
+	lc.started = true
+	ctx, lc.cancel = context.WithCancel(ctx)
+	// The action loop outlives the context, it performs the actions of the handlers still running
+	actionCtx, stopActions := context.WithCancel(context.Background())
+	lc.stopActions = stopActions
+	lc.listening = make(chan struct{})
+
+	kademlia.restoreQuota()
+	kademlia.runLoop(func() { kademlia.listenActions(actionCtx) })
+	go func() {
+		defer close(lc.listening)
+		kademlia.Network.Listen(kademlia)
+	}()
+	if kademlia.StreamListener != nil {
+		kademlia.runLoop(func() { kademlia.Network.ServeStreams(kademlia.StreamListener) })
+	}
+	kademlia.runLoop(func() { kademlia.ListenRepublishTicker(ctx) })
+	kademlia.runLoop(func() { kademlia.ListenRefreshTicker(ctx) })
+	if kademlia.StateFile != "" {
+		kademlia.runLoop(func() { kademlia.ListenStateSaver(ctx, kademlia.StateFile, kademlia.StateInterval) })
+	}
+	go func() {
+		<-ctx.Done()
+		kademlia.Stop()
+	}()
+	return nil
+}
+
+// runLoop runs fn in a goroutine that Stop waits for
+func (kademlia *Kademlia) runLoop(fn func()) {
+	kademlia.lifecycle.loops.Add(1)
+	go func() {
+		defer kademlia.lifecycle.loops.Done()
+		fn()
+	}()
+}
+
+// Stop shuts the node down: it calls BeforeStop, hands the stored values to the closest nodes if HandoffOnStop is set,
+// stops the background loops, closes the sockets, performs the actions already received,
+// saves the state if StateFile is set and closes the store. Later calls return the result of the first
+func (kademlia *Kademlia) Stop() error {
+	lc := &kademlia.lifecycle
+	lc.stopOnce.Do(func() { lc.stopErr = kademlia.stop() })
+	return lc.stopErr
+}
+
+func (kademlia *Kademlia) stop() error {
+	lc := &kademlia.lifecycle
+	lc.mutex.Lock()
+	started := lc.started
+	lc.stopped = true
+	lc.mutex.Unlock()
+	kademlia.routingLogger().Info("Stopping node")
+
+	var errs []error
+	if kademlia.BeforeStop != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), beforeStopTimeout)
+		if err := kademlia.BeforeStop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+	// Other nodes are still reachable, so the values are handed off before anything is closed
+	if kademlia.HandoffOnStop {
+		ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+		kademlia.Handoff(ctx)
+		cancel()
+	}
+	if started {
+		lc.cancel()
+	}
+	if err := kademlia.Network.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if !started && kademlia.StreamListener != nil {
+		kademlia.StreamListener.Close()
+	}
+	if started {
+		<-lc.listening
+		// Handlers blocked on the action channel are served before the action loop stops
+		kademlia.Network.waitHandlers()
+		lc.stopActions()
+		lc.loops.Wait()
+	}
+	if kademlia.StateFile != "" {
+		if err := kademlia.SaveState(kademlia.StateFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := kademlia.Storage.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	kademlia.routingLogger().Info("Stopped node")
+	return errors.Join(errs...)
+}
+
+// Handoff stores every stored value on the k closest other nodes to its key with its remaining TTL,
+// so the values stay available when the node leaves, it returns how many values were taken by a node
+func (kademlia *Kademlia) Handoff(ctx context.Context) int {
+	kademlia.ExpireData()
+	keys := kademlia.storedKeys()
+	handedOff := 0
+	for _, hash := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		entry, ok := kademlia.getEntry(hash)
+		if !ok {
+			continue
+		}
+		key := NewKademliaID(hash)
+		target := NewContact(key, "")
+		contacts, _, _ := kademlia.NodeLookup(ctx, &target, "")
+		others := make([]Contact, 0, len(contacts))
+		for _, contact := range contacts {
+			if !contact.ID.Equals(kademlia.RoutingTable.Me.ID) {
+				others = append(others, contact)
+			}
+		}
+		if len(kademlia.storeOnContacts(ctx, key, entry.Data, time.Until(entry.ExpiresAt), others)) > 0 {
+			handedOff++
+		}
+	}
+	kademlia.storeLogger().Info("Handed off stored values", "values", handedOff, "stored", len(keys))
+	return handedOff
+}
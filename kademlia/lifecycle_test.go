@@ -0,0 +1,138 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+// memnetNode creates a node listening on the address of the in-memory network without starting it
+func memnetNode(t *testing.T, network *memnet.Network, address string) *Kademlia {
+	conn, err := network.Listen(address)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	k := NewKademliaWithTransport(NewRoutingTable(NewContact(NewRandomKademliaID(), address)), conn)
+	k.Network.Timeout = 200 * time.Millisecond
+	k.Network.Retries = 0
+	return k
+}
+
+func TestStart_RejectsSecondStartAndStartAfterStop(t *testing.T) {
+	k := memnetNode(t, memnet.New(1), "10.0.0.1:8000")
+
+	if err := k.Start(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := k.Start(context.Background()); !errors.Is(err, ErrAlreadyStarted) {
+		t.Errorf("Expected ErrAlreadyStarted, got %v", err)
+	}
+	if err := k.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := k.Start(context.Background()); !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+}
+
+func TestStop_ClosesSocketAndSavesState(t *testing.T) {
+	network := memnet.New(1)
+	peer := memnetNode(t, network, "10.0.0.1:8000")
+	k := memnetNode(t, network, "10.0.0.2:8000")
+	k.StateFile = filepath.Join(t.TempDir(), "state.json")
+	peer.Start(context.Background())
+	t.Cleanup(func() { peer.Stop() })
+	k.Start(context.Background())
+	if err := peer.Network.SendPingMessage(context.Background(), &peer.RoutingTable.Me, &k.RoutingTable.Me); err != nil {
+		t.Fatalf("Expected the started node to answer, got %v", err)
+	}
+
+	if err := k.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := peer.Network.SendPingMessage(context.Background(), &peer.RoutingTable.Me, &k.RoutingTable.Me); err == nil {
+		t.Error("Expected the stopped node not to answer")
+	}
+	state, err := LoadState(k.StateFile)
+	if err != nil {
+		t.Fatalf("Expected the state to be saved, got %v", err)
+	}
+	if saved := state.SavedContacts(); len(saved) != 1 || !saved[0].ID.Equals(peer.RoutingTable.Me.ID) {
+		t.Errorf("Expected the peer that pinged the node in the saved state, got %v", saved)
+	}
+}
+
+func TestStop_CallsBeforeStopWhileTheNodeStillAnswers(t *testing.T) {
+	network := memnet.New(1)
+	peer := memnetNode(t, network, "10.0.0.1:8000")
+	k := memnetNode(t, network, "10.0.0.2:8000")
+	peer.Start(context.Background())
+	t.Cleanup(func() { peer.Stop() })
+	k.Start(context.Background())
+	var pingErr error
+	called := false
+	k.BeforeStop = func(ctx context.Context) error {
+		called = true
+		pingErr = peer.Network.SendPingMessage(ctx, &peer.RoutingTable.Me, &k.RoutingTable.Me)
+		return nil
+	}
+
+	if err := k.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !called || pingErr != nil {
+		t.Errorf("Expected BeforeStop to be called while the node answers, called %v, got %v", called, pingErr)
+	}
+}
+
+func TestStop_StopsWhenTheContextIsCancelled(t *testing.T) {
+	k := memnetNode(t, memnet.New(1), "10.0.0.1:8000")
+	ctx, cancel := context.WithCancel(context.Background())
+	k.Start(ctx)
+	listening := k.lifecycle.listening
+
+	cancel()
+
+	select {
+	case <-listening:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the node to stop listening when the context is cancelled")
+	}
+}
+
+func TestStop_HandsOffStoredValuesToTheClosestNodes(t *testing.T) {
+	network := memnet.New(10)
+	nodes := memnetNodes(t, network, 8, 21)
+	leaving := nodes[3]
+	data := []byte("handed off")
+	key := HashData(data).String()
+	leaving.StoreWithTTL(key, data, time.Hour)
+	leaving.HandoffOnStop = true
+
+	if err := leaving.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	holders := 0
+	for _, node := range nodes {
+		if node == leaving {
+			continue
+		}
+		if stored, ok := node.getData(key); ok && string(stored) == string(data) {
+			holders++
+			if ttl := node.remainingTTL(key); ttl > time.Hour || ttl < time.Hour-time.Minute {
+				t.Errorf("Expected the remaining TTL to be handed off, got %v", ttl)
+			}
+		}
+	}
+	if holders == 0 {
+		t.Error("Expected the value on the nodes that stay")
+	}
+}
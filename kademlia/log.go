@@ -0,0 +1,65 @@
+package kademlia
+
+import (
+	"log/slog"
+)
+
+// Components a node logs as, every record of a node carries its ID and one of these
+const (
+	componentNetwork = "network"
+	componentRouting = "routing"
+	componentStore   = "store"
+	componentLookup  = "lookup"
+)
+
+// SetLogger makes the node and its network log to the logger,
+// the constructors use slog.Default
+func (kademlia *Kademlia) SetLogger(logger *slog.Logger) {
+	if kademlia.RoutingTable != nil && kademlia.RoutingTable.Me.ID != nil {
+		logger = logger.With("node", kademlia.RoutingTable.Me.ID.String())
+	}
+	kademlia.routingLog = logger.With("component", componentRouting)
+	kademlia.storeLog = logger.With("component", componentStore)
+	kademlia.lookupLog = logger.With("component", componentLookup)
+	if kademlia.Network != nil {
+		kademlia.Network.SetLogger(logger)
+	}
+}
+
+// SetLogger makes the network log to the logger
+func (network *Network) SetLogger(logger *slog.Logger) {
+	network.log = logger.With("component", componentNetwork)
+}
+
+func (kademlia *Kademlia) routingLogger() *slog.Logger {
+	return loggerOrDefault(kademlia.routingLog, componentRouting)
+}
+
+func (kademlia *Kademlia) storeLogger() *slog.Logger {
+	return loggerOrDefault(kademlia.storeLog, componentStore)
+}
+
+func (kademlia *Kademlia) lookupLogger() *slog.Logger {
+	return loggerOrDefault(kademlia.lookupLog, componentLookup)
+}
+
+func (network *Network) logger() *slog.Logger {
+	return loggerOrDefault(network.log, componentNetwork)
+}
+
+// loggerOrDefault returns the logger, or the default logger for a node or network
+// that was not made by a constructor
+func loggerOrDefault(logger *slog.Logger, component string) *slog.Logger {
+	if logger == nil {
+		return slog.Default().With("component", component)
+	}
+	return logger
+}
+
+// peerID returns the ID of a peer as a log attribute, messages from peers may come without one
+func peerID(id *KademliaID) slog.Attr {
+	if id == nil {
+		return slog.String("peer_id", "")
+	}
+	return slog.String("peer_id", id.String())
+}
@@ -0,0 +1,52 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+// records decodes the JSON log records written to buf
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var result []map[string]any
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestSetLogger_AddsNodeComponentAndPeerFields(t *testing.T) {
+	var buf bytes.Buffer
+	k := joiningNode()
+	k.SetLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	silent, _ := silentPeer(t)
+
+	k.Join(context.Background(), []Contact{silent})
+	k.Network.logger().Info("network record")
+
+	var routing, network map[string]any
+	for _, record := range records(t, &buf) {
+		if record["node"] != k.RoutingTable.Me.ID.String() {
+			t.Errorf("Expected every record to carry the node ID, got %v", record)
+		}
+		switch record["msg"] {
+		case "Bootstrap contact did not answer":
+			routing = record
+		case "network record":
+			network = record
+		}
+	}
+	if routing == nil || routing["component"] != componentRouting || routing["peer"] != silent.Address || routing["rpc"] != "PING" {
+		t.Errorf("Expected a routing record about the silent seed, got %v", routing)
+	}
+	if network == nil || network["component"] != componentNetwork {
+		t.Errorf("Expected a network record, got %v", network)
+	}
+}
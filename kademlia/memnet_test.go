@@ -0,0 +1,131 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+// memnetNodes starts n nodes on the in-memory network, every node joins through the first one,
+// the node IDs are drawn from the seed so a failing run can be repeated
+func memnetNodes(t *testing.T, network *memnet.Network, n int, seed int64) []*Kademlia {
+	random := rand.New(rand.NewSource(seed))
+	nodes := make([]*Kademlia, n)
+	for i := range nodes {
+		address := fmt.Sprintf("10.0.%d.%d:8000", i/256, i%256)
+		conn, err := network.Listen(address)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		id := KademliaID{}
+		random.Read(id[:])
+		k := NewKademliaWithTransport(NewRoutingTable(NewContact(&id, address)), conn)
+		k.Network.Timeout = 200 * time.Millisecond
+		go k.ListenActionChannel()
+		go k.Network.Listen(k)
+		nodes[i] = k
+	}
+	for _, k := range nodes[1:] {
+		if _, err := k.Join(context.Background(), []Contact{nodes[0].RoutingTable.Me}); err != nil {
+			t.Fatalf("Node %s could not join: %v", k.RoutingTable.Me.Address, err)
+		}
+	}
+	return nodes
+}
+
+// closestIDs returns the IDs of the k nodes closest to the target
+func closestIDs(nodes []*Kademlia, target *KademliaID, k int) []KademliaID {
+	ids := make([]KademliaID, len(nodes))
+	for i, node := range nodes {
+		ids[i] = *node.RoutingTable.Me.ID
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].CalcDistance(target).Less(ids[j].CalcDistance(target))
+	})
+	return ids[:k]
+}
+
+func TestMemnet_LookupFindsClosestNodesAmongHundreds(t *testing.T) {
+	network := memnet.New(1)
+	network.SetLatency(time.Millisecond, time.Millisecond)
+	nodes := memnetNodes(t, network, 200, 1)
+	random := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 10; i++ {
+		targetID := KademliaID{}
+		random.Read(targetID[:])
+		target := NewContact(&targetID, "")
+		from := nodes[random.Intn(len(nodes))]
+
+		found, _, _ := from.NodeLookup(context.Background(), &target, "")
+
+		want := closestIDs(nodes, &targetID, 1)[0]
+		if len(found) == 0 || !found[0].ID.Equals(&want) {
+			t.Errorf("Lookup %d from %s did not find the closest node %s, got %v", i, from.RoutingTable.Me.Address, want.String(), found)
+		}
+	}
+}
+
+func TestMemnet_LookupSurvivesPacketLossAndReordering(t *testing.T) {
+	// A single lookup can lose every RPC to the closest node, so the success rate is taken over
+	// the lookups on networks with different seeds and most of them should succeed
+	succeeded, dropped := 0, 0
+	for seed := int64(1); seed <= 5; seed++ {
+		network := memnet.New(seed)
+		nodes := memnetNodes(t, network, 100, 3)
+		network.SetLatency(time.Millisecond, 2*time.Millisecond)
+		network.SetLoss(0.1)
+		network.SetReordering(0.2)
+		random := rand.New(rand.NewSource(seed))
+
+		for i := 0; i < 2; i++ {
+			targetID := KademliaID{}
+			random.Read(targetID[:])
+			target := NewContact(&targetID, "")
+
+			found, _, _ := nodes[random.Intn(len(nodes))].NodeLookup(context.Background(), &target, "")
+
+			want := closestIDs(nodes, &targetID, 1)[0]
+			if len(found) > 0 && found[0].ID.Equals(&want) {
+				succeeded++
+			}
+		}
+		dropped += network.Stats().Dropped
+	}
+	if succeeded < 8 {
+		t.Errorf("Expected most lookups to find the closest node despite loss, %d of 10 did", succeeded)
+	}
+	if dropped == 0 {
+		t.Error("Expected some datagrams to be dropped")
+	}
+}
+
+func TestMemnet_PartitionStopsRPCsUntilHealed(t *testing.T) {
+	network := memnet.New(5)
+	nodes := memnetNodes(t, network, 20, 5)
+	for _, k := range nodes {
+		k.Network.Timeout = 50 * time.Millisecond
+		k.Network.Retries = 0
+	}
+	network.Partition([]string{"10.0.0.0", "10.0.0.1"})
+	me := nodes[0].RoutingTable.Me
+
+	if _, err := nodes[0].Network.Ping(context.Background(), &me, &nodes[1].RoutingTable.Me); err != nil {
+		t.Errorf("Expected a node inside the partition to answer, got %v", err)
+	}
+	if _, err := nodes[0].Network.Ping(context.Background(), &me, &nodes[2].RoutingTable.Me); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout across the partition, got %v", err)
+	}
+
+	network.Heal()
+	if _, err := nodes[0].Network.Ping(context.Background(), &me, &nodes[2].RoutingTable.Me); err != nil {
+		t.Errorf("Expected the node to answer after healing, got %v", err)
+	}
+}
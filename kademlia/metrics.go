@@ -0,0 +1,129 @@
+package kademlia
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"d7024e/metrics"
+)
+
+// Metrics counts what a node and its network do, every node has its own
+type Metrics struct {
+	Registry        *metrics.Registry
+	rpcsSent        *metrics.Counter   // by RPC type
+	rpcsReceived    *metrics.Counter   // by RPC type
+	rpcTimeouts     *metrics.Counter   // by RPC type
+	badSignatures   *metrics.Counter   // by reason
+	rejectedRPCs    *metrics.Counter   // by RPC type and reason
+	lookupDuration  *metrics.Histogram // by lookup kind
+	lookupHops      *metrics.Histogram // by lookup kind
+	putReplication  *metrics.Histogram
+	routingContacts *metrics.Gauge // by bucket index
+	storedKeys      *metrics.Gauge
+	storedBytes     *metrics.Gauge
+}
+
+// Kinds of lookups the lookup metrics are split by
+const (
+	lookupKindNode = "node"
+	lookupKindData = "data"
+)
+
+// newMetrics registers the metrics of a node
+func newMetrics() *Metrics {
+	registry := metrics.NewRegistry()
+	return &Metrics{
+		Registry:        registry,
+		rpcsSent:        registry.Counter("kademlia_rpcs_sent_total", "RPCs sent to other nodes, retries not included.", "type"),
+		rpcsReceived:    registry.Counter("kademlia_rpcs_received_total", "Requests received from other nodes.", "type"),
+		rpcTimeouts:     registry.Counter("kademlia_rpc_timeouts_total", "RPCs that got no reply in any attempt.", "type"),
+		badSignatures:   registry.Counter("kademlia_invalid_signatures_total", "Messages dropped for a missing or invalid signature.", "reason"),
+		rejectedRPCs:    registry.Counter("kademlia_rpcs_rejected_total", "Requests rejected for exceeding a rate limit or a storage quota, or for an invalid ID.", "type", "reason"),
+		lookupDuration:  registry.Histogram("kademlia_lookup_duration_seconds", "Time a lookup took.", metrics.ExponentialBuckets(0.005, 2, 12), "kind"),
+		lookupHops:      registry.Histogram("kademlia_lookup_hops", "Rounds of RPCs a lookup took.", metrics.LinearBuckets(1, 1, 10), "kind"),
+		putReplication:  registry.Histogram("kademlia_put_replication_ratio", "Fraction of the closest nodes that stored the value of a PUT.", []float64{0, 0.2, 0.4, 0.6, 0.8, 1}),
+		routingContacts: registry.Gauge("kademlia_routing_table_contacts", "Contacts in a bucket of the routing table, empty buckets are left out.", "bucket"),
+		storedKeys:      registry.Gauge("kademlia_stored_keys", "Values stored on this node."),
+		storedBytes:     registry.Gauge("kademlia_stored_bytes", "Bytes of the values stored on this node."),
+	}
+}
+
+// WriteMetrics writes the metrics of the node in the Prometheus text format,
+// a node that was not made by a constructor has none
+func (kademlia *Kademlia) WriteMetrics(w io.Writer) error {
+	if kademlia.Metrics == nil {
+		return nil
+	}
+	kademlia.collectMetrics()
+	return kademlia.Metrics.Registry.Write(w)
+}
+
+// collectMetrics sets the gauges that mirror the routing table and the stored values
+func (kademlia *Kademlia) collectMetrics() {
+	kademlia.Metrics.routingContacts.Reset()
+	for i := 0; i < IDLength*8; i++ {
+		if contacts := len(kademlia.RoutingTable.BucketContacts(i)); contacts > 0 {
+			kademlia.Metrics.routingContacts.Set(float64(contacts), strconv.Itoa(i))
+		}
+	}
+
+	infos, err := kademlia.Storage.List()
+	if err != nil {
+		kademlia.storeLogger().Error("Error listing stored data", "err", err)
+		return
+	}
+	bytes := 0
+	for _, info := range infos {
+		bytes += info.Size
+	}
+	kademlia.Metrics.storedKeys.Set(float64(len(infos)))
+	kademlia.Metrics.storedBytes.Set(float64(bytes))
+}
+
+// The methods below do nothing on a nil Metrics, so a network made without a node counts nothing
+
+func (m *Metrics) rpcSent(rpc string) {
+	if m != nil {
+		m.rpcsSent.Inc(rpc)
+	}
+}
+
+func (m *Metrics) rpcReceived(rpc string) {
+	if m != nil {
+		m.rpcsReceived.Inc(rpc)
+	}
+}
+
+// rpcFailed counts the RPC as timed out if it failed with ErrTimeout
+func (m *Metrics) rpcFailed(rpc string, err error) {
+	if m != nil && errors.Is(err, ErrTimeout) {
+		m.rpcTimeouts.Inc(rpc)
+	}
+}
+
+func (m *Metrics) invalidSignature(reason string) {
+	if m != nil {
+		m.badSignatures.Inc(reason)
+	}
+}
+
+func (m *Metrics) rpcRejected(rpc string, reason string) {
+	if m != nil {
+		m.rejectedRPCs.Inc(rpc, reason)
+	}
+}
+
+func (m *Metrics) lookupDone(kind string, duration time.Duration, stats LookupStats) {
+	if m != nil {
+		m.lookupDuration.Observe(duration.Seconds(), kind)
+		m.lookupHops.Observe(float64(stats.Rounds), kind)
+	}
+}
+
+func (m *Metrics) putDone(stored int, contacts int) {
+	if m != nil && contacts > 0 {
+		m.putReplication.Observe(float64(stored) / float64(contacts))
+	}
+}
@@ -0,0 +1,66 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"d7024e/memnet"
+)
+
+func TestMetrics_CountRPCsLookupsAndPuts(t *testing.T) {
+	nodes := memnetNodes(t, memnet.New(9), DefaultK+1, 9)
+	sender, receiver := nodes[0], nodes[1]
+	sentBefore := sender.Metrics.rpcsSent.Value("PING")
+	receivedBefore := receiver.Metrics.rpcsReceived.Value("PING")
+
+	if err := sender.Network.SendPingMessage(context.Background(), &sender.RoutingTable.Me, &receiver.RoutingTable.Me); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := sender.Put(context.Background(), []byte("counted")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if sent := sender.Metrics.rpcsSent.Value("PING") - sentBefore; sent != 1 {
+		t.Errorf("Expected 1 PING sent, got %v", sent)
+	}
+	if received := receiver.Metrics.rpcsReceived.Value("PING") - receivedBefore; received < 1 {
+		t.Errorf("Expected the PING to be received, got %v", received)
+	}
+	if count, _ := sender.Metrics.lookupHops.Count(lookupKindNode); count == 0 {
+		t.Error("Expected the lookup of the PUT to be observed")
+	}
+	if count, sum := sender.Metrics.putReplication.Count(); count != 1 || sum != 1 {
+		t.Errorf("Expected one PUT stored on every node, got %d observations summing to %v", count, sum)
+	}
+}
+
+func TestMetrics_CountTimeouts(t *testing.T) {
+	k := joiningNode()
+	silent, _ := silentPeer(t)
+
+	k.Network.SendPingMessage(context.Background(), &k.RoutingTable.Me, &silent)
+
+	if timeouts := k.Metrics.rpcTimeouts.Value("PING"); timeouts != 1 {
+		t.Errorf("Expected 1 PING timeout, got %v", timeouts)
+	}
+}
+
+func TestWriteMetrics_ReportsRoutingTableAndStorage(t *testing.T) {
+	k := joiningNode()
+	k.RoutingTable.AddContact(NewContact(NewRandomKademliaID(), "127.0.0.1:2"))
+	k.Store(HashData([]byte("stored")).String(), []byte("stored"))
+	var buf bytes.Buffer
+
+	if err := k.WriteMetrics(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := buf.String()
+	for _, line := range []string{"kademlia_stored_keys 1\n", "kademlia_stored_bytes 6\n", "kademlia_routing_table_contacts{bucket="} {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected %q in\n%s", line, output)
+		}
+	}
+}
@@ -1,63 +1,310 @@
 package kademlia
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultRPCTimeout = 2 * time.Second
+const DefaultRPCRetries = 2
+
+var (
+	ErrTimeout            = errors.New("rpc timed out")
+	ErrUnreachable        = errors.New("receiver unreachable")
+	ErrUnexpectedResponse = errors.New("unexpected response")
+	ErrNotFound           = errors.New("data not found on receiver")
+	ErrStoreRejected      = errors.New("store rejected by receiver")
 )
 
 type Network struct {
-	responseChan chan Response
-	conn         net.PacketConn
+	Timeout           time.Duration        // time to wait for a response to a single RPC attempt
+	Retries           int                  // number of times an RPC is resent after a failed attempt
+	Encoding          Encoding             // encoding of outgoing requests, replies use the encoding of the request
+	MaxObjectSize     int                  // largest value that is stored, sent or accepted in a reply
+	StreamThreshold   int                  // packets larger than this are fetched over a stream instead of sent in chunks
+	Identity          *Identity            // proves the node ID in every message, nil for a random ID
+	Puzzle            *PuzzleDifficulty    // contacts must prove their ID with an Identity of this difficulty, nil to admit any ID
+	SigningKey        ed25519.PrivateKey   // signs every message if the node has no Identity, messages are unsigned if nil
+	RequireSignatures bool                 // drop messages that are not signed
+	RateLimits        map[string]RateLimit // requests of each type a source IP and a sender ID may send, types without a limit are not limited
+	StreamRateLimit   RateLimit            // streams fetched from one source IP, not limited if zero
+	transport         Transport
+	pendingRPCs       map[KademliaID]chan Response // lookups waiting for an answer from the action channel
+	pendingMutex      sync.Mutex
+	streamListener    net.Listener
+	outbox            map[KademliaID]stagedPacket // packets waiting to be fetched over a stream
+	outboxBytes       int                         // bytes of the staged packets
+	fetchingBytes     int                         // bytes of the streams being fetched
+	streamMutex       sync.Mutex
+	log               *slog.Logger
+	metrics           *Metrics       // shared with the node, nil for a network made without one
+	handlers          sync.WaitGroup // goroutines handling received packets
+	ctx               context.Context
+	cancel            context.CancelFunc // cancels the RPCs sent by the handlers when the network closes
+	closed            atomic.Bool
+	keys              keyCache    // public keys of the senders of received messages
+	proven            provenHosts // hosts that answered a PING
+	limiter           rateLimiter
 }
 
 // Response struct for network responses
 type Response struct {
-	Data            []byte    `json:"data"`
-	ClosestContacts []Contact `json:"closest_contacts"`
-	Target          *Contact  `json:"target"`
+	RPCID           *KademliaID `json:"rpc_id"`
+	Data            []byte      `json:"data"`
+	ClosestContacts []Contact   `json:"closest_contacts"`
+	Target          *Contact    `json:"target"`
+	SenderID        *KademliaID `json:"sender_id,omitempty"`
+	PublicKey       []byte      `json:"public_key,omitempty"`
+	Signature       []byte      `json:"signature,omitempty"`
 }
 
-// NewNetwork constructor for Network
+// NewNetwork constructor for Network over UDP, conn may be nil for a network that only sends RPCs
 func NewNetwork(conn net.PacketConn) *Network {
-	return &Network{make(chan Response), conn}
+	return NewNetworkWithTransport(NewUDPTransport(conn))
+}
+
+// NewNetworkWithTransport constructor for Network over any transport
+func NewNetworkWithTransport(transport Transport) *Network {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Network{
+		Timeout:           DefaultRPCTimeout,
+		Retries:           DefaultRPCRetries,
+		SigningKey:        NewSigningKey(),
+		RequireSignatures: true,
+		RateLimits:        RateLimits(DefaultRateLimit),
+		StreamRateLimit:   DefaultStreamRateLimit,
+		transport:         transport,
+		pendingRPCs:       make(map[KademliaID]chan Response),
+		log:               slog.Default().With("component", componentNetwork),
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+}
+
+// Close stops receiving datagrams and serving streams, Listen and ServeStreams return
+// and the RPCs sent while handling received messages are cancelled
+func (network *Network) Close() error {
+	if network.closed.Swap(true) {
+		return nil
+	}
+	if network.cancel != nil {
+		network.cancel()
+	}
+	network.streamMutex.Lock()
+	if network.streamListener != nil {
+		network.streamListener.Close()
+	}
+	network.streamMutex.Unlock()
+	return network.transport.Close()
+}
+
+// LocalAddr returns the address the node receives datagrams on
+func (network *Network) LocalAddr() net.Addr {
+	return network.transport.LocalAddr()
+}
+
+// context returns the context of the RPCs sent while handling received messages
+func (network *Network) context() context.Context {
+	if network.ctx == nil {
+		return context.Background()
+	}
+	return network.ctx
+}
+
+// handle runs fn in a goroutine that Close waits for through waitHandlers
+func (network *Network) handle(fn func()) {
+	network.handlers.Add(1)
+	go func() {
+		defer network.handlers.Done()
+		fn()
+	}()
+}
+
+// waitHandlers waits for the goroutines handling received packets, Listen must have returned
+func (network *Network) waitHandlers() {
+	network.handlers.Wait()
 }
 
 // Message struct for network messages
 type Message struct {
-	Type     string      // Type of message: "PING", "PONG", "FIND_NODE", etc.
-	SenderID *KademliaID // ID of the node sending the message
-	SenderIP string      // IP address of the node sending the message
-	TargetID string      // ID of the target node
-	TargetIP string      // IP address of the target node
-	DataID   *KademliaID // ID of the data
-	Data     []byte
+	RPCID      *KademliaID `json:"rpc_id"` // Random ID of the RPC, echoed in the reply
+	Type       string      // Type of message: "PING", "PONG", "FIND_NODE", etc.
+	SenderID   *KademliaID // ID of the node sending the message
+	SenderIP   string      // IP address of the node sending the message
+	TargetID   string      // ID of the target node
+	TargetIP   string      // IP address of the target node
+	DataID     *KademliaID // ID of the data
+	Data       []byte
+	TTL        time.Duration // Remaining lifetime of the data in a STORE message
+	PublicKey  []byte        `json:"public_key,omitempty"`  // Key the message is signed with, the sender ID is derived from it if the sender has an Identity
+	Nonce      []byte        `json:"nonce,omitempty"`       // Solution of the dynamic puzzle of the sender ID
+	Signature  []byte        `json:"signature,omitempty"`   // Signature of the sender over the other fields
+	ObservedIP string        `json:"observed_ip,omitempty"` // Address the PING of a PONG came from, as the receiver saw it
+	encoding   Encoding      // Encoding the message was received in, replies are sent in the same
 }
 
 // Listen listens for incoming messages on the network
 func (network *Network) Listen(k *Kademlia) {
-	fmt.Println("Listening on all interfaces on port 8000")
-	defer network.conn.Close()
+	network.logger().Info("Listening", "address", network.transport.LocalAddr().String())
+	defer network.transport.Close()
+	chunks := newReassembler(network.ObjectSizeLimit())
 
 	for {
-		var buf [8192]byte
-		n, addr, err := network.conn.ReadFrom(buf[0:])
+		var buf [maxDatagramSize]byte
+		n, addr, err := network.transport.ReadFrom(buf[0:])
 		if err != nil {
-			fmt.Println(err)
+			if network.closed.Load() {
+				network.logger().Info("Stopped listening")
+				return
+			}
+			network.logger().Error("Stopped listening", "err", err)
 			return
 		}
-		var receivedMessage Message
-		err = json.Unmarshal(buf[:n], &receivedMessage)
+		packet, err := chunks.add(addr.String(), buf[:n])
 		if err != nil {
-			fmt.Println("Error unmarshalling message:", err)
+			network.logger().Debug("Dropping chunk", "peer", addr.String(), "err", err)
+			continue
+		}
+		if packet == nil {
+			continue
+		}
+		// Packets over the limit of their IP cost neither a goroutine, a stream fetch nor a signature check
+		if !network.allowPacket(addr) {
+			network.metrics.rpcRejected("PACKET", rejectedRateLimit)
+			network.logger().Debug("Dropping packet over the rate limit", "peer", addr.String())
+			continue
+		}
+		// Only fetch streams from hosts within their budget, before any connection is opened
+		if isPointer(packet) && !network.allowStream(addr) {
+			network.metrics.rpcRejected("STREAM", rejectedRateLimit)
+			network.logger().Debug("Dropping stream pointer over the rate limit", "peer", addr.String())
 			continue
 		}
-		network.handleMessage(k, receivedMessage, addr)
+		network.handle(func() { network.receive(k, packet, addr) })
+	}
+}
+
+// receive decodes and handles a packet, fetching it first if only a pointer to a stream was received
+func (network *Network) receive(k *Kademlia, packet []byte, addr net.Addr) {
+	packet, err := network.resolvePacket(packet, addr)
+	if err != nil {
+		network.logger().Warn("Error fetching stream", "peer", addr.String(), "err", err)
+		return
+	}
+	receivedMessage, err := network.decodeMessage(packet)
+	if errors.Is(err, ErrInvalidSignature) {
+		network.logger().Info("Dropping message", "peer", addr.String(), "err", err)
+		return
+	}
+	if err != nil {
+		network.logger().Debug("Dropping message", "peer", addr.String(), "err", err)
+		return
+	}
+	network.handleMessage(k, receivedMessage, addr)
+}
+
+// encodeMessage encodes and signs a message sent by this node, with the proof of its ID if it has an Identity
+func (network *Network) encodeMessage(encoding Encoding, message Message) ([]byte, error) {
+	if network.Identity != nil {
+		message.Nonce = network.Identity.Nonce[:]
+	}
+	return encodeMessage(encoding, network.sign(message))
+}
+
+// decodeMessage decodes a received message, it fails with ErrInvalidSignature if the signature does not verify
+func (network *Network) decodeMessage(packet []byte) (Message, error) {
+	message, err := decodeMessage(packet)
+	if err != nil {
+		return Message{}, err
+	}
+	return network.verifySignature(message)
+}
+
+// verifySender checks the proof of the sender ID of a received message if contacts must prove their ID
+func (network *Network) verifySender(message Message) error {
+	if network.Puzzle == nil {
+		return nil
+	}
+	return VerifyIdentity(message.SenderID, message.PublicKey, message.Nonce, *network.Puzzle)
+}
+
+// admitsSender returns true if the sender of a request may be added to the routing table
+func (network *Network) admitsSender(message Message) bool {
+	if err := network.verifySender(message); err != nil {
+		network.logger().Info("Not admitting sender", "peer", message.SenderIP, peerID(message.SenderID), "rpc", message.Type, "err", err)
+		return false
+	}
+	return true
+}
+
+// registerRPC registers a channel that receives the response for the RPC ID
+func (network *Network) registerRPC(rpcID *KademliaID) chan Response {
+	responseChan := make(chan Response, 1)
+	network.pendingMutex.Lock()
+	defer network.pendingMutex.Unlock()
+	if network.pendingRPCs == nil {
+		network.pendingRPCs = make(map[KademliaID]chan Response)
 	}
+	network.pendingRPCs[*rpcID] = responseChan
+	return responseChan
+}
+
+// unregisterRPC removes the channel registered for the RPC ID
+func (network *Network) unregisterRPC(rpcID *KademliaID) {
+	network.pendingMutex.Lock()
+	defer network.pendingMutex.Unlock()
+	delete(network.pendingRPCs, *rpcID)
+}
+
+// deliverResponse routes a response to the caller waiting for the RPC ID, returns false if no one is waiting
+func (network *Network) deliverResponse(rpcID *KademliaID, response Response) bool {
+	if rpcID == nil {
+		return false
+	}
+	network.pendingMutex.Lock()
+	responseChan, ok := network.pendingRPCs[*rpcID]
+	delete(network.pendingRPCs, *rpcID)
+	network.pendingMutex.Unlock()
+	if !ok {
+		return false
+	}
+	responseChan <- response
+	return true
 }
 
 // handleMessage handles incoming messages
 func (network *Network) handleMessage(k *Kademlia, receivedMessage Message, addr net.Addr) {
+	// Contacts are added with the address the request came from, not the one the sender claims
+	if address := senderAddress(receivedMessage.SenderIP, addr); address != receivedMessage.SenderIP {
+		network.logger().Debug("Advertised address does not match the source", "peer", address, "advertised", receivedMessage.SenderIP, "rpc", receivedMessage.Type)
+		receivedMessage.SenderIP = address
+	}
+	switch receivedMessage.Type {
+	case "PING", "STORE", "FIND_NODE", "FIND_DATA", "REFRESH":
+		network.metrics.rpcReceived(receivedMessage.Type)
+	}
+	receivedMessage, err := checkRequest(receivedMessage)
+	if err != nil {
+		network.metrics.rpcRejected(receivedMessage.Type, rejectedMalformed)
+		network.logger().Info("Dropping malformed request", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "rpc", receivedMessage.Type, "err", err)
+		return
+	}
+	if !network.allowRequest(receivedMessage) {
+		network.metrics.rpcRejected(receivedMessage.Type, rejectedRateLimit)
+		network.logger().Debug("Dropping request over the rate limit", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "rpc", receivedMessage.Type)
+		// A dropped STORE would look like a lost packet and be sent again
+		if receivedMessage.Type == "STORE" {
+			network.reply(k, receivedMessage, "STORE_REJECTED", addr)
+		}
+		return
+	}
 	switch receivedMessage.Type {
 	case "PING":
 		network.handlePing(k, receivedMessage, addr)
@@ -67,22 +314,46 @@ func (network *Network) handleMessage(k *Kademlia, receivedMessage Message, addr
 		network.handleFindNode(k, receivedMessage, addr)
 	case "FIND_DATA":
 		network.handleFindData(k, receivedMessage, addr)
+	case "REFRESH":
+		network.handleRefresh(k, receivedMessage, addr)
+	}
+}
+
+// checkRequest returns the request with its target in the form of KademliaID.String,
+// or an error if it has no sender ID or a lookup request does not name a valid target
+func checkRequest(message Message) (Message, error) {
+	if message.SenderID == nil {
+		return message, fmt.Errorf("%w: no sender ID", ErrMalformedPacket)
+	}
+	switch message.Type {
+	case "FIND_NODE", "FIND_DATA":
+		target, err := ParseKademliaID(message.TargetID)
+		if err != nil {
+			return message, fmt.Errorf("%w: target: %w", ErrMalformedPacket, err)
+		}
+		message.TargetID = target.String()
 	}
+	return message, nil
 }
 
 // handlePing handles incoming PING messages and sends a PONG response
 func (network *Network) handlePing(k *Kademlia, receivedMessage Message, addr net.Addr) {
 	pongMsg := Message{
-		Type:     "PONG",
-		SenderID: k.RoutingTable.Me.ID,
-		SenderIP: k.RoutingTable.Me.Address,
-	}
-	data, _ := json.Marshal(pongMsg)
-	_, err := network.conn.WriteTo(data, addr)
+		RPCID:      receivedMessage.RPCID,
+		Type:       "PONG",
+		SenderID:   k.RoutingTable.Me.ID,
+		SenderIP:   k.RoutingTable.Me.Address,
+		ObservedIP: addr.String(),
+	}
+	data, _ := network.encodeMessage(receivedMessage.encoding, pongMsg)
+	err := network.writeTo(data, addr)
 	if err != nil {
-		fmt.Println("Error sending PONG:", err)
+		network.logger().Debug("Error sending reply", "peer", addr.String(), "rpc", "PONG", "err", err)
 	} else {
-		fmt.Println("Received PING. Adding contact with ID:", receivedMessage.SenderID.String(), "and IP:", receivedMessage.SenderIP)
+		network.logger().Debug("Received request", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "rpc", receivedMessage.Type)
+		if !network.admitsSender(receivedMessage) {
+			return
+		}
 		action := Action{
 			Action:   "UpdateRT",
 			SenderId: receivedMessage.SenderID,
@@ -92,125 +363,217 @@ func (network *Network) handlePing(k *Kademlia, receivedMessage Message, addr ne
 	}
 }
 
-// handleStore sends action to Kademlia to store and sends back a STORE_OK response
+// handleStore sends action to Kademlia to store and sends back a STORE_OK response,
+// data that is too large or does not hash to its key is answered with STORE_TOO_LARGE or STORE_INVALID
+// and data that takes its publisher or its source IP over the storage quota, or the node over its storage limit,
+// with STORE_REJECTED. Only the publisher of a value that is already stored resets its TTL, for any other
+// sender the stored value is kept as it is, so no other node can keep a value alive
 func (network *Network) handleStore(k *Kademlia, receivedMessage Message, addr net.Addr) {
-	storeOKMsg := Message{
-		Type:     "STORE_OK",
-		SenderID: k.RoutingTable.Me.ID,
-		SenderIP: k.RoutingTable.Me.Address,
-	}
-	data, _ := json.Marshal(storeOKMsg)
-	_, err := network.conn.WriteTo(data, addr)
+	replyType := "STORE_OK"
+	if network.checkObjectSize(receivedMessage.Data) != nil {
+		replyType = "STORE_TOO_LARGE"
+	} else if receivedMessage.DataID == nil || !VerifyData(receivedMessage.DataID.String(), receivedMessage.Data) {
+		replyType = "STORE_INVALID"
+	} else if !k.allowsStore(receivedMessage.SenderID, addr.String(), receivedMessage.DataID.String(), len(receivedMessage.Data)) {
+		replyType = "STORE_REJECTED"
+		network.metrics.rpcRejected(receivedMessage.Type, rejectedQuota)
+	}
+	err := network.reply(k, receivedMessage, replyType, addr)
 	if err != nil {
-		fmt.Println("Error sending STORE_OK:", err)
+		network.logger().Debug("Error sending reply", "peer", addr.String(), "rpc", replyType, "err", err)
+	} else if replyType != "STORE_OK" {
+		network.logger().Info("Rejected STORE", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "rpc", replyType)
 	} else {
-		fmt.Println("Received STORE. Added contact to routing table with ID:", receivedMessage.SenderID.String(), "and IP:", receivedMessage.SenderIP)
+		network.logger().Debug("Received request", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "rpc", receivedMessage.Type)
 		action := Action{
-			Action:   "Store",
+			Action:   "StoreIfMissing",
 			Hash:     receivedMessage.DataID.String(),
 			Data:     receivedMessage.Data,
 			SenderId: receivedMessage.SenderID,
 			SenderIp: receivedMessage.SenderIP,
+			TTL:      networkTTL(receivedMessage.TTL),
+		}
+		if k.isPublisher(receivedMessage, action.Hash) {
+			action.Action = "Store"
 		}
 		k.ActionChannel <- action
 	}
 }
 
-// handleFindNode handles incoming FIND_NODE messages, calls for a lookup action in Kademlia and sends back closest contacts
-func (network *Network) handleFindNode(k *Kademlia, receivedMessage Message, addr net.Addr) {
-	fmt.Println("Received FIND_NODE")
-	if network.SendPingMessage(&k.RoutingTable.Me, &Contact{ID: receivedMessage.SenderID, Address: receivedMessage.SenderIP}) {
-		action := Action{
-			Action:   "UpdateRT",
-			SenderId: receivedMessage.SenderID,
-			SenderIp: receivedMessage.SenderIP,
+// reply sends a reply of the type without a payload to a request
+func (network *Network) reply(k *Kademlia, receivedMessage Message, replyType string, addr net.Addr) error {
+	replyMsg := Message{
+		RPCID:    receivedMessage.RPCID,
+		Type:     replyType,
+		SenderID: k.RoutingTable.Me.ID,
+		SenderIP: k.RoutingTable.Me.Address,
+	}
+	data, _ := network.encodeMessage(receivedMessage.encoding, replyMsg)
+	return network.writeTo(data, addr)
+}
+
+// handleRefresh resets the TTL of the stored data and sends back REFRESH_OK, or REFRESH_FAIL if the data
+// is not stored on this node or the sender is not the publisher that first stored it, so only the
+// publisher can keep a value alive and a FORGET takes effect
+func (network *Network) handleRefresh(k *Kademlia, receivedMessage Message, addr net.Addr) {
+	replyType := "REFRESH_FAIL"
+	if receivedMessage.DataID != nil {
+		key := receivedMessage.DataID.String()
+		if !k.isPublisher(receivedMessage, key) {
+			network.logger().Info("Rejected REFRESH", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "key", key)
+		} else if k.RefreshTTL(key, networkTTL(receivedMessage.TTL)) {
+			replyType = "REFRESH_OK"
 		}
-		k.ActionChannel <- action
-	} else {
-		fmt.Println("Error receiving PONG in FIND_NODE")
 	}
+	err := network.reply(k, receivedMessage, replyType, addr)
+	if err != nil {
+		network.logger().Debug("Error sending reply", "peer", addr.String(), "rpc", replyType, "err", err)
+	}
+}
+
+// senderAddress returns the address to reach the sender of a request at: its advertised address if it
+// matches the IP the request came from, otherwise that IP with the advertised port, as requests are sent
+// from another port than the one a node listens on
+func senderAddress(advertised string, source net.Addr) string {
+	sourceHost, _, err := net.SplitHostPort(source.String())
+	if err != nil {
+		return advertised
+	}
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return source.String()
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.Equal(net.ParseIP(sourceHost)) {
+		return advertised
+	}
+	return net.JoinHostPort(sourceHost, port)
+}
+
+// pingBackAndUpdateRT pings the sender of a message and adds it to the routing table if it answers,
+// it runs separately from the reply so a slow sender cannot make its own request time out
+func (network *Network) pingBackAndUpdateRT(k *Kademlia, receivedMessage Message) {
+	if !network.admitsSender(receivedMessage) {
+		return
+	}
+	sender := &Contact{ID: receivedMessage.SenderID, Address: receivedMessage.SenderIP}
+	if err := network.SendPingMessage(network.context(), &k.RoutingTable.Me, sender); err != nil {
+		network.logger().Debug("Sender did not answer the ping back", "peer", receivedMessage.SenderIP, "rpc", "PING", "err", err)
+		return
+	}
+	action := Action{
+		Action:   "UpdateRT",
+		SenderId: receivedMessage.SenderID,
+		SenderIp: receivedMessage.SenderIP,
+	}
+	k.ActionChannel <- action
+}
+
+// handleFindNode handles incoming FIND_NODE messages, calls for a lookup action in Kademlia and sends back closest contacts
+func (network *Network) handleFindNode(k *Kademlia, receivedMessage Message, addr net.Addr) {
+	network.logger().Debug("Received request", "peer", receivedMessage.SenderIP, peerID(receivedMessage.SenderID), "rpc", receivedMessage.Type)
+	network.handle(func() { network.pingBackAndUpdateRT(k, receivedMessage) })
 	contact := Contact{ID: NewKademliaID(receivedMessage.TargetID), Address: receivedMessage.SenderIP}
+	// The action is routed by a local ID so callers cannot collide with each other's RPC IDs
+	actionID := NewRandomKademliaID()
+	responseChan := network.registerRPC(actionID)
+	defer network.unregisterRPC(actionID)
 	action := Action{
 		Action:   "LookupContact",
-		SenderId: NewKademliaID(receivedMessage.SenderID.String()),
+		SenderId: receivedMessage.SenderID,
 		SenderIp: receivedMessage.SenderIP,
 		Target:   &contact,
+		RPCID:    actionID,
 	}
 	k.ActionChannel <- action
-	responseChannel := <-network.responseChan
-	response := Response{
+	responseChannel := <-responseChan
+	response := network.signResponse(Response{
+		RPCID:           receivedMessage.RPCID,
 		Data:            responseChannel.Data,
 		ClosestContacts: responseChannel.ClosestContacts,
-	}
-	responseChannel.Data, _ = json.Marshal(response)
-	_, err := network.conn.WriteTo(responseChannel.Data, addr)
+	}, k.RoutingTable.Me.ID)
+	responseChannel.Data, _ = encodeResponse(receivedMessage.encoding, response)
+	err := network.writeReply(k, receivedMessage, responseChannel.Data, addr)
 	if err != nil {
-		fmt.Println("Error sending closest contacts:", err)
+		network.logger().Debug("Error sending reply", "peer", addr.String(), "rpc", receivedMessage.Type, "err", err)
 	}
 }
 
 // handleFindData handles incoming FIND_DATA messages, calls for a lookup action in Kademlia and sends back closest contacts and data
 func (network *Network) handleFindData(k *Kademlia, receivedMessage Message, addr net.Addr) {
-	if network.SendPingMessage(&k.RoutingTable.Me, &Contact{ID: receivedMessage.SenderID, Address: receivedMessage.SenderIP}) {
-		action := Action{
-			Action:   "UpdateRT",
-			SenderId: receivedMessage.SenderID,
-			SenderIp: receivedMessage.SenderIP,
-		}
-		k.ActionChannel <- action
-	}
+	network.handle(func() { network.pingBackAndUpdateRT(k, receivedMessage) })
+	actionID := NewRandomKademliaID()
+	responseChan := network.registerRPC(actionID)
+	defer network.unregisterRPC(actionID)
 	action := Action{
 		Action:   "LookupData",
 		SenderId: receivedMessage.SenderID,
 		SenderIp: receivedMessage.SenderIP,
 		Hash:     receivedMessage.TargetID,
+		RPCID:    actionID,
 	}
 	k.ActionChannel <- action
-	responseChannel := <-network.responseChan
+	responseChannel := <-responseChan
 
-	response := Response{
+	response := network.signResponse(Response{
+		RPCID:           receivedMessage.RPCID,
 		Data:            responseChannel.Data,
 		ClosestContacts: responseChannel.ClosestContacts,
-	}
-	responseChannel.Data, _ = json.Marshal(response)
-	_, err := network.conn.WriteTo(responseChannel.Data, addr)
+	}, k.RoutingTable.Me.ID)
+	responseChannel.Data, _ = encodeResponse(receivedMessage.encoding, response)
+	err := network.writeReply(k, receivedMessage, responseChannel.Data, addr)
 	if err != nil {
-		fmt.Println("Error sending closest contacts:", err)
+		network.logger().Debug("Error sending reply", "peer", addr.String(), "rpc", receivedMessage.Type, "err", err)
 	}
 }
 
 // SendPingMessage sends a PING message to a receiver and waits for a PONG response
-func (network *Network) SendPingMessage(sender *Contact, receiver *Contact) bool {
+func (network *Network) SendPingMessage(ctx context.Context, sender *Contact, receiver *Contact) error {
+	_, err := network.Ping(ctx, sender, receiver)
+	return err
+}
+
+// Ping sends a PING message to a receiver and returns the contact that answered,
+// its ID is taken from the PONG so receivers with an unknown ID can be pinged
+func (network *Network) Ping(ctx context.Context, sender *Contact, receiver *Contact) (Contact, error) {
+	contact, _, err := network.ping(ctx, sender, receiver)
+	return contact, err
+}
+
+// ping sends a PING message to a receiver and returns the contact that answered
+// and the address the receiver saw the PING come from, empty if the receiver does not tell
+func (network *Network) ping(ctx context.Context, sender *Contact, receiver *Contact) (Contact, string, error) {
 	pingMsg := Message{
 		Type:     "PING",
 		SenderID: sender.ID,
 		SenderIP: sender.Address,
 	}
 
-	response, err := network.SendMessage(sender, receiver, pingMsg)
+	response, err := network.SendMessage(ctx, sender, receiver, pingMsg)
 	if err != nil {
-		fmt.Println("Error sending PING message:", err)
-		return false
+		return Contact{}, "", fmt.Errorf("error sending PING message: %w", err)
 	}
 
-	var receivedMessage Message
-	err = json.Unmarshal(response, &receivedMessage)
+	receivedMessage, err := network.decodeMessage(response)
 	if err != nil {
-		fmt.Println("Error unmarshalling response:", err)
-		return false
+		return Contact{}, "", fmt.Errorf("%w: error decoding response: %w", ErrUnexpectedResponse, err)
 	}
 
-	if receivedMessage.Type == "PONG" {
-		fmt.Println("Received PONG from", receiver.Address)
-		return true
-	} else {
-		fmt.Println("Received unexpected message:", receivedMessage)
-		return false
+	if receivedMessage.Type != "PONG" {
+		return Contact{}, "", fmt.Errorf("%w: expected PONG, got %s", ErrUnexpectedResponse, receivedMessage.Type)
 	}
+	if receivedMessage.SenderID == nil {
+		return Contact{}, "", fmt.Errorf("%w: PONG without sender ID", ErrUnexpectedResponse)
+	}
+	if err := network.verifySender(receivedMessage); err != nil {
+		return Contact{}, "", fmt.Errorf("error checking PONG: %w", err)
+	}
+	network.logger().Debug("Received reply", "peer", receiver.Address, peerID(receivedMessage.SenderID), "rpc", "PONG")
+	network.proven.add(sourceHost(receiver.Address), time.Now())
+	return NewContact(receivedMessage.SenderID, receiver.Address), receivedMessage.ObservedIP, nil
 }
 
 // SendFindContactMessage sends a FIND_NODE message to a receiver and waits for closest contacts
-func (network *Network) SendFindContactMessage(sender *Contact, receiver *Contact, target *Contact) ([]Contact, error) {
+func (network *Network) SendFindContactMessage(ctx context.Context, sender *Contact, receiver *Contact, target *Contact) ([]Contact, error) {
 	findNodeMsg := Message{
 		Type:     "FIND_NODE",
 		SenderID: sender.ID,
@@ -219,24 +582,25 @@ func (network *Network) SendFindContactMessage(sender *Contact, receiver *Contac
 		TargetIP: target.Address,
 	}
 
-	response, err := network.SendMessage(sender, receiver, findNodeMsg)
+	response, err := network.SendMessage(ctx, sender, receiver, findNodeMsg)
 	if err != nil {
-		return nil, fmt.Errorf("error sending FIND_NODE message: %v", err)
+		return nil, fmt.Errorf("error sending FIND_NODE message: %w", err)
 	}
 
-	var resp Response
-
-	err = json.Unmarshal(response, &resp)
+	resp, err := decodeResponse(response)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling contacts: %v", err)
+		return nil, fmt.Errorf("%w: error decoding contacts: %w", ErrUnexpectedResponse, err)
+	}
+	if err := network.verifyResponse(resp, receiver); err != nil {
+		return nil, fmt.Errorf("error checking FIND_NODE reply: %w", err)
 	}
 	closestContacts := resp.ClosestContacts
-	fmt.Println("Closest contacts:", closestContacts)
+	network.logger().Debug("Received reply", "peer", receiver.Address, "rpc", "FIND_NODE", "contacts", len(closestContacts))
 	return closestContacts, nil
 }
 
 // SendFindDataMessage sends a FIND_DATA message to a receiver and waits for closest contacts and data
-func (network *Network) SendFindDataMessage(sender *Contact, receiver *Contact, hash string) ([]Contact, []byte, error) {
+func (network *Network) SendFindDataMessage(ctx context.Context, sender *Contact, receiver *Contact, hash string) ([]Contact, []byte, error) {
 	findNodeMsg := Message{
 		Type:     "FIND_DATA",
 		SenderID: sender.ID,
@@ -244,86 +608,249 @@ func (network *Network) SendFindDataMessage(sender *Contact, receiver *Contact,
 		TargetID: hash,
 	}
 
-	response, err := network.SendMessage(sender, receiver, findNodeMsg)
+	response, err := network.SendMessage(ctx, sender, receiver, findNodeMsg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error sending FIND_DATA message: %v", err)
-	}
-	type Response struct {
-		Data            []byte    `json:"data"`
-		ClosestContacts []Contact `json:"closest_contacts"`
+		return nil, nil, fmt.Errorf("error sending FIND_DATA message: %w", err)
 	}
 
-	var resp Response
-	err = json.Unmarshal(response, &resp)
+	resp, err := decodeResponse(response)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error unmarshalling data: %v", err)
+		return nil, nil, fmt.Errorf("%w: error decoding data: %w", ErrUnexpectedResponse, err)
+	}
+	if err := network.verifyResponse(resp, receiver); err != nil {
+		return nil, nil, fmt.Errorf("error checking FIND_DATA reply: %w", err)
 	}
 	data := resp.Data
 	closestContacts := resp.ClosestContacts
+	if data != nil {
+		if err := network.checkObjectSize(data); err != nil {
+			return closestContacts, nil, err
+		}
+		if !VerifyData(hash, data) {
+			return closestContacts, nil, fmt.Errorf("%w: FIND_DATA reply from %s", ErrInvalidData, receiver.Address)
+		}
+	}
 
 	return closestContacts, data, nil
 }
 
 // SendStoreMessage sends a STORE message to a receiver and waits for a STORE_OK response
-func (network *Network) SendStoreMessage(sender *Contact, receiver *Contact, dataID *KademliaID, data []byte) bool {
+func (network *Network) SendStoreMessage(ctx context.Context, sender *Contact, receiver *Contact, dataID *KademliaID, data []byte) error {
+	return network.SendStoreMessageWithTTL(ctx, sender, receiver, dataID, data, tExpire)
+}
+
+// SendStoreMessageWithTTL sends a STORE message carrying the remaining lifetime of the data
+func (network *Network) SendStoreMessageWithTTL(ctx context.Context, sender *Contact, receiver *Contact, dataID *KademliaID, data []byte, ttl time.Duration) error {
 	storeMsg := Message{
 		Type:     "STORE",
 		SenderID: sender.ID,
 		SenderIP: sender.Address,
 		DataID:   dataID,
 		Data:     data,
+		TTL:      ttl,
+	}
+	if err := network.checkObjectSize(data); err != nil {
+		return err
 	}
 
-	response, err := network.SendMessage(sender, receiver, storeMsg)
+	response, err := network.SendMessage(ctx, sender, receiver, storeMsg)
 	if err != nil {
-		fmt.Println("Error sending STORE message:", err)
-		return false
+		return fmt.Errorf("error sending STORE message: %w", err)
 	}
 
-	var responseMsg Message
-	err = json.Unmarshal(response, &responseMsg)
+	responseMsg, err := network.decodeMessage(response)
 	if err != nil {
-		fmt.Println("Error unmarshalling response:", err)
-		return false
-	}
-	fmt.Println("Response message:", responseMsg.Type)
-	if responseMsg.Type == "STORE_OK" {
-		fmt.Println("Received STORE_OK from", receiver.Address)
-		return true
-	} else {
-		fmt.Println("Received unexpected message:", responseMsg)
-		return false
-	}
+		return fmt.Errorf("%w: error decoding response: %w", ErrUnexpectedResponse, err)
+	}
+	switch responseMsg.Type {
+	case "STORE_OK":
+	case "STORE_TOO_LARGE":
+		return fmt.Errorf("%w: rejected by %s", ErrObjectTooLarge, receiver.Address)
+	case "STORE_INVALID":
+		return fmt.Errorf("%w: rejected by %s", ErrInvalidData, receiver.Address)
+	case "STORE_REJECTED":
+		return fmt.Errorf("%w: %s is rate limiting this node or its storage quota is used up", ErrStoreRejected, receiver.Address)
+	default:
+		return fmt.Errorf("%w: expected STORE_OK, got %s", ErrUnexpectedResponse, responseMsg.Type)
+	}
+	network.logger().Debug("Received reply", "peer", receiver.Address, "rpc", "STORE_OK")
+	return nil
 }
 
-// SendMessage sends a message to a receiver and waits for a response
-func (network *Network) SendMessage(sender *Contact, receiver *Contact, message interface{}) ([]byte, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", receiver.Address)
+// SendRefreshMessage sends a REFRESH message to a receiver and returns ErrNotFound if it answered REFRESH_FAIL
+func (network *Network) SendRefreshMessage(ctx context.Context, sender *Contact, receiver *Contact, dataID *KademliaID, ttl time.Duration) error {
+	refreshMsg := Message{
+		Type:     "REFRESH",
+		SenderID: sender.ID,
+		SenderIP: sender.Address,
+		DataID:   dataID,
+		TTL:      ttl,
+	}
+
+	response, err := network.SendMessage(ctx, sender, receiver, refreshMsg)
 	if err != nil {
-		return nil, fmt.Errorf("error resolving UDP address: %v", err)
+		return fmt.Errorf("error sending REFRESH message: %w", err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	responseMsg, err := network.decodeMessage(response)
 	if err != nil {
-		return nil, fmt.Errorf("error dialing UDP: %v", err)
+		return fmt.Errorf("%w: error decoding response: %w", ErrUnexpectedResponse, err)
+	}
+	switch responseMsg.Type {
+	case "REFRESH_OK":
+		return nil
+	case "REFRESH_FAIL":
+		return ErrNotFound
+	default:
+		return fmt.Errorf("%w: expected REFRESH_OK, got %s", ErrUnexpectedResponse, responseMsg.Type)
+	}
+}
+
+// SendMessage sends a message to a receiver and waits for the response carrying the same RPC ID,
+// every attempt times out after network.Timeout and failed attempts are resent network.Retries times
+func (network *Network) SendMessage(ctx context.Context, sender *Contact, receiver *Contact, message Message) ([]byte, error) {
+	if message.RPCID == nil {
+		message.RPCID = NewRandomKademliaID()
 	}
-	defer conn.Close()
 
-	data, err := json.Marshal(message)
+	data, err := network.encodeMessage(network.Encoding, message)
 	if err != nil {
 		return nil, fmt.Errorf("error serializing message: %v", err)
 	}
 
-	_, err = conn.Write(data)
+	conn, err := network.transport.Dial(receiver.Address)
 	if err != nil {
-		return nil, fmt.Errorf("error sending message: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
 	}
+	defer conn.Close()
+	data = network.preparePacket(data)
+	defer network.unstage(data)
+	network.metrics.rpcSent(message.Type)
+
+	var lastErr error
+	for attempt := 0; attempt <= network.Retries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		response, err := network.sendAttempt(ctx, conn, data, message.RPCID)
+		if err == nil {
+			return response, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		lastErr = err
+	}
+	network.metrics.rpcFailed(message.Type, lastErr)
+	return nil, lastErr
+}
 
-	var buf [8192]byte
-	n, _, err := conn.ReadFromUDP(buf[0:])
-	if err != nil {
-		return nil, fmt.Errorf("error receiving response: %v", err)
+// sendAttempt sends the encoded message once and waits for the matching reply until the RPC times out
+func (network *Network) sendAttempt(ctx context.Context, conn net.Conn, data []byte, rpcID *KademliaID) ([]byte, error) {
+	conn.SetDeadline(network.attemptDeadline(ctx))
+	// Unblock the read as soon as the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	for _, chunk := range splitPacket(data) {
+		if _, err := conn.Write(chunk); err != nil {
+			return nil, rpcError("error sending message", err)
+		}
+	}
+
+	remote := conn.RemoteAddr()
+	chunks := newReassembler(network.ObjectSizeLimit())
+	for {
+		var buf [maxDatagramSize]byte
+		n, err := conn.Read(buf[0:])
+		if err != nil {
+			return nil, rpcError("error receiving response", err)
+		}
+		reply, err := chunks.add(remote.String(), buf[:n])
+		if err != nil {
+			network.logger().Debug("Dropping chunk", "peer", remote.String(), "err", err)
+			continue
+		}
+		if reply == nil {
+			// A large reply is still arriving, give every chunk the full timeout
+			if ctx.Err() == nil {
+				conn.SetDeadline(network.attemptDeadline(ctx))
+			}
+			continue
+		}
+		if reply, err = network.resolvePacket(reply, remote); err != nil {
+			return nil, err
+		}
+		if replyMatchesRPC(reply, rpcID) {
+			return reply, nil
+		}
+		network.logger().Debug("Discarding reply with unexpected RPC ID", "peer", remote.String())
 	}
+}
+
+// attemptDeadline returns when the current wait for a reply times out
+func (network *Network) attemptDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(network.rpcTimeout())
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// writeTo sends a packet to the address, as a pointer to a stream if it is large
+// and in chunks if it still does not fit in one datagram, chunks are only sent to a host that
+// answered a PING and ErrUnproven is returned for any other
+func (network *Network) writeTo(packet []byte, addr net.Addr) error {
+	chunks := splitPacket(network.prepareReply(packet))
+	if len(chunks) > 1 && !network.proven.contains(sourceHost(addr.String()), time.Now()) {
+		return fmt.Errorf("%w: %s", ErrUnproven, addr.String())
+	}
+	for _, chunk := range chunks {
+		if _, err := network.transport.WriteTo(chunk, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return buf[:n], nil
+// writeReply sends the reply to a request, if it is sent in chunks and the host it came from has not
+// answered a PING yet the sender is pinged first
+func (network *Network) writeReply(k *Kademlia, receivedMessage Message, packet []byte, addr net.Addr) error {
+	err := network.writeTo(packet, addr)
+	if !errors.Is(err, ErrUnproven) {
+		return err
+	}
+	sender := &Contact{Address: receivedMessage.SenderIP}
+	if err := network.SendPingMessage(network.context(), &k.RoutingTable.Me, sender); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnproven, err)
+	}
+	return network.writeTo(packet, addr)
+}
+
+// rpcTimeout returns the timeout of a single RPC attempt
+func (network *Network) rpcTimeout() time.Duration {
+	if network.Timeout <= 0 {
+		return DefaultRPCTimeout
+	}
+	return network.Timeout
+}
+
+// rpcError wraps a socket error in ErrTimeout or ErrUnreachable
+func rpcError(description string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %s: %v", ErrTimeout, description, err)
+	}
+	return fmt.Errorf("%w: %s: %v", ErrUnreachable, description, err)
+}
+
+// replyMatchesRPC returns true if the encoded reply echoes the RPC ID
+func replyMatchesRPC(reply []byte, rpcID *KademliaID) bool {
+	replyID, err := decodeRPCID(reply)
+	if err != nil || replyID == nil {
+		return false
+	}
+	return replyID.Equals(rpcID)
 }
@@ -1,7 +1,15 @@
 package kademlia
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"d7024e/memnet"
 )
 
 // Test NewNetwork
@@ -11,3 +19,264 @@ func TestNewNetwork(t *testing.T) {
 		t.Error("Expected new network to be created")
 	}
 }
+
+func TestDeliverResponse_RoutesToMatchingRPC(t *testing.T) {
+	network := NewNetwork(nil)
+	firstID := NewRandomKademliaID()
+	secondID := NewRandomKademliaID()
+	firstChan := network.registerRPC(firstID)
+	secondChan := network.registerRPC(secondID)
+
+	network.deliverResponse(secondID, Response{Data: []byte("second")})
+	network.deliverResponse(firstID, Response{Data: []byte("first")})
+
+	if response := <-firstChan; string(response.Data) != "first" {
+		t.Errorf("Expected first response, got %s", string(response.Data))
+	}
+	if response := <-secondChan; string(response.Data) != "second" {
+		t.Errorf("Expected second response, got %s", string(response.Data))
+	}
+}
+
+func TestDeliverResponse_ReturnsFalseForUnknownRPC(t *testing.T) {
+	network := NewNetwork(nil)
+
+	if network.deliverResponse(NewRandomKademliaID(), Response{}) {
+		t.Error("Expected no delivery for an unregistered RPC ID")
+	}
+	if network.deliverResponse(nil, Response{}) {
+		t.Error("Expected no delivery for a nil RPC ID")
+	}
+}
+
+func TestUnregisterRPC_RemovesPendingRPC(t *testing.T) {
+	network := NewNetwork(nil)
+	rpcID := NewRandomKademliaID()
+	network.registerRPC(rpcID)
+
+	network.unregisterRPC(rpcID)
+
+	if network.deliverResponse(rpcID, Response{}) {
+		t.Error("Expected no delivery after unregistering the RPC ID")
+	}
+}
+
+func TestReplyMatchesRPC(t *testing.T) {
+	rpcID := NewRandomKademliaID()
+	matching, _ := json.Marshal(Response{RPCID: rpcID})
+	other, _ := json.Marshal(Message{RPCID: NewRandomKademliaID(), Type: "PONG"})
+	missing, _ := json.Marshal(Message{Type: "PONG"})
+
+	if !replyMatchesRPC(matching, rpcID) {
+		t.Error("Expected reply with the same RPC ID to match")
+	}
+	if replyMatchesRPC(other, rpcID) {
+		t.Error("Expected reply with another RPC ID not to match")
+	}
+	if replyMatchesRPC(missing, rpcID) {
+		t.Error("Expected reply without RPC ID not to match")
+	}
+}
+
+// silentPeer returns a contact for a UDP socket that counts requests but never answers
+func silentPeer(t *testing.T) (Contact, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var received int32
+	go func() {
+		var buf [8192]byte
+		for {
+			if _, _, err := conn.ReadFrom(buf[0:]); err != nil {
+				return
+			}
+			atomic.AddInt32(&received, 1)
+		}
+	}()
+	return NewContact(NewRandomKademliaID(), conn.LocalAddr().String()), &received
+}
+
+func TestSendPingMessage_TimesOutAndRetries(t *testing.T) {
+	peer, received := silentPeer(t)
+	network := NewNetwork(nil)
+	network.Timeout = 50 * time.Millisecond
+	network.Retries = 2
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:0")
+
+	err := network.SendPingMessage(context.Background(), &me, &peer)
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if count := atomic.LoadInt32(received); count != 3 {
+		t.Errorf("Expected 3 attempts, got %d", count)
+	}
+}
+
+func TestSendPingMessage_StopsOnCancelledContext(t *testing.T) {
+	peer, _ := silentPeer(t)
+	network := NewNetwork(nil)
+	network.Timeout = time.Minute
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := network.SendPingMessage(ctx, &me, &peer)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Expected cancellation to interrupt the RPC")
+	}
+}
+
+func TestSendPingMessage_UnreachableAddress(t *testing.T) {
+	network := NewNetwork(nil)
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:0")
+	peer := NewContact(NewRandomKademliaID(), "not-an-address")
+
+	err := network.SendPingMessage(context.Background(), &me, &peer)
+
+	if !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("Expected ErrUnreachable, got %v", err)
+	}
+}
+
+func TestSendPingMessage_ReceivesPong(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	peer := NewContact(NewRandomKademliaID(), conn.LocalAddr().String())
+	k := NewKademlia(NewRoutingTable(peer), conn)
+	go k.Network.Listen(k)
+	defer conn.Close()
+	network := NewNetwork(nil)
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:0")
+	// Drain the UpdateRT action sent after the PONG
+	go func() { <-k.ActionChannel }()
+
+	if err := network.SendPingMessage(context.Background(), &me, &peer); err != nil {
+		t.Fatalf("Expected PONG, got %v", err)
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	source := memnet.Addr("10.0.0.2:41000")
+	tests := []struct {
+		advertised string
+		expected   string
+	}{
+		{"10.0.0.2:8000", "10.0.0.2:8000"},
+		{"10.0.0.9:8000", "10.0.0.2:8000"},
+		{"kademlia-node:8000", "10.0.0.2:8000"},
+		{"", "10.0.0.2:41000"},
+	}
+	for _, test := range tests {
+		if address := senderAddress(test.advertised, source); address != test.expected {
+			t.Errorf("Expected %q advertised from %v to be reached at %q, got %q", test.advertised, source, test.expected, address)
+		}
+	}
+}
+
+func TestHandlePing_AddsSenderAtTheSourceAddressAndTellsItWhereThePingCameFrom(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	sender := memnetNode(t, network, "10.0.0.2:8000")
+	// The sender claims to be another host
+	claimed := NewContact(sender.RoutingTable.Me.ID, "10.0.0.9:8000")
+
+	_, observed, err := sender.Network.ping(context.Background(), &claimed, &node.RoutingTable.Me)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if host, _, _ := net.SplitHostPort(observed); host != "10.0.0.2" {
+		t.Errorf("Expected the PONG to tell the PING came from 10.0.0.2, got %q", observed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(node.RoutingTable.AllContacts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	contacts := node.RoutingTable.AllContacts()
+	if len(contacts) != 1 || contacts[0].Address != "10.0.0.2:8000" {
+		t.Errorf("Expected the sender at the address its PING came from, got %v", contacts)
+	}
+}
+
+func TestHandleStore_BoundsTheTTLToTheExpiryTime(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	sender := memnetNode(t, network, "10.0.0.2:8000")
+	data := []byte("data1")
+
+	err := sender.Network.SendStoreMessageWithTTL(context.Background(), &sender.RoutingTable.Me, &node.RoutingTable.Me, HashData(data), data, 1000*tExpire)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	key := HashData(data).String()
+	entry, ok := node.getEntry(key)
+	for deadline := time.Now().Add(time.Second); !ok && time.Now().Before(deadline); entry, ok = node.getEntry(key) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ok {
+		t.Fatal("Expected the value to be stored")
+	}
+	if ttl := time.Until(entry.ExpiresAt); ttl > tExpire {
+		t.Errorf("Expected the TTL to be at most %v, got %v", tExpire, ttl)
+	}
+}
+
+func TestHandleMessage_DropsLookupsWithAnInvalidTarget(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	sender := memnetNode(t, network, "10.0.0.2:8000")
+	me, receiver := &sender.RoutingTable.Me, &node.RoutingTable.Me
+
+	for _, rpc := range []string{"FIND_NODE", "FIND_DATA"} {
+		message := Message{Type: rpc, SenderID: me.ID, SenderIP: me.Address, TargetID: "ab"}
+		if _, err := sender.Network.SendMessage(context.Background(), me, receiver, message); !errors.Is(err, ErrTimeout) {
+			t.Errorf("Expected the %s to be dropped, got %v", rpc, err)
+		}
+		if count := node.Metrics.rejectedRPCs.Value(rpc, rejectedMalformed); count != 1 {
+			t.Errorf("Expected one malformed %s, got %v", rpc, count)
+		}
+	}
+	if err := sender.Network.SendPingMessage(context.Background(), me, receiver); err != nil {
+		t.Errorf("Expected the node to still answer, got %v", err)
+	}
+}
+
+func TestHandleMessage_DropsRequestsWithoutSenderID(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Network.RequireSignatures = false
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	sender := memnetNode(t, network, "10.0.0.2:8000")
+	sender.Network.SigningKey = nil
+	me, receiver := &sender.RoutingTable.Me, &node.RoutingTable.Me
+
+	message := Message{Type: "FIND_NODE", SenderIP: me.Address, TargetID: receiver.ID.String()}
+	if _, err := sender.Network.SendMessage(context.Background(), me, receiver, message); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected the FIND_NODE to be dropped, got %v", err)
+	}
+
+	if count := node.Metrics.rejectedRPCs.Value("FIND_NODE", rejectedMalformed); count != 1 {
+		t.Errorf("Expected one malformed FIND_NODE, got %v", count)
+	}
+	if err := sender.Network.SendPingMessage(context.Background(), me, receiver); err != nil {
+		t.Errorf("Expected the node to still answer, got %v", err)
+	}
+}
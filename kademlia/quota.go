@@ -0,0 +1,164 @@
+package kademlia
+
+import "sync"
+
+// DefaultStoreQuota is the number of bytes of values one publisher or one host may have stored on a node
+const DefaultStoreQuota = 256 << 20
+
+// DefaultStorageLimit is the number of bytes of values all other nodes together may have stored on a node
+const DefaultStorageLimit = 1 << 30
+
+// storeQuota counts the bytes of the values every publisher and every host has stored on the node,
+// the publisher of a value is the sender ID of the STORE that first stored it and the host its source IP.
+// Values found in the Store when the node starts only count towards the total, their publisher is not known
+type storeQuota struct {
+	mutex  sync.Mutex
+	owners map[string]quotaCharge // publisher, host and size of every charged key
+	used   map[KademliaID]int     // bytes charged to every publisher
+	hosts  map[string]int         // bytes charged to every host
+	total  int                    // bytes charged to anyone
+}
+
+// quotaCharge is the size of a value and the publisher and host it is charged to
+type quotaCharge struct {
+	publisher KademliaID
+	host      string
+	size      int
+	restored  bool // found in the Store on start, charged to no publisher or host
+}
+
+// allows returns false if charging the size of the value to the publisher and the host takes either over
+// the limit or all charged values over the total. A key that is already charged is not charged again,
+// whoever stores it again
+func (quota *storeQuota) allows(publisher KademliaID, host string, key string, size int, limit int, total int) bool {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	if _, ok := quota.owners[key]; ok {
+		return true
+	}
+	if limit > 0 && (quota.used[publisher]+size > limit || quota.hosts[host]+size > limit) {
+		return false
+	}
+	return total <= 0 || quota.total+size <= total
+}
+
+// charge charges the size of a stored value to the publisher and the host, unless the key is already charged
+// to a publisher
+func (quota *storeQuota) charge(publisher KademliaID, host string, key string, size int) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	if charge, ok := quota.owners[key]; ok {
+		if !charge.restored {
+			return
+		}
+		quota.total -= charge.size
+	}
+	if quota.owners == nil {
+		quota.owners = make(map[string]quotaCharge)
+	}
+	if quota.used == nil {
+		quota.used = make(map[KademliaID]int)
+		quota.hosts = make(map[string]int)
+	}
+	quota.owners[key] = quotaCharge{publisher: publisher, host: host, size: size}
+	quota.used[publisher] += size
+	quota.hosts[host] += size
+	quota.total += size
+}
+
+// restore charges the size of a value found in the Store to the total only
+func (quota *storeQuota) restore(key string, size int) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	if _, ok := quota.owners[key]; ok {
+		return
+	}
+	if quota.owners == nil {
+		quota.owners = make(map[string]quotaCharge)
+	}
+	quota.owners[key] = quotaCharge{size: size, restored: true}
+	quota.total += size
+}
+
+// owner returns the publisher the key is charged to, false if the key is not charged or its publisher is not known
+func (quota *storeQuota) owner(key string) (KademliaID, bool) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	charge, ok := quota.owners[key]
+	return charge.publisher, ok && !charge.restored
+}
+
+// release returns the size of a deleted value to its publisher
+func (quota *storeQuota) release(key string) {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	charge, ok := quota.owners[key]
+	if !ok {
+		return
+	}
+	delete(quota.owners, key)
+	quota.total -= charge.size
+	if charge.restored {
+		return
+	}
+	if quota.used[charge.publisher] -= charge.size; quota.used[charge.publisher] <= 0 {
+		delete(quota.used, charge.publisher)
+	}
+	if quota.hosts[charge.host] -= charge.size; quota.hosts[charge.host] <= 0 {
+		delete(quota.hosts, charge.host)
+	}
+}
+
+// allowsStore returns false if a value another node stores on this node takes its publisher or the IP it came
+// from over the StoreQuota, or the stored values over the StorageLimit. Senders without an ID share one quota
+func (kademlia *Kademlia) allowsStore(publisher *KademliaID, source string, key string, size int) bool {
+	return kademlia.quota.allows(quotaID(publisher), sourceHost(source), key, size, kademlia.StoreQuota, kademlia.StorageLimit)
+}
+
+// storeForPeer stores a value another node sent with a STORE and charges it to its publisher and the IP it came
+// from once it is stored, a value that no longer fits the quota when its action is performed is dropped
+func (kademlia *Kademlia) storeForPeer(action Action) {
+	if !kademlia.allowsStore(action.SenderId, action.SenderIp, action.Hash, len(action.Data)) {
+		kademlia.storeLogger().Info("Dropping value over the quota", "key", action.Hash, peerID(action.SenderId))
+		return
+	}
+	var err error
+	if action.Action == "Store" {
+		err = kademlia.StoreWithTTL(action.Hash, action.Data, action.TTL)
+	} else {
+		_, err = kademlia.StoreIfMissing(action.Hash, action.Data, action.TTL)
+	}
+	if err != nil {
+		return
+	}
+	kademlia.quota.charge(quotaID(action.SenderId), sourceHost(action.SenderIp), action.Hash, len(action.Data))
+}
+
+// restoreQuota charges the values kept in the Store by an earlier run to the StorageLimit
+func (kademlia *Kademlia) restoreQuota() {
+	infos, err := kademlia.Storage.List()
+	if err != nil {
+		kademlia.storeLogger().Error("Error listing stored data", "err", err)
+		return
+	}
+	for _, info := range infos {
+		kademlia.quota.restore(info.Key, info.Size)
+	}
+}
+
+// quotaID returns the ID a publisher is charged by, senders without an ID share the zero ID
+func quotaID(publisher *KademliaID) KademliaID {
+	if publisher == nil {
+		return KademliaID{}
+	}
+	return *publisher
+}
+
+// isPublisher returns true if the sender of a signed message first stored the key on this node
+func (kademlia *Kademlia) isPublisher(message Message, key string) bool {
+	if message.Signature == nil || message.SenderID == nil {
+		return false
+	}
+	publisher, ok := kademlia.quota.owner(key)
+	return ok && publisher == *message.SenderID
+}
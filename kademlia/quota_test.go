@@ -0,0 +1,129 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+// reserve charges the value if the quota allows it, like a STORE that is stored
+func (quota *storeQuota) reserve(publisher KademliaID, host string, key string, size int, limit int, total int) bool {
+	if !quota.allows(publisher, host, key, size, limit, total) {
+		return false
+	}
+	quota.charge(publisher, host, key, size)
+	return true
+}
+
+// failingStore is a Store whose writes fail
+type failingStore struct {
+	Store
+}
+
+func (store failingStore) Put(key string, entry Entry) error {
+	return errors.New("disk full")
+}
+
+func TestStoreQuota_ChargesEveryKeyOnceAndReleasesDeletedKeys(t *testing.T) {
+	var quota storeQuota
+	publisher, other := *NewRandomKademliaID(), *NewRandomKademliaID()
+
+	if !quota.reserve(publisher, "10.0.0.2", "a", 60, 100, 0) || !quota.reserve(other, "10.0.0.3", "a", 60, 100, 0) {
+		t.Fatal("Expected the first value to fit and storing it again to be free")
+	}
+	if quota.reserve(publisher, "10.0.0.2", "b", 60, 100, 0) {
+		t.Error("Expected a second value to take the publisher over the quota")
+	}
+	if !quota.reserve(other, "10.0.0.3", "b", 60, 100, 0) {
+		t.Error("Expected another publisher to have its own quota")
+	}
+	quota.release("a")
+	if !quota.reserve(publisher, "10.0.0.2", "c", 60, 100, 0) {
+		t.Error("Expected the released bytes to be available again")
+	}
+}
+
+func TestStoreQuota_LimitsEveryHostAndTheTotal(t *testing.T) {
+	var quota storeQuota
+
+	quota.reserve(*NewRandomKademliaID(), "10.0.0.2", "a", 60, 100, 150)
+	if quota.reserve(*NewRandomKademliaID(), "10.0.0.2", "b", 60, 100, 150) {
+		t.Error("Expected a new ID on the same host to be over the quota of the host")
+	}
+	if !quota.reserve(*NewRandomKademliaID(), "10.0.0.3", "b", 60, 100, 150) {
+		t.Error("Expected another host to have its own quota")
+	}
+	if quota.reserve(*NewRandomKademliaID(), "10.0.0.4", "c", 60, 100, 150) {
+		t.Error("Expected a third value to take the node over its storage limit")
+	}
+	quota.release("a")
+	if !quota.reserve(*NewRandomKademliaID(), "10.0.0.2", "c", 60, 100, 150) {
+		t.Error("Expected the released bytes to be available to the host and the total again")
+	}
+}
+
+func TestHandleStore_RejectsValuesOverThePublisherQuota(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.StoreQuota = 10
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	sender := memnetNode(t, network, "10.0.0.2:8000")
+	me, receiver := &sender.RoutingTable.Me, &node.RoutingTable.Me
+	first, second := []byte("value one"), []byte("value two")
+
+	if err := sender.Network.SendStoreMessageWithTTL(context.Background(), me, receiver, HashData(first), first, time.Hour); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The value is charged once it is stored
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := node.quota.owner(HashData(first).String()); ok {
+			break
+		}
+	}
+	err := sender.Network.SendStoreMessageWithTTL(context.Background(), me, receiver, HashData(second), second, time.Hour)
+
+	if !errors.Is(err, ErrStoreRejected) {
+		t.Errorf("Expected the second value to be rejected, got %v", err)
+	}
+	if count := node.Metrics.rejectedRPCs.Value("STORE", rejectedQuota); count != 1 {
+		t.Errorf("Expected one STORE over the quota, got %v", count)
+	}
+}
+
+func TestStoreForPeer_ChargesOnlyStoredValues(t *testing.T) {
+	kademlia := NewKademlia(NewRoutingTable(NewContact(NewRandomKademliaID(), "10.0.0.1:8000")), nil)
+	kademlia.Storage = failingStore{NewMemoryStore()}
+	action := Action{Action: "Store", Hash: HashData([]byte("data1")).String(), Data: []byte("data1"), SenderId: NewRandomKademliaID(), SenderIp: "10.0.0.2:8000"}
+
+	kademlia.storeForPeer(action)
+
+	if _, ok := kademlia.quota.owner(action.Hash); ok || kademlia.quota.total != 0 {
+		t.Errorf("Expected a value that was not stored not to be charged, %d bytes charged", kademlia.quota.total)
+	}
+	kademlia.Storage = NewMemoryStore()
+	kademlia.storeForPeer(action)
+	if publisher, ok := kademlia.quota.owner(action.Hash); !ok || publisher != *action.SenderId {
+		t.Error("Expected the stored value to be charged to its publisher")
+	}
+}
+
+func TestStart_RestoresTheStorageLimitFromTheStore(t *testing.T) {
+	node := memnetNode(t, memnet.New(1), "10.0.0.1:8000")
+	node.StorageLimit = 10
+	key := HashData([]byte("value one")).String()
+	node.Storage.Put(key, Entry{Data: []byte("value one"), ExpiresAt: time.Now().Add(time.Hour)})
+
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+
+	if node.allowsStore(NewRandomKademliaID(), "10.0.0.2:8000", HashData([]byte("value two")).String(), 9) {
+		t.Error("Expected the stored value to count towards the storage limit")
+	}
+	if _, ok := node.quota.owner(key); ok {
+		t.Error("Expected the publisher of a restored value to be unknown")
+	}
+}
@@ -0,0 +1,137 @@
+package kademlia
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Every source IP has one token bucket for all its packets and every sender ID has a token bucket for each
+// request type. A packet takes a token from the bucket of its IP as soon as it is received, before it is fetched,
+// verified or handled, and a request then takes one from the bucket of its sender ID. Either empty bucket drops
+// it, so neither a host with many IDs nor an ID sent from many hosts gets past the limit.
+
+// maxRateBuckets bounds the number of token buckets kept for sources that sent requests
+const maxRateBuckets = 10000
+
+// Reasons a request is rejected for, they label the rejected request counter
+const (
+	rejectedRateLimit = "rate_limit"
+	rejectedQuota     = "quota"
+	rejectedMalformed = "malformed"
+)
+
+// DefaultRateLimit is far above what the lookups and republishing of a single node send to another
+var DefaultRateLimit = RateLimit{Rate: 20, Burst: 50}
+
+// RateLimit is the number of requests of one type a source may send per second, and in a burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits returns the same limit for every request type, nil if the limit does not allow any request
+func RateLimits(limit RateLimit) map[string]RateLimit {
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		return nil
+	}
+	limits := make(map[string]RateLimit)
+	for _, rpc := range []string{"PING", "STORE", "FIND_NODE", "FIND_DATA", "REFRESH"} {
+		limits[rpc] = limit
+	}
+	return limits
+}
+
+// tokenBucket holds the tokens a source has left for one request type
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens earned since the last update, up to the burst
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens = min(float64(bucket.limit.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.limit.Rate)
+	bucket.updated = now
+}
+
+// rateLimiter keeps the token buckets of the sources that sent requests
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow takes a token from the bucket of every key if all of them have one left
+func (limiter *rateLimiter) allow(limit RateLimit, now time.Time, keys ...string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = limiter.bucket(key, limit, now)
+		buckets[i].refill(now)
+		if buckets[i].tokens < 1 {
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true
+}
+
+// bucket returns the bucket of the key, a new bucket starts full
+func (limiter *rateLimiter) bucket(key string, limit RateLimit, now time.Time) *tokenBucket {
+	if bucket, ok := limiter.buckets[key]; ok {
+		bucket.limit = limit
+		return bucket
+	}
+	if limiter.buckets == nil {
+		limiter.buckets = make(map[string]*tokenBucket)
+	}
+	if len(limiter.buckets) >= maxRateBuckets {
+		limiter.prune(now)
+	}
+	bucket := &tokenBucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+	limiter.buckets[key] = bucket
+	return bucket
+}
+
+// prune forgets the buckets that are full again, forgetting them loses nothing as new buckets start full.
+// If every bucket is in use it forgets an arbitrary one
+func (limiter *rateLimiter) prune(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if bucket.refill(now); bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+	for key := range limiter.buckets {
+		if len(limiter.buckets) < maxRateBuckets {
+			break
+		}
+		delete(limiter.buckets, key)
+	}
+}
+
+// allowPacket takes a token from the bucket of the IP a packet came from, it returns false if the IP
+// sent more packets than the limits of all request types together allow
+func (network *Network) allowPacket(source net.Addr) bool {
+	var limit RateLimit
+	for _, typeLimit := range network.RateLimits {
+		limit.Rate += typeLimit.Rate
+		limit.Burst += typeLimit.Burst
+	}
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		return true
+	}
+	return network.limiter.allow(limit, time.Now(), "ip "+sourceHost(source.String()))
+}
+
+// allowRequest takes a token from the bucket of the sender ID of a request,
+// it returns false if the sender is over the limit of the request type
+func (network *Network) allowRequest(message Message) bool {
+	limit, ok := network.RateLimits[message.Type]
+	if !ok {
+		return true
+	}
+	return network.limiter.allow(limit, time.Now(), message.Type+" id "+message.SenderID.String())
+}
@@ -0,0 +1,119 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+func TestRateLimiter_AllowsBurstAndRefillsAtRate(t *testing.T) {
+	var limiter rateLimiter
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow(limit, now, "PING ip 10.0.0.2") {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	if limiter.allow(limit, now, "PING ip 10.0.0.2") {
+		t.Error("Expected the request after the burst to be rejected")
+	}
+	if !limiter.allow(limit, now.Add(500*time.Millisecond), "PING ip 10.0.0.2") {
+		t.Error("Expected a token after half a second at 2 per second")
+	}
+	if !limiter.allow(limit, now, "PING ip 10.0.0.3") {
+		t.Error("Expected another source to have its own bucket")
+	}
+}
+
+func TestRateLimiter_RejectsWhenAnyBucketIsEmptyWithoutTakingFromTheOthers(t *testing.T) {
+	var limiter rateLimiter
+	limit := RateLimit{Rate: 1, Burst: 1}
+	now := time.Now()
+	limiter.allow(limit, now, "STORE id 01")
+
+	// The sender ID has used its token, the fresh IP must keep its own
+	if limiter.allow(limit, now, "STORE ip 10.0.0.2", "STORE id 01") {
+		t.Fatal("Expected the request to be rejected for its sender ID")
+	}
+	if !limiter.allow(limit, now, "STORE ip 10.0.0.2", "STORE id 02") {
+		t.Error("Expected the IP to still have its token")
+	}
+}
+
+func TestRateLimiter_KeepsABoundedNumberOfBuckets(t *testing.T) {
+	var limiter rateLimiter
+	limit := RateLimit{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	for i := 0; i < maxRateBuckets+100; i++ {
+		limiter.allow(limit, now, "PING ip "+strconv.Itoa(i))
+	}
+
+	if len(limiter.buckets) > maxRateBuckets {
+		t.Errorf("Expected at most %d buckets, got %d", maxRateBuckets, len(limiter.buckets))
+	}
+}
+
+func TestHandleMessage_RejectsStoresAndDropsPingsOverTheRateLimit(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Network.RateLimits = RateLimits(RateLimit{Rate: 0.001, Burst: 2})
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	sender := memnetNode(t, network, "10.0.0.2:8000")
+	me, receiver := &sender.RoutingTable.Me, &node.RoutingTable.Me
+	data := []byte("data1")
+	key := HashData(data)
+
+	var storeErr, pingErr error
+	for i := 0; i < 3; i++ {
+		storeErr = sender.Network.SendStoreMessageWithTTL(context.Background(), me, receiver, key, data, time.Hour)
+		pingErr = sender.Network.SendPingMessage(context.Background(), me, receiver)
+	}
+
+	if !errors.Is(storeErr, ErrStoreRejected) {
+		t.Errorf("Expected the third STORE to be rejected, got %v", storeErr)
+	}
+	if !errors.Is(pingErr, ErrTimeout) {
+		t.Errorf("Expected the third PING to be dropped, got %v", pingErr)
+	}
+	for _, rpc := range []string{"STORE", "PING"} {
+		if count := node.Metrics.rejectedRPCs.Value(rpc, rejectedRateLimit); count != 1 {
+			t.Errorf("Expected one %s over the rate limit, got %v", rpc, count)
+		}
+	}
+}
+
+func TestListen_DropsPacketsOverTheLimitOfTheirIP(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	// Every ID may send one PING, the IP five packets of any type
+	node.Network.RateLimits = RateLimits(RateLimit{Rate: 0.001, Burst: 1})
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	receiver := &node.RoutingTable.Me
+
+	var errs []error
+	for port := 8000; port < 8006; port++ {
+		sender := memnetNode(t, network, "10.0.0.2:"+strconv.Itoa(port))
+		errs = append(errs, sender.Network.SendPingMessage(context.Background(), &sender.RoutingTable.Me, receiver))
+	}
+
+	for i, err := range errs[:5] {
+		if err != nil {
+			t.Errorf("Expected the PING of sender %d to be answered, got %v", i+1, err)
+		}
+	}
+	if !errors.Is(errs[5], ErrTimeout) {
+		t.Errorf("Expected the sixth PING from the IP to be dropped, got %v", errs[5])
+	}
+	if count := node.Metrics.rejectedRPCs.Value("PACKET", rejectedRateLimit); count != 1 {
+		t.Errorf("Expected one packet over the rate limit, got %v", count)
+	}
+}
@@ -0,0 +1,54 @@
+package kademlia
+
+import (
+	"context"
+	"time"
+)
+
+const DefaultRefreshInterval = time.Hour
+const refreshCheckInterval = time.Minute
+
+// ListenRefreshTicker refreshes stale buckets until the context is cancelled
+func (kademlia *Kademlia) ListenRefreshTicker(ctx context.Context) {
+	checkInterval := refreshCheckInterval
+	if interval := kademlia.refreshInterval(); interval < checkInterval {
+		checkInterval = interval
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			kademlia.RefreshBuckets(ctx)
+		}
+	}
+}
+
+// RefreshBuckets does a NodeLookup on a random ID in the range of every bucket
+// that has not been touched within the refresh interval
+func (kademlia *Kademlia) RefreshBuckets(ctx context.Context) int {
+	refreshed := 0
+	for _, index := range kademlia.RoutingTable.StaleBuckets(kademlia.refreshInterval()) {
+		if ctx.Err() != nil {
+			break
+		}
+		target := NewContact(kademlia.RoutingTable.RandomIDInBucket(index), "")
+		// NodeLookup touches the bucket even if no contacts are found
+		kademlia.NodeLookup(ctx, &target, "")
+		refreshed++
+	}
+	if refreshed > 0 {
+		kademlia.routingLogger().Debug("Refreshed stale buckets", "buckets", refreshed)
+	}
+	return refreshed
+}
+
+// refreshInterval returns how long a bucket may go untouched before it is refreshed
+func (kademlia *Kademlia) refreshInterval() time.Duration {
+	if kademlia.RefreshInterval <= 0 {
+		return DefaultRefreshInterval
+	}
+	return kademlia.RefreshInterval
+}
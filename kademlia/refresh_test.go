@@ -0,0 +1,84 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRandomIDInBucket_FallsInBucketRange(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000"))
+
+	for _, index := range []int{0, 1, 7, 8, 42, IDLength*8 - 1} {
+		id := rt.RandomIDInBucket(index)
+		if got := rt.getBucketIndex(id); got != index {
+			t.Errorf("Expected random ID in bucket %d, got bucket %d", index, got)
+		}
+	}
+}
+
+func TestStaleBuckets_ReturnsUntouchedBuckets(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000"))
+	for i := 0; i < IDLength*8; i++ {
+		rt.buckets[i].lastTouched = time.Now().Add(-2 * time.Hour)
+	}
+	rt.TouchBucket(rt.RandomIDInBucket(3))
+
+	stale := rt.StaleBuckets(time.Hour)
+
+	if len(stale) != IDLength*8-1 {
+		t.Fatalf("Expected %d stale buckets, got %d", IDLength*8-1, len(stale))
+	}
+	for _, index := range stale {
+		if index == 3 {
+			t.Error("Expected touched bucket not to be stale")
+		}
+	}
+}
+
+func TestAddContact_TouchesBucket(t *testing.T) {
+	bucket := newBucket()
+	bucket.lastTouched = time.Now().Add(-2 * time.Hour)
+
+	bucket.AddContact(NewContact(NewRandomKademliaID(), "127.0.0.1:8000"))
+
+	if time.Since(bucket.LastTouched()) > time.Minute {
+		t.Error("Expected adding a contact to touch the bucket")
+	}
+}
+
+func TestRefreshBuckets_TouchesStaleBuckets(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000"))
+	kademlia := &Kademlia{RoutingTable: rt, RefreshInterval: time.Hour}
+	rt.buckets[5].lastTouched = time.Now().Add(-2 * time.Hour)
+	rt.buckets[9].lastTouched = time.Now().Add(-2 * time.Hour)
+
+	refreshed := kademlia.RefreshBuckets(context.Background())
+
+	if refreshed != 2 {
+		t.Errorf("Expected 2 refreshed buckets, got %d", refreshed)
+	}
+	if len(rt.StaleBuckets(time.Hour)) != 0 {
+		t.Error("Expected no stale buckets after refreshing")
+	}
+}
+
+func TestListenRefreshTicker_StopsOnCancel(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000"))
+	kademlia := &Kademlia{RoutingTable: rt, RefreshInterval: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		kademlia.ListenRefreshTicker(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected refresher to stop after cancel")
+	}
+}
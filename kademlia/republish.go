@@ -0,0 +1,285 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const tExpire = 24 * time.Hour    // time after which a stored value is evicted
+const tReplicate = time.Hour      // interval at which stored values are republished to the k closest nodes
+const tRepublish = 12 * time.Hour // interval at which the original publisher re-stores its values
+
+// publishedValue is a value originally PUT by this node
+type publishedValue struct {
+	Data          []byte
+	LastPublished time.Time
+}
+
+// StoreWithTTL stores the data and sets it to expire after ttl,
+// a ttl of zero or less falls back to the default expiry time
+func (kademlia *Kademlia) StoreWithTTL(hash string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = tExpire
+	}
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	if err := kademlia.Storage.Put(hash, Entry{Data: data, ExpiresAt: time.Now().Add(ttl)}); err != nil {
+		kademlia.storeLogger().Error("Error storing data", "key", hash, "err", err)
+		return err
+	}
+	return nil
+}
+
+// StoreIfMissing stores the data and sets it to expire after ttl unless it is already stored,
+// it returns false if the stored value was kept
+func (kademlia *Kademlia) StoreIfMissing(hash string, data []byte, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		ttl = tExpire
+	}
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	if _, ok := kademlia.getEntry(hash); ok {
+		return false, nil
+	}
+	if err := kademlia.Storage.Put(hash, Entry{Data: data, ExpiresAt: time.Now().Add(ttl)}); err != nil {
+		kademlia.storeLogger().Error("Error storing data", "key", hash, "err", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// networkTTL bounds the TTL another node asks for to (0, tExpire], so no node can keep a value
+// alive longer than a PUT does
+func networkTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > tExpire {
+		return tExpire
+	}
+	return ttl
+}
+
+// getData returns the stored data for the hash if it exists and has not expired
+func (kademlia *Kademlia) getData(hash string) ([]byte, bool) {
+	entry, ok := kademlia.getEntry(hash)
+	return entry.Data, ok
+}
+
+// getEntry returns the stored entry for the hash if it exists and has not expired
+func (kademlia *Kademlia) getEntry(hash string) (Entry, bool) {
+	entry, ok, err := kademlia.Storage.Get(hash)
+	if err != nil {
+		kademlia.storeLogger().Error("Error reading data", "key", hash, "err", err)
+		return Entry{}, false
+	}
+	if !ok || !time.Now().Before(entry.ExpiresAt) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// remainingTTL returns how long the stored data for the hash has left before it expires
+func (kademlia *Kademlia) remainingTTL(hash string) time.Duration {
+	entry, ok := kademlia.getEntry(hash)
+	if !ok {
+		return tExpire
+	}
+	return time.Until(entry.ExpiresAt)
+}
+
+// ExpireData evicts all stored values whose TTL has run out
+func (kademlia *Kademlia) ExpireData() {
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	infos, err := kademlia.Storage.List()
+	if err != nil {
+		kademlia.storeLogger().Error("Error listing stored data", "err", err)
+		return
+	}
+	now := time.Now()
+	for _, info := range infos {
+		if now.Before(info.ExpiresAt) {
+			continue
+		}
+		if err := kademlia.Storage.Delete(info.Key); err != nil {
+			kademlia.storeLogger().Error("Error deleting expired data", "key", info.Key, "err", err)
+			continue
+		}
+		kademlia.quota.release(info.Key)
+	}
+}
+
+// Publish marks the data as originally PUT by this node so it is re-stored before it expires
+func (kademlia *Kademlia) Publish(hash string, data []byte) {
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	if kademlia.published == nil {
+		kademlia.published = make(map[string]*publishedValue)
+	}
+	kademlia.published[hash] = &publishedValue{Data: data, LastPublished: time.Now()}
+}
+
+// Forget stops this node from refreshing data it has published, returns false if the hash was not published here
+func (kademlia *Kademlia) Forget(hash string) bool {
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	if _, ok := kademlia.published[hash]; !ok {
+		return false
+	}
+	delete(kademlia.published, hash)
+	return true
+}
+
+// RefreshTTL resets the TTL of stored data, returns false if the data is not stored or has expired
+func (kademlia *Kademlia) RefreshTTL(hash string, ttl time.Duration) bool {
+	if ttl <= 0 {
+		ttl = tExpire
+	}
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	entry, ok := kademlia.getEntry(hash)
+	if !ok {
+		return false
+	}
+	entry.ExpiresAt = time.Now().Add(ttl)
+	if err := kademlia.Storage.Put(hash, entry); err != nil {
+		kademlia.storeLogger().Error("Error refreshing data", "key", hash, "err", err)
+		return false
+	}
+	return true
+}
+
+// ListenRepublishTicker expires and republishes stored values every tReplicate until the context is cancelled
+func (kademlia *Kademlia) ListenRepublishTicker(ctx context.Context) {
+	ticker := time.NewTicker(tReplicate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			kademlia.RepublishData(ctx)
+		}
+	}
+}
+
+// RepublishData evicts expired values, replicates the remaining ones to the k closest nodes
+// and refreshes the values published by this node that are due for republishing
+func (kademlia *Kademlia) RepublishData(ctx context.Context) {
+	kademlia.ExpireData()
+
+	// Values are read one at a time, a store on disk may hold more than fits in memory
+	for _, hash := range kademlia.storedKeys() {
+		entry, ok := kademlia.getEntry(hash)
+		if !ok {
+			continue
+		}
+		kademlia.storeOnClosestContacts(ctx, hash, entry.Data, time.Until(entry.ExpiresAt))
+	}
+
+	for hash, data := range kademlia.duePublishedSnapshot() {
+		kademlia.refreshOnClosestContacts(ctx, hash, data)
+	}
+}
+
+// storedKeys returns the keys of the stored values
+func (kademlia *Kademlia) storedKeys() []string {
+	infos, err := kademlia.Storage.List()
+	if err != nil {
+		kademlia.storeLogger().Error("Error listing stored data", "err", err)
+		return nil
+	}
+	keys := make([]string, len(infos))
+	for i, info := range infos {
+		keys[i] = info.Key
+	}
+	return keys
+}
+
+// duePublishedSnapshot returns the published values that are due for republishing
+// and marks them as published now
+func (kademlia *Kademlia) duePublishedSnapshot() map[string][]byte {
+	kademlia.dataMutex.Lock()
+	defer kademlia.dataMutex.Unlock()
+	due := make(map[string][]byte)
+	now := time.Now()
+	for hash, value := range kademlia.published {
+		if now.Sub(value.LastPublished) >= tRepublish {
+			due[hash] = value.Data
+			value.LastPublished = now
+		}
+	}
+	return due
+}
+
+// storeOnClosestContacts finds the k closest nodes to the hash and stores the data on them with the given TTL
+func (kademlia *Kademlia) storeOnClosestContacts(ctx context.Context, hash string, data []byte, ttl time.Duration) int {
+	dataID := NewKademliaID(hash)
+	target := NewContact(dataID, "")
+	contacts, _, _ := kademlia.NodeLookup(ctx, &target, "")
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	successCount := 0
+	for _, contact := range contacts {
+		// Refresh our own copy locally instead of sending a STORE to ourselves
+		if contact.ID.Equals(kademlia.RoutingTable.Me.ID) {
+			kademlia.StoreWithTTL(hash, data, ttl)
+			successCount++
+			continue
+		}
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			err := kademlia.Network.SendStoreMessageWithTTL(ctx, &kademlia.RoutingTable.Me, &contact, dataID, data, ttl)
+			if err != nil {
+				kademlia.reportFailedRPC(contact, err)
+				return
+			}
+			mutex.Lock()
+			successCount++
+			mutex.Unlock()
+		}(contact)
+	}
+	wg.Wait()
+	kademlia.storeLogger().Debug("Republished data", "key", hash, "contacts", successCount)
+	return successCount
+}
+
+// refreshOnClosestContacts resets the TTL of the data on the k closest nodes to the hash,
+// nodes that do not have the data yet get a STORE instead
+func (kademlia *Kademlia) refreshOnClosestContacts(ctx context.Context, hash string, data []byte) int {
+	dataID := NewKademliaID(hash)
+	target := NewContact(dataID, "")
+	contacts, _, _ := kademlia.NodeLookup(ctx, &target, "")
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	successCount := 0
+	for _, contact := range contacts {
+		if contact.ID.Equals(kademlia.RoutingTable.Me.ID) {
+			kademlia.StoreWithTTL(hash, data, tExpire)
+			successCount++
+			continue
+		}
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			me := &kademlia.RoutingTable.Me
+			err := kademlia.Network.SendRefreshMessage(ctx, me, &contact, dataID, tExpire)
+			if errors.Is(err, ErrNotFound) {
+				err = kademlia.Network.SendStoreMessageWithTTL(ctx, me, &contact, dataID, data, tExpire)
+			}
+			if err != nil {
+				kademlia.reportFailedRPC(contact, err)
+				return
+			}
+			mutex.Lock()
+			successCount++
+			mutex.Unlock()
+		}(contact)
+	}
+	wg.Wait()
+	kademlia.storeLogger().Debug("Refreshed published data", "key", hash, "contacts", successCount)
+	return successCount
+}
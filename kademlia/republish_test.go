@@ -0,0 +1,222 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+func TestStoreWithTTL_SetsExpiry(t *testing.T) {
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+
+	kademlia.StoreWithTTL("hash1", []byte("data1"), time.Minute)
+
+	entry, ok, _ := kademlia.Storage.Get("hash1")
+	expiresAt := entry.ExpiresAt
+	if !ok {
+		t.Fatal("Expected expiry to be set")
+	}
+	if time.Until(expiresAt) > time.Minute || time.Until(expiresAt) <= 0 {
+		t.Errorf("Expected expiry within a minute, got %v", time.Until(expiresAt))
+	}
+}
+
+func TestStoreWithTTL_UsesDefaultForNonPositiveTTL(t *testing.T) {
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+
+	kademlia.StoreWithTTL("hash1", []byte("data1"), 0)
+
+	if ttl := kademlia.remainingTTL("hash1"); ttl <= tExpire-time.Minute {
+		t.Errorf("Expected default TTL %v, got %v", tExpire, ttl)
+	}
+}
+
+func TestLookupData_IgnoresExpiredData(t *testing.T) {
+	kademlia := &Kademlia{
+		Storage:      NewMemoryStore(),
+		RoutingTable: NewRoutingTable(NewContact(NewRandomKademliaID(), "172.20.0.1:8000")),
+	}
+	hash := NewRandomKademliaID().String()
+	kademlia.StoreWithTTL(hash, []byte("data1"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	data, _ := kademlia.LookupData(hash)
+
+	if data != nil {
+		t.Errorf("Expected expired data to be ignored, got %s", string(data))
+	}
+}
+
+func TestExpireData_RemovesExpiredValues(t *testing.T) {
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+	kademlia.StoreWithTTL("expired", []byte("old"), time.Nanosecond)
+	kademlia.StoreWithTTL("alive", []byte("new"), time.Hour)
+	time.Sleep(time.Millisecond)
+
+	kademlia.ExpireData()
+
+	if _, ok, _ := kademlia.Storage.Get("expired"); ok {
+		t.Error("Expected expired value to be evicted")
+	}
+	if _, ok, _ := kademlia.Storage.Get("alive"); !ok {
+		t.Error("Expected unexpired value to be kept")
+	}
+}
+
+func TestPublish_RecordsPublishedValue(t *testing.T) {
+	kademlia := &Kademlia{}
+
+	kademlia.Publish("hash1", []byte("data1"))
+
+	value, ok := kademlia.published["hash1"]
+	if !ok || string(value.Data) != "data1" {
+		t.Fatal("Expected value to be recorded as published")
+	}
+}
+
+func TestDuePublishedSnapshot_ReturnsOnlyDueValues(t *testing.T) {
+	kademlia := &Kademlia{}
+	kademlia.Publish("fresh", []byte("fresh"))
+	kademlia.Publish("stale", []byte("stale"))
+	kademlia.published["stale"].LastPublished = time.Now().Add(-tRepublish)
+
+	due := kademlia.duePublishedSnapshot()
+
+	if len(due) != 1 || string(due["stale"]) != "stale" {
+		t.Errorf("Expected only the stale value to be due, got %v", due)
+	}
+	if time.Since(kademlia.published["stale"].LastPublished) >= tRepublish {
+		t.Error("Expected LastPublished to be updated")
+	}
+}
+
+func TestRepublishData_RefreshesOwnCopyWhenAlone(t *testing.T) {
+	me := NewContact(NewRandomKademliaID(), "172.20.0.1:8000")
+	kademlia := &Kademlia{Storage: NewMemoryStore(), RoutingTable: NewRoutingTable(me)}
+	hash := NewRandomKademliaID().String()
+	kademlia.StoreWithTTL(hash, []byte("data1"), time.Hour)
+
+	kademlia.RepublishData(context.Background())
+
+	if data, ok := kademlia.getData(hash); !ok || string(data) != "data1" {
+		t.Error("Expected data to still be stored after republishing")
+	}
+}
+
+func TestForget_RemovesPublishedValue(t *testing.T) {
+	kademlia := &Kademlia{}
+	kademlia.Publish("hash1", []byte("data1"))
+
+	if !kademlia.Forget("hash1") {
+		t.Fatal("Expected Forget to return true for a published value")
+	}
+	if _, ok := kademlia.published["hash1"]; ok {
+		t.Error("Expected value to no longer be published")
+	}
+}
+
+func TestForget_ReturnsFalseForUnknownHash(t *testing.T) {
+	kademlia := &Kademlia{}
+
+	if kademlia.Forget("hash1") {
+		t.Error("Expected Forget to return false for an unknown hash")
+	}
+}
+
+func TestRefreshTTL_ResetsExpiry(t *testing.T) {
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+	kademlia.StoreWithTTL("hash1", []byte("data1"), time.Minute)
+
+	if !kademlia.RefreshTTL("hash1", time.Hour) {
+		t.Fatal("Expected RefreshTTL to return true for stored data")
+	}
+	if ttl := kademlia.remainingTTL("hash1"); ttl <= time.Minute {
+		t.Errorf("Expected TTL to be reset to an hour, got %v", ttl)
+	}
+}
+
+func TestRefreshTTL_ReturnsFalseForMissingOrExpiredData(t *testing.T) {
+	kademlia := &Kademlia{Storage: NewMemoryStore()}
+	kademlia.StoreWithTTL("expired", []byte("data1"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if kademlia.RefreshTTL("missing", time.Hour) {
+		t.Error("Expected RefreshTTL to return false for missing data")
+	}
+	if kademlia.RefreshTTL("expired", time.Hour) {
+		t.Error("Expected RefreshTTL to return false for expired data")
+	}
+}
+
+func TestHandleRefresh_AcceptsOnlyThePublisherAndBoundsTheTTL(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	publisher := memnetNode(t, network, "10.0.0.2:8000")
+	other := memnetNode(t, network, "10.0.0.3:8000")
+	data := []byte("data1")
+	key := HashData(data)
+	if err := publisher.Network.SendStoreMessageWithTTL(context.Background(), &publisher.RoutingTable.Me, &node.RoutingTable.Me, key, data, time.Minute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := node.getEntry(key.String()); ok {
+			break
+		}
+	}
+
+	otherErr := other.Network.SendRefreshMessage(context.Background(), &other.RoutingTable.Me, &node.RoutingTable.Me, key, tExpire)
+	publisherErr := publisher.Network.SendRefreshMessage(context.Background(), &publisher.RoutingTable.Me, &node.RoutingTable.Me, key, 1000*tExpire)
+
+	if !errors.Is(otherErr, ErrNotFound) {
+		t.Errorf("Expected the REFRESH of another node to fail, got %v", otherErr)
+	}
+	if publisherErr != nil {
+		t.Fatalf("Expected the REFRESH of the publisher to succeed, got %v", publisherErr)
+	}
+	if ttl := node.remainingTTL(key.String()); ttl <= time.Minute || ttl > tExpire {
+		t.Errorf("Expected the TTL to be reset to at most %v, got %v", tExpire, ttl)
+	}
+}
+
+func TestHandleStore_OnlyThePublisherExtendsTheTTL(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	publisher := memnetNode(t, network, "10.0.0.2:8000")
+	other := memnetNode(t, network, "10.0.0.3:8000")
+	data := []byte("data1")
+	key := HashData(data)
+	store := func(sender *Kademlia, ttl time.Duration) {
+		if err := sender.Network.SendStoreMessageWithTTL(context.Background(), &sender.RoutingTable.Me, &node.RoutingTable.Me, key, data, ttl); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	waitForTTL := func(condition func(time.Duration) bool) time.Duration {
+		ttl := node.remainingTTL(key.String())
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !condition(ttl); time.Sleep(10 * time.Millisecond) {
+			ttl = node.remainingTTL(key.String())
+		}
+		return ttl
+	}
+	extended := func(ttl time.Duration) bool { return ttl > time.Minute }
+	store(publisher, time.Minute)
+	waitForTTL(func(ttl time.Duration) bool { return ttl <= time.Minute })
+
+	store(other, tExpire)
+	otherTTL := waitForTTL(extended)
+	store(publisher, 2*time.Minute)
+	publisherTTL := waitForTTL(extended)
+
+	if otherTTL > time.Minute {
+		t.Errorf("Expected the STORE of another node to keep the TTL, got %v", otherTTL)
+	}
+	if publisherTTL <= time.Minute || publisherTTL > 2*time.Minute {
+		t.Errorf("Expected the STORE of the publisher to reset the TTL to 2m, got %v", publisherTTL)
+	}
+}
@@ -1,11 +1,15 @@
 package kademlia
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
-const bucketSize = k
+const bucketSize = DefaultK
 
 // RoutingTable definition
-// keeps a refrence contact of me and an array of buckets
+// keeps a refrence contact of me and an array of buckets,
+// every bucket guards its own contacts so the table is safe for concurrent use
 type RoutingTable struct {
 	Me      Contact
 	buckets [IDLength * 8]*bucket
@@ -13,9 +17,14 @@ type RoutingTable struct {
 
 // NewRoutingTable returns a new instance of a RoutingTable
 func NewRoutingTable(me Contact) *RoutingTable {
+	return NewRoutingTableWithBucketSize(me, bucketSize)
+}
+
+// NewRoutingTableWithBucketSize returns a new instance of a RoutingTable whose buckets hold at most size contacts
+func NewRoutingTableWithBucketSize(me Contact, size int) *RoutingTable {
 	routingTable := &RoutingTable{}
 	for i := 0; i < IDLength*8; i++ {
-		routingTable.buckets[i] = newBucket()
+		routingTable.buckets[i] = newBucketWithSize(size)
 	}
 	routingTable.Me = me
 	return routingTable
@@ -29,13 +38,28 @@ func (routingTable *RoutingTable) AddContact(contact Contact) (bool, *Contact) {
 	return bucketIsFull, lastContact
 }
 
-// RemoveContact removes a contact from the correct Bucket
+// RemoveContact removes a contact from the correct Bucket, a candidate from its replacement cache takes its place
 func (routingTable *RoutingTable) RemoveContact(contact *Contact) {
 	bucketIndex := routingTable.getBucketIndex(contact.ID)
 	bucket := routingTable.buckets[bucketIndex]
 	bucket.RemoveContact(contact)
 }
 
+// MarkFailed counts a failed RPC to a contact, returns true if the contact was evicted from its Bucket
+func (routingTable *RoutingTable) MarkFailed(contact *Contact) bool {
+	bucketIndex := routingTable.getBucketIndex(contact.ID)
+	bucket := routingTable.buckets[bucketIndex]
+	return bucket.MarkFailed(contact)
+}
+
+// BucketReplacements returns a copy of the replacement cache of the Bucket at index
+func (routingTable *RoutingTable) BucketReplacements(index int) []Contact {
+	if index < 0 || index >= IDLength*8 {
+		return nil
+	}
+	return routingTable.buckets[index].Replacements()
+}
+
 // FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
 func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
 	var candidates ContactCandidates
@@ -64,6 +88,52 @@ func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count
 	return candidates.GetContacts(count)
 }
 
+// BucketContacts returns a copy of the Contacts in the Bucket at index
+func (routingTable *RoutingTable) BucketContacts(index int) []Contact {
+	if index < 0 || index >= IDLength*8 {
+		return nil
+	}
+	return routingTable.buckets[index].Contacts()
+}
+
+// AllContacts returns a copy of all Contacts in the RoutingTable, ordered by Bucket index
+func (routingTable *RoutingTable) AllContacts() []Contact {
+	var contacts []Contact
+	for i := 0; i < IDLength*8; i++ {
+		contacts = append(contacts, routingTable.buckets[i].Contacts()...)
+	}
+	return contacts
+}
+
+// TouchBucket marks the Bucket covering the id as recently used
+func (routingTable *RoutingTable) TouchBucket(id *KademliaID) {
+	routingTable.buckets[routingTable.getBucketIndex(id)].Touch()
+}
+
+// StaleBuckets returns the indexes of the Buckets that have not been touched within interval
+func (routingTable *RoutingTable) StaleBuckets(interval time.Duration) []int {
+	var stale []int
+	for i := 0; i < IDLength*8; i++ {
+		if time.Since(routingTable.buckets[i].LastTouched()) >= interval {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// RandomIDInBucket returns a random KademliaID that falls in the range of the Bucket at index
+func (routingTable *RoutingTable) RandomIDInBucket(index int) *KademliaID {
+	distance := NewRandomKademliaID()
+	byteIndex, bitIndex := index/8, uint(index%8)
+	// Clear all bits before the bucket bit, set the bucket bit and keep the rest random
+	for i := 0; i < byteIndex; i++ {
+		distance[i] = 0
+	}
+	mask := byte(0xFF) >> bitIndex
+	distance[byteIndex] = (distance[byteIndex] & mask) | (0x80 >> bitIndex)
+	return routingTable.Me.ID.CalcDistance(distance)
+}
+
 // getBucketIndex get the correct Bucket index for the KademliaID
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 	distance := id.CalcDistance(routingTable.Me.ID)
@@ -81,11 +151,11 @@ func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 // PrintAllIP prints all the IP addresses in the RoutingTable
 func (routingTable *RoutingTable) PrintAllIP() {
 	for i := 0; i < IDLength*8; i++ {
-		bucket := routingTable.buckets[i]
-		if bucket.Len() > 0 {
+		contacts := routingTable.BucketContacts(i)
+		if len(contacts) > 0 {
 			//PRINT IP and ID
-			fmt.Printf("Bucket %d: %v\n", i, bucket)
-			bucket.PrintAllIP()
+			fmt.Printf("Bucket %d: %v\n", i, contacts)
+			routingTable.buckets[i].PrintAllIP()
 		}
 	}
 }
@@ -95,9 +165,9 @@ func (routingTable *RoutingTable) PrintRoutingTable() {
 	fmt.Println("Routing Table:")
 	fmt.Println("Me: ", routingTable.Me)
 	for i := 0; i < IDLength*8; i++ {
-		bucket := routingTable.buckets[i]
-		if bucket.Len() > 0 {
-			fmt.Printf("Bucket %d: %v\n", i, bucket)
+		contacts := routingTable.BucketContacts(i)
+		if len(contacts) > 0 {
+			fmt.Printf("Bucket %d: %v\n", i, contacts)
 		}
 	}
 }
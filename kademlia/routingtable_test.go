@@ -2,8 +2,10 @@ package kademlia
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -227,3 +229,92 @@ func captureOutput(f func()) string {
 	buf.ReadFrom(r)
 	return buf.String()
 }
+
+func TestBucketContactsRT(t *testing.T) {
+	rt := NewRoutingTable(
+		NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000"),
+	)
+	contact := NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000001"), "localhost:8001")
+	rt.AddContact(contact)
+
+	contacts := rt.BucketContacts(rt.getBucketIndex(contact.ID))
+	if len(contacts) != 1 || !contacts[0].ID.Equals(contact.ID) {
+		t.Fatalf("Expected bucket to contain %s, got %v", contact.String(), contacts)
+	}
+	if rt.BucketContacts(-1) != nil || rt.BucketContacts(IDLength*8) != nil {
+		t.Fatalf("Expected nil for out of range bucket index")
+	}
+}
+
+func TestAllContactsRT(t *testing.T) {
+	rt := NewRoutingTable(
+		NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000"),
+	)
+	rt.AddContact(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000001"), "localhost:8001"))
+	rt.AddContact(NewContact(NewKademliaID("1111111100000000000000000000000000000001"), "localhost:8002"))
+
+	contacts := rt.AllContacts()
+	if len(contacts) != 2 {
+		t.Fatalf("Expected 2 contacts, got %d", len(contacts))
+	}
+
+	// Modifying the snapshot must not change the routing table
+	contacts[0].Address = "changed"
+	for _, contact := range rt.AllContacts() {
+		if contact.Address == "changed" {
+			t.Fatalf("Expected snapshot to be a copy of the routing table")
+		}
+	}
+}
+
+// TestConcurrentAccessRT stresses the routing table from many goroutines, run with go test -race
+func TestConcurrentAccessRT(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "localhost:8000"))
+	var wg sync.WaitGroup
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				contact := NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 9000+i))
+				rt.AddContact(contact)
+				rt.FindClosestContacts(contact.ID, DefaultK)
+				if j%3 == 0 {
+					rt.RemoveContact(&contact)
+				}
+				for _, c := range rt.AllContacts() {
+					_ = c.Address
+				}
+				rt.BucketContacts(j % (IDLength * 8))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < IDLength*8; i++ {
+		if len(rt.BucketContacts(i)) > bucketSize {
+			t.Fatalf("Bucket %d holds more than %d contacts", i, bucketSize)
+		}
+	}
+}
+
+func TestMarkFailedRT(t *testing.T) {
+	rt := NewRoutingTable(
+		NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000"),
+	)
+	contact := NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000001"), "localhost:8001")
+	rt.AddContact(contact)
+
+	evicted := false
+	for i := 0; i < maxContactFailures; i++ {
+		evicted = rt.MarkFailed(&contact)
+	}
+
+	if !evicted {
+		t.Fatalf("Expected contact to be evicted after %d failures", maxContactFailures)
+	}
+	if len(rt.FindClosestContacts(contact.ID, 1)) != 0 {
+		t.Fatalf("Expected contact to be removed from the routing table")
+	}
+}
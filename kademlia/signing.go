@@ -0,0 +1,181 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Every message and every reply to a lookup is signed with the Ed25519 key of its sender over its binary
+// encoding without the signature, whatever encoding it is sent in, and carries the public key. A key is bound
+// to the ID it hashes to, see KeyID, so no other host can send messages in the name of that ID. For other IDs
+// a node remembers the first key the ID signed with, until a key bound to the ID replaces it.
+
+// maxCachedKeys bounds the number of sender IDs whose public key is remembered, no key is evicted to make room
+const maxCachedKeys = 10000
+
+// Reasons a message is dropped for, they label the invalid signature counter
+const (
+	signatureMissing     = "missing"
+	signatureInvalid     = "invalid"
+	signatureKeyMismatch = "key_mismatch"
+)
+
+var ErrInvalidSignature = errors.New("invalid message signature")
+
+// NewSigningKey returns a new key to sign the messages of a node with
+func NewSigningKey() ed25519.PrivateKey {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	// crypto/rand only fails if the system has no source of randomness, no key is safe without one
+	if err != nil {
+		panic(fmt.Sprintf("error generating signing key: %v", err))
+	}
+	return privateKey
+}
+
+// KeyID returns the ID the public key is bound to, the SHA-1 of the key
+func KeyID(publicKey ed25519.PublicKey) *KademliaID {
+	id := KademliaID(sha1.Sum(publicKey))
+	return &id
+}
+
+// keyCache remembers the public key every sender ID signed with first
+type keyCache struct {
+	mutex sync.Mutex
+	keys  map[KademliaID]ed25519.PublicKey
+}
+
+// get returns the key remembered for the ID, or nil if there is none
+func (cache *keyCache) get(id *KademliaID) ed25519.PublicKey {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.keys[*id]
+}
+
+// pin remembers the key for the ID if it has none yet, it returns false if the ID is bound to another key.
+// A key bound to the ID replaces a key another host signed with first. Once the cache is full new IDs
+// are not remembered, so a flood of IDs cannot push out the key of a known node
+func (cache *keyCache) pin(id *KademliaID, key ed25519.PublicKey) bool {
+	bound := KeyID(key).Equals(id)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	known, ok := cache.keys[*id]
+	if ok && !bound {
+		return known.Equal(key)
+	}
+	if cache.keys == nil {
+		cache.keys = make(map[KademliaID]ed25519.PublicKey)
+	}
+	if ok || len(cache.keys) < maxCachedKeys {
+		cache.keys[*id] = key
+	}
+	return true
+}
+
+// signingKey returns the key messages are signed with, the key of the Identity if the node has one
+func (network *Network) signingKey() ed25519.PrivateKey {
+	if network.Identity != nil {
+		return network.Identity.PrivateKey
+	}
+	return network.SigningKey
+}
+
+// sign adds the public key and the signature of the node to the message
+func (network *Network) sign(message Message) Message {
+	key := network.signingKey()
+	if key == nil {
+		return message
+	}
+	message.PublicKey = key.Public().(ed25519.PublicKey)
+	message.Signature = ed25519.Sign(key, signedContent(message))
+	return message
+}
+
+// signResponse adds the ID, the public key and the signature of the node to a reply
+func (network *Network) signResponse(response Response, id *KademliaID) Response {
+	key := network.signingKey()
+	if key == nil {
+		return response
+	}
+	response.SenderID = id
+	response.PublicKey = key.Public().(ed25519.PublicKey)
+	response.Signature = ed25519.Sign(key, signedResponseContent(response))
+	return response
+}
+
+// verifySignature checks the signature of a received message against the key it carries,
+// or the remembered key of its sender, and returns the message with the key that signed it
+func (network *Network) verifySignature(message Message) (Message, error) {
+	if message.Signature == nil {
+		if network.RequireSignatures {
+			return message, network.rejectSignature(signatureMissing, "message is not signed")
+		}
+		return message, nil
+	}
+	if message.SenderID == nil {
+		return message, network.rejectSignature(signatureInvalid, "no sender ID")
+	}
+	if message.PublicKey == nil {
+		message.PublicKey = network.keys.get(message.SenderID)
+	}
+	return message, network.verifyKey(message.SenderID, message.PublicKey, signedContent(message), message.Signature)
+}
+
+// verifyResponse checks the signature of a reply and that it comes from the ID the request was sent to,
+// if that ID is known
+func (network *Network) verifyResponse(response Response, receiver *Contact) error {
+	if response.Signature == nil {
+		if network.RequireSignatures {
+			return network.rejectSignature(signatureMissing, "reply is not signed")
+		}
+		return nil
+	}
+	if response.SenderID == nil {
+		return network.rejectSignature(signatureInvalid, "no sender ID")
+	}
+	if receiver.ID != nil && !receiver.ID.Equals(response.SenderID) {
+		return network.rejectSignature(signatureInvalid, "reply from another ID")
+	}
+	publicKey := response.PublicKey
+	if publicKey == nil {
+		publicKey = network.keys.get(response.SenderID)
+	}
+	return network.verifyKey(response.SenderID, publicKey, signedResponseContent(response), response.Signature)
+}
+
+// verifyKey checks a signature over the content and that the ID has not signed with another key before
+func (network *Network) verifyKey(id *KademliaID, publicKey ed25519.PublicKey, content []byte, signature []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return network.rejectSignature(signatureInvalid, "no public key")
+	}
+	if !ed25519.Verify(publicKey, content, signature) {
+		return network.rejectSignature(signatureInvalid, "signature does not match")
+	}
+	if !network.keys.pin(id, publicKey) {
+		return network.rejectSignature(signatureKeyMismatch, "sender ID signed with another key before")
+	}
+	return nil
+}
+
+// rejectSignature counts a message dropped for the reason and returns the error it is dropped with
+func (network *Network) rejectSignature(reason string, detail string) error {
+	network.metrics.invalidSignature(reason)
+	return fmt.Errorf("%w: %s", ErrInvalidSignature, detail)
+}
+
+// signedContent returns the bytes the signature of the message covers
+func signedContent(message Message) []byte {
+	message.Signature = nil
+	content, _ := encodeMessage(EncodingBinary, message)
+	return content
+}
+
+// signedResponseContent returns the bytes the signature of the reply covers
+func signedResponseContent(response Response) []byte {
+	response.Signature = nil
+	content, _ := encodeResponse(EncodingBinary, response)
+	return content
+}
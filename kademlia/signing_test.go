@@ -0,0 +1,176 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"d7024e/memnet"
+)
+
+// signingNetwork returns a network that signs its messages and counts the messages it drops
+func signingNetwork() *Network {
+	network := NewNetwork(nil)
+	network.metrics = newMetrics()
+	return network
+}
+
+func TestVerifySignature_AcceptsSignedMessagesInBothEncodings(t *testing.T) {
+	sender, receiver := signingNetwork(), signingNetwork()
+	for _, encoding := range []Encoding{EncodingBinary, EncodingJSON} {
+		packet, _ := sender.encodeMessage(encoding, testMessage())
+
+		message, err := receiver.decodeMessage(packet)
+
+		if err != nil {
+			t.Errorf("Expected the %v message to verify, got %v", encoding, err)
+		}
+		if !bytes.Equal(message.PublicKey, sender.SigningKey.Public().(ed25519.PublicKey)) {
+			t.Errorf("Expected the key of the sender on the %v message", encoding)
+		}
+	}
+}
+
+func TestVerifySignature_DropsTamperedUnsignedAndImpersonatingMessages(t *testing.T) {
+	sender, impostor, receiver := signingNetwork(), signingNetwork(), signingNetwork()
+	message := testMessage()
+	signed := sender.sign(message)
+	tampered := signed
+	tampered.Data = []byte("other data")
+	impersonating := impostor.sign(message)
+
+	if _, err := receiver.verifySignature(signed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, tamperedErr := receiver.verifySignature(tampered)
+	_, unsignedErr := receiver.verifySignature(message)
+	_, impersonatingErr := receiver.verifySignature(impersonating)
+
+	for name, err := range map[string]error{"tampered": tamperedErr, "unsigned": unsignedErr, "impersonating": impersonatingErr} {
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected the %s message to be dropped, got %v", name, err)
+		}
+	}
+	for _, reason := range []string{signatureInvalid, signatureMissing, signatureKeyMismatch} {
+		if count := receiver.metrics.badSignatures.Value(reason); count != 1 {
+			t.Errorf("Expected one message dropped as %s, got %v", reason, count)
+		}
+	}
+	receiver.RequireSignatures = false
+	if _, err := receiver.verifySignature(message); err != nil {
+		t.Errorf("Expected an unsigned message to be accepted when signatures are not required, got %v", err)
+	}
+}
+
+func TestVerifySignature_UsesTheKnownKeyOfTheSender(t *testing.T) {
+	sender, receiver := signingNetwork(), signingNetwork()
+	first := testMessage()
+	receiver.verifySignature(sender.sign(first))
+	second := testMessage()
+	second.SenderID = first.SenderID
+	withoutKey := sender.sign(second)
+	withoutKey.PublicKey = nil
+
+	verified, err := receiver.verifySignature(withoutKey)
+
+	if err != nil {
+		t.Fatalf("Expected the known key to verify the message, got %v", err)
+	}
+	if verified.PublicKey == nil {
+		t.Error("Expected the known key on the verified message")
+	}
+}
+
+func TestVerifySignature_KeyBoundToTheIDReplacesTheKeyOfAnImpostor(t *testing.T) {
+	owner, impostor, receiver := signingNetwork(), signingNetwork(), signingNetwork()
+	message := testMessage()
+	message.SenderID = KeyID(owner.SigningKey.Public().(ed25519.PublicKey))
+
+	// The impostor signs in the name of the ID before its owner does
+	if _, err := receiver.verifySignature(impostor.sign(message)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, ownerErr := receiver.verifySignature(owner.sign(message))
+	_, impostorErr := receiver.verifySignature(impostor.sign(message))
+
+	if ownerErr != nil {
+		t.Errorf("Expected the key bound to the ID to be accepted, got %v", ownerErr)
+	}
+	if !errors.Is(impostorErr, ErrInvalidSignature) {
+		t.Errorf("Expected the key of the impostor to be dropped once the owner signed, got %v", impostorErr)
+	}
+}
+
+func TestKeyCache_KeepsKnownKeysWhenFull(t *testing.T) {
+	cache := &keyCache{}
+	known, key := NewRandomKademliaID(), signingNetwork().SigningKey.Public().(ed25519.PublicKey)
+	other := signingNetwork().SigningKey.Public().(ed25519.PublicKey)
+	cache.pin(known, key)
+	for len(cache.keys) < maxCachedKeys {
+		cache.pin(NewRandomKademliaID(), other)
+	}
+
+	newID := NewRandomKademliaID()
+	accepted := cache.pin(newID, other)
+
+	if !accepted || cache.get(newID) != nil {
+		t.Errorf("Expected a new ID to be accepted without being remembered, accepted %v", accepted)
+	}
+	if cache.pin(known, other) {
+		t.Error("Expected the known ID to keep its key")
+	}
+}
+
+func TestVerifyResponse_DropsTamperedUnsignedAndForeignReplies(t *testing.T) {
+	responder, receiver := signingNetwork(), signingNetwork()
+	id := NewRandomKademliaID()
+	contact := NewContact(id, "10.0.0.1:8000")
+	signed := responder.signResponse(testResponse(3), id)
+	tampered := signed
+	tampered.ClosestContacts = tampered.ClosestContacts[:1]
+	other := NewContact(NewRandomKademliaID(), "10.0.0.1:8000")
+
+	for _, encoding := range []Encoding{EncodingBinary, EncodingJSON} {
+		packet, _ := encodeResponse(encoding, signed)
+		decoded, err := decodeResponse(packet)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := receiver.verifyResponse(decoded, &contact); err != nil {
+			t.Errorf("Expected the %v reply to verify, got %v", encoding, err)
+		}
+	}
+	tamperedErr := receiver.verifyResponse(tampered, &contact)
+	unsignedErr := receiver.verifyResponse(testResponse(3), &contact)
+	foreignErr := receiver.verifyResponse(signed, &other)
+
+	for name, err := range map[string]error{"tampered": tamperedErr, "unsigned": unsignedErr, "foreign": foreignErr} {
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected the %s reply to be dropped, got %v", name, err)
+		}
+	}
+}
+
+func TestListen_DropsMessagesInTheNameOfAKnownNode(t *testing.T) {
+	network := memnet.New(1)
+	node := memnetNode(t, network, "10.0.0.1:8000")
+	known := memnetNode(t, network, "10.0.0.2:8000")
+	impostor := memnetNode(t, network, "10.0.0.3:8000")
+	node.Start(context.Background())
+	t.Cleanup(func() { node.Stop() })
+	if err := known.Network.SendPingMessage(context.Background(), &known.RoutingTable.Me, &node.RoutingTable.Me); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The impostor claims the ID of the known node but signs with its own key
+	err := impostor.Network.SendPingMessage(context.Background(), &known.RoutingTable.Me, &node.RoutingTable.Me)
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected the PING of the impostor to go unanswered, got %v", err)
+	}
+	if count := node.Metrics.badSignatures.Value(signatureKeyMismatch); count != 1 {
+		t.Errorf("Expected the PING to be counted as signed with another key, got %v", count)
+	}
+}
@@ -0,0 +1,150 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const DefaultStateInterval = time.Minute
+
+// State is what a node saves so it keeps its ID and contacts across restarts
+type State struct {
+	ID       string         `json:"id"`
+	KeySeed  string         `json:"key_seed,omitempty"` // hex encoded seed of the key the node signs with, the key of its Identity if it has one
+	Nonce    string         `json:"nonce,omitempty"`    // hex encoded solution of the dynamic puzzle of the Identity, if the node has one
+	Contacts []StateContact `json:"contacts"`
+	SavedAt  time.Time      `json:"saved_at"`
+}
+
+// StateContact is a contact of the routing table in a State
+type StateContact struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// State returns the ID of the node and the contacts of its routing table
+func (kademlia *Kademlia) State() State {
+	state := State{ID: kademlia.RoutingTable.Me.ID.String(), SavedAt: time.Now()}
+	if key := kademlia.Network.signingKey(); key != nil {
+		state.KeySeed = hex.EncodeToString(key.Seed())
+	}
+	if identity := kademlia.Network.Identity; identity != nil {
+		state.Nonce = identity.Nonce.String()
+	}
+	for _, contact := range kademlia.RoutingTable.AllContacts() {
+		state.Contacts = append(state.Contacts, StateContact{ID: contact.ID.String(), Address: contact.Address})
+	}
+	return state
+}
+
+// SaveState writes the state of the node to the file, replacing it atomically,
+// only the owner may read it as it holds the private key of the node
+func (kademlia *Kademlia) SaveState(path string) error {
+	kademlia.stateMutex.Lock()
+	defer kademlia.stateMutex.Unlock()
+	content, err := json.MarshalIndent(kademlia.State(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, content, 0o600); err != nil {
+		return fmt.Errorf("error saving state: %w", err)
+	}
+	return nil
+}
+
+// LoadState reads a state saved by SaveState, the error wraps os.ErrNotExist if there is none
+func LoadState(path string) (State, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return State{}, fmt.Errorf("error reading state: %w", err)
+	}
+	var state State
+	if err := json.Unmarshal(content, &state); err != nil {
+		return State{}, fmt.Errorf("error parsing state: %w", err)
+	}
+	if _, err := ParseKademliaID(state.ID); err != nil {
+		return State{}, fmt.Errorf("error parsing state: node ID must be %d hex characters", IDLength*2)
+	}
+	return state, nil
+}
+
+// NodeID returns the saved ID of the node
+func (state State) NodeID() *KademliaID {
+	return NewKademliaID(state.ID)
+}
+
+// SigningKey returns the saved key the node signed with, or nil if none was saved,
+// peers drop messages signed with another key for the same ID
+func (state State) SigningKey() (ed25519.PrivateKey, error) {
+	if state.KeySeed == "" {
+		return nil, nil
+	}
+	seed, err := hex.DecodeString(state.KeySeed)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("error parsing state: key seed must be %d hex characters", ed25519.SeedSize*2)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Identity returns the saved Identity, or nil if the node had none
+func (state State) Identity() (*Identity, error) {
+	if state.Nonce == "" {
+		return nil, nil
+	}
+	key, err := state.SigningKey()
+	nonce, nonceErr := ParseKademliaID(state.Nonce)
+	if err != nil || key == nil || nonceErr != nil {
+		return nil, fmt.Errorf("%w: saved key seed or nonce is invalid", ErrInvalidIdentity)
+	}
+	identity, err := NewIdentityFromSeed(key.Seed(), nonce)
+	if err != nil {
+		return nil, err
+	}
+	if !identity.ID().Equals(state.NodeID()) {
+		return nil, fmt.Errorf("%w: saved ID is not derived from the saved key", ErrInvalidIdentity)
+	}
+	return identity, nil
+}
+
+// SavedContacts returns the saved contacts, skipping any with an invalid ID
+func (state State) SavedContacts() []Contact {
+	var contacts []Contact
+	for _, contact := range state.Contacts {
+		if id, err := ParseKademliaID(contact.ID); err == nil && contact.Address != "" {
+			contacts = append(contacts, NewContact(id, contact.Address))
+		}
+	}
+	return contacts
+}
+
+// ListenStateSaver saves the state of the node to the file every interval,
+// and once more when the context is cancelled
+func (kademlia *Kademlia) ListenStateSaver(ctx context.Context, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultStateInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			kademlia.saveStateOrLog(path)
+			return
+		case <-ticker.C:
+			kademlia.saveStateOrLog(path)
+		}
+	}
+}
+
+func (kademlia *Kademlia) saveStateOrLog(path string) {
+	if err := kademlia.SaveState(path); err != nil {
+		kademlia.routingLogger().Error("Error saving state", "path", path, "err", err)
+		return
+	}
+	kademlia.routingLogger().Debug("Saved state", "path", path)
+}
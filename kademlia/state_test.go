@@ -0,0 +1,149 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"d7024e/memnet"
+)
+
+func TestSaveState_RoundTripsIDAndContacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	k := joiningNode()
+	contact := NewContact(NewRandomKademliaID(), "127.0.0.1:2")
+	k.RoutingTable.AddContact(contact)
+
+	if err := k.SaveState(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	state, err := LoadState(path)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !state.NodeID().Equals(k.RoutingTable.Me.ID) {
+		t.Errorf("Expected the node ID %s, got %s", k.RoutingTable.Me.ID.String(), state.ID)
+	}
+	saved := state.SavedContacts()
+	if len(saved) != 1 || !saved[0].ID.Equals(contact.ID) || saved[0].Address != contact.Address {
+		t.Errorf("Expected the contact of the routing table, got %v", saved)
+	}
+}
+
+func TestLoadState_ReportsMissingAndInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadState(filepath.Join(dir, "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist, got %v", err)
+	}
+
+	path := filepath.Join(dir, "state.json")
+	os.WriteFile(path, []byte(`{"id": "not-an-id"}`), 0o644)
+	if _, err := LoadState(path); err == nil {
+		t.Error("Expected an error for an invalid node ID")
+	}
+}
+
+func TestSavedContacts_SkipsInvalidContacts(t *testing.T) {
+	state := State{Contacts: []StateContact{
+		{ID: NewRandomKademliaID().String(), Address: "127.0.0.1:2"},
+		{ID: "short", Address: "127.0.0.1:3"},
+		{ID: NewRandomKademliaID().String()},
+	}}
+
+	if contacts := state.SavedContacts(); len(contacts) != 1 || contacts[0].Address != "127.0.0.1:2" {
+		t.Errorf("Expected only the valid contact, got %v", contacts)
+	}
+}
+
+func TestListenStateSaver_SavesWhenCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	k := joiningNode()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		k.ListenStateSaver(ctx, path, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if _, err := LoadState(path); err != nil {
+		t.Errorf("Expected the state to be saved on shutdown, got %v", err)
+	}
+}
+
+func TestSavedState_RebuildsRoutingTableWithoutBootstrapNode(t *testing.T) {
+	network := memnet.New(10)
+	nodes := memnetNodes(t, network, 6, 10)
+	// The second node learns the later ones from their requests
+	restarting := nodes[1]
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := restarting.SaveState(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The node and the bootstrap node go away, the node comes back on the same address
+	restarting.Network.transport.Close()
+	nodes[0].Network.transport.Close()
+	state, _ := LoadState(path)
+	conn, err := network.Listen(restarting.RoutingTable.Me.Address)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	restarted := NewKademliaWithTransport(NewRoutingTable(NewContact(state.NodeID(), restarting.RoutingTable.Me.Address)), conn)
+	restarted.Network.Timeout = 200 * time.Millisecond
+	// The peers know the node by the key it signed with before the restart
+	restarted.Network.SigningKey, _ = state.SigningKey()
+	go restarted.ListenActionChannel()
+	go restarted.Network.Listen(restarted)
+
+	answered, err := restarted.Join(context.Background(), state.SavedContacts())
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if answered != len(state.SavedContacts())-1 {
+		t.Errorf("Expected every saved contact but the bootstrap node to answer, got %d of %d", answered, len(state.SavedContacts()))
+	}
+	for _, contact := range restarted.RoutingTable.AllContacts() {
+		if contact.ID.Equals(nodes[0].RoutingTable.Me.ID) {
+			t.Error("Expected the stopped bootstrap node not to be added")
+		}
+	}
+	if !restarted.RoutingTable.Me.ID.Equals(restarting.RoutingTable.Me.ID) {
+		t.Errorf("Expected the saved ID %s", restarting.RoutingTable.Me.ID.String())
+	}
+}
+
+func TestSaveState_KeepsIdentityReadableOnlyByOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	identity := testIdentity(t)
+	k := joiningNode()
+	k.RoutingTable = NewRoutingTable(NewContact(identity.ID(), "127.0.0.1:1"))
+	k.Network.Identity = identity
+
+	if err := k.SaveState(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	state, _ := LoadState(path)
+	restored, err := state.Identity()
+
+	if err != nil || restored == nil {
+		t.Fatalf("Expected the saved identity, got %v", err)
+	}
+	if !restored.ID().Equals(identity.ID()) || restored.Nonce != identity.Nonce {
+		t.Error("Expected the same ID and nonce")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the state to be readable only by its owner, got %v", info.Mode().Perm())
+	}
+	state.ID = NewRandomKademliaID().String()
+	if _, err := state.Identity(); !errors.Is(err, ErrInvalidIdentity) {
+		t.Errorf("Expected ErrInvalidIdentity for an ID the key does not derive, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package kademlia
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("key must be a hex encoded KademliaID")
+
+// Entry is a stored value and the time it expires
+type Entry struct {
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+// EntryInfo describes a stored value without its data
+type EntryInfo struct {
+	Key       string
+	Size      int
+	ExpiresAt time.Time
+}
+
+// Store keeps the values a node stores for other nodes, keys are hex encoded KademliaIDs.
+// A Store does not expire values itself, the node checks ExpiresAt and deletes them
+type Store interface {
+	Put(key string, entry Entry) error
+	Get(key string) (Entry, bool, error)
+	Delete(key string) error
+	List() ([]EntryInfo, error)
+	Close() error
+}
+
+// memoryStore is a Store that keeps the values in a map and loses them when the node stops
+type memoryStore struct {
+	mutex   sync.RWMutex
+	entries map[string]Entry
+}
+
+// NewMemoryStore returns an empty Store in memory
+func NewMemoryStore() Store {
+	return &memoryStore{entries: make(map[string]Entry)}
+}
+
+func (store *memoryStore) Put(key string, entry Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.entries[key] = entry
+	return nil
+}
+
+func (store *memoryStore) Get(key string) (Entry, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	entry, ok := store.entries[key]
+	return entry, ok, nil
+}
+
+func (store *memoryStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.entries, key)
+	return nil
+}
+
+func (store *memoryStore) List() ([]EntryInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	infos := make([]EntryInfo, 0, len(store.entries))
+	for key, entry := range store.entries {
+		infos = append(infos, EntryInfo{Key: key, Size: len(entry.Data), ExpiresAt: entry.ExpiresAt})
+	}
+	return infos, nil
+}
+
+func (store *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,328 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const DefaultStreamThreshold = 32 << 10       // packets larger than this are sent over a stream if one is available
+const streamStagingTimeout = 30 * time.Second // how long a staged packet can be fetched
+const streamBlockSize = 64 << 10              // bytes read before the stream deadline is extended
+const maxStreamBytes = 256 << 20              // bytes of staged packets, and of streams being fetched, at the same time, at least four packets
+
+// DefaultStreamRateLimit bounds the streams a node fetches from one IP, a pointer makes the node
+// connect to the host it came from, so pointers with a spoofed source must not turn it into a port scanner
+var DefaultStreamRateLimit = RateLimit{Rate: 5, Burst: 20}
+
+var (
+	ErrStreamNotFound = errors.New("staged packet not found")
+	ErrStreamsBusy    = errors.New("too many bytes fetched over streams at the same time")
+)
+
+// stagedPacket is a packet waiting to be fetched over a stream, a reply is only served once
+type stagedPacket struct {
+	data    []byte
+	expires time.Time
+	once    bool
+}
+
+// streamPointer is sent over UDP in place of a packet that is fetched over a stream,
+// the stream is fetched from the port on the IP the pointer came from so peers cannot point at other hosts
+type streamPointer struct {
+	Token *KademliaID
+	Size  uint64
+	Port  int
+}
+
+// ServeStreams serves staged packets to the nodes that received a pointer to them,
+// the listener should use TCP on the same port number as the UDP socket
+func (network *Network) ServeStreams(listener net.Listener) {
+	network.streamMutex.Lock()
+	if network.closed.Load() {
+		network.streamMutex.Unlock()
+		listener.Close()
+		return
+	}
+	network.streamListener = listener
+	network.streamMutex.Unlock()
+	network.logger().Info("Serving streams", "address", listener.Addr().String())
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if network.closed.Load() {
+				network.logger().Info("Stopped serving streams")
+			} else {
+				network.logger().Error("Stopped serving streams", "err", err)
+			}
+			network.streamMutex.Lock()
+			network.streamListener = nil
+			network.streamMutex.Unlock()
+			return
+		}
+		go network.serveStream(conn)
+	}
+}
+
+// serveStream reads the token of a staged packet and writes back its length and contents,
+// a length of zero means the packet is unknown or has expired
+func (network *Network) serveStream(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(network.rpcTimeout()))
+	header := make([]byte, 2+IDLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		network.logger().Debug("Error reading stream request", "peer", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	if header[0] != wireMagic || header[1] != WireVersion {
+		network.logger().Debug("Dropping stream request", "peer", conn.RemoteAddr().String(), "err", ErrUnsupportedVersion)
+		return
+	}
+	token := KademliaID{}
+	copy(token[:], header[2:])
+	data := network.stagedData(&token)
+
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(data)))
+	if _, err := conn.Write(length[:]); err != nil {
+		network.logger().Debug("Error writing stream", "peer", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	for written := 0; written < len(data); written += streamBlockSize {
+		conn.SetWriteDeadline(time.Now().Add(network.rpcTimeout()))
+		end := min(written+streamBlockSize, len(data))
+		if _, err := conn.Write(data[written:end]); err != nil {
+			network.logger().Debug("Error writing stream", "peer", conn.RemoteAddr().String(), "err", err)
+			return
+		}
+	}
+}
+
+// stagedData returns the staged packet for the token or nil if it is unknown or has expired,
+// a packet that is only served once is removed
+func (network *Network) stagedData(token *KademliaID) []byte {
+	network.streamMutex.Lock()
+	defer network.streamMutex.Unlock()
+	staged, ok := network.outbox[*token]
+	if !ok || time.Now().After(staged.expires) {
+		return nil
+	}
+	if staged.once {
+		network.removeStaged(*token)
+	}
+	return staged.data
+}
+
+// unstage removes the packet a prepared packet points to, if it points to one
+func (network *Network) unstage(prepared []byte) {
+	if !isPointer(prepared) {
+		return
+	}
+	pointer, err := decodePointer(prepared)
+	if err != nil {
+		return
+	}
+	network.streamMutex.Lock()
+	defer network.streamMutex.Unlock()
+	network.removeStaged(*pointer.Token)
+}
+
+// removeStaged removes a staged packet, the stream mutex must be held
+func (network *Network) removeStaged(token KademliaID) {
+	if staged, ok := network.outbox[token]; ok {
+		delete(network.outbox, token)
+		network.outboxBytes -= len(staged.data)
+	}
+}
+
+// maxStreamBytes returns the bytes of packets that may be staged, or fetched, at the same time
+func (network *Network) maxStreamBytes() int {
+	return max(maxStreamBytes, 4*(network.ObjectSizeLimit()+maxDatagramSize))
+}
+
+// prepareReply returns the reply as is, or stages it to be fetched once and returns a pointer to it
+func (network *Network) prepareReply(packet []byte) []byte {
+	return network.stage(packet, true)
+}
+
+// preparePacket returns the packet as is, or stages it and returns a pointer to it
+// if it is above the stream threshold and streams are served, the caller removes it with unstage
+func (network *Network) preparePacket(packet []byte) []byte {
+	return network.stage(packet, false)
+}
+
+// stage returns the packet as is, or stages it and returns a pointer to it if it is above the stream
+// threshold, streams are served and the staged packets stay below maxStreamBytes
+func (network *Network) stage(packet []byte, once bool) []byte {
+	if len(packet) <= network.streamThreshold() {
+		return packet
+	}
+	network.streamMutex.Lock()
+	defer network.streamMutex.Unlock()
+	if network.streamListener == nil {
+		return packet
+	}
+	if network.outbox == nil {
+		network.outbox = make(map[KademliaID]stagedPacket)
+	}
+	now := time.Now()
+	for token, staged := range network.outbox {
+		if now.After(staged.expires) {
+			network.removeStaged(token)
+		}
+	}
+	if network.outboxBytes+len(packet) > network.maxStreamBytes() {
+		network.logger().Warn("Too many packets staged, sending in chunks", "size", len(packet))
+		return packet
+	}
+	_, port, err := net.SplitHostPort(network.streamListener.Addr().String())
+	if err != nil {
+		return packet
+	}
+	pointer := streamPointer{Token: NewRandomKademliaID(), Size: uint64(len(packet))}
+	if pointer.Port, err = strconv.Atoi(port); err != nil {
+		return packet
+	}
+	network.outbox[*pointer.Token] = stagedPacket{data: packet, expires: now.Add(streamStagingTimeout), once: once}
+	network.outboxBytes += len(packet)
+	return encodePointer(pointer)
+}
+
+// streamThreshold returns the size above which packets are sent over a stream
+func (network *Network) streamThreshold() int {
+	if network.StreamThreshold <= 0 {
+		return DefaultStreamThreshold
+	}
+	return network.StreamThreshold
+}
+
+// resolvePacket returns the packet as is, or fetches the packet a stream pointer from the source refers to
+func (network *Network) resolvePacket(packet []byte, source net.Addr) ([]byte, error) {
+	if !isPointer(packet) {
+		return packet, nil
+	}
+	pointer, err := decodePointer(packet)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(source.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: stream pointer from %s", ErrMalformedPacket, source.String())
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(pointer.Port))
+	return network.fetchStream(address, pointer)
+}
+
+// fetchStream fetches a staged packet, every block has to arrive within the RPC timeout
+func (network *Network) fetchStream(address string, pointer streamPointer) ([]byte, error) {
+	maxPacketSize := uint64(network.ObjectSizeLimit() + maxDatagramSize)
+	if pointer.Size > maxPacketSize {
+		return nil, fmt.Errorf("%w: stream of %d bytes", ErrObjectTooLarge, pointer.Size)
+	}
+	// The size is reserved before connecting, so a reply that is served once is not lost
+	if !network.reserveFetch(int(pointer.Size)) {
+		return nil, fmt.Errorf("%w: stream of %d bytes from %s", ErrStreamsBusy, pointer.Size, address)
+	}
+	defer network.releaseFetch(int(pointer.Size))
+	conn, err := network.transport.DialStream(address, network.rpcTimeout())
+	if err != nil {
+		return nil, rpcError("error connecting to stream", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(network.rpcTimeout()))
+
+	request := append([]byte{wireMagic, WireVersion}, pointer.Token[:]...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, rpcError("error requesting stream", err)
+	}
+	var length [8]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, rpcError("error reading stream", err)
+	}
+	size := binary.BigEndian.Uint64(length[:])
+	if size == 0 {
+		return nil, fmt.Errorf("%w: token %s at %s", ErrStreamNotFound, pointer.Token.String(), address)
+	}
+	if size != pointer.Size {
+		return nil, fmt.Errorf("%w: stream of %d bytes, pointer announced %d", ErrMalformedPacket, size, pointer.Size)
+	}
+
+	packet := make([]byte, size)
+	for read := 0; read < len(packet); read += streamBlockSize {
+		conn.SetReadDeadline(time.Now().Add(network.rpcTimeout()))
+		end := min(read+streamBlockSize, len(packet))
+		if _, err := io.ReadFull(conn, packet[read:end]); err != nil {
+			return nil, rpcError("error reading stream", err)
+		}
+	}
+	return packet, nil
+}
+
+// reserveFetch counts the bytes of a stream that is about to be fetched,
+// it returns false if that takes the streams being fetched over maxStreamBytes
+func (network *Network) reserveFetch(size int) bool {
+	network.streamMutex.Lock()
+	defer network.streamMutex.Unlock()
+	if network.fetchingBytes+size > network.maxStreamBytes() {
+		return false
+	}
+	network.fetchingBytes += size
+	return true
+}
+
+// releaseFetch returns the bytes of a fetched stream
+func (network *Network) releaseFetch(size int) {
+	network.streamMutex.Lock()
+	defer network.streamMutex.Unlock()
+	network.fetchingBytes -= size
+}
+
+// allowStream takes a token from the stream bucket of the IP a pointer came from,
+// it returns false if the node fetched too many streams from the IP
+func (network *Network) allowStream(source net.Addr) bool {
+	if network.StreamRateLimit.Rate <= 0 || network.StreamRateLimit.Burst <= 0 {
+		return true
+	}
+	return network.limiter.allow(network.StreamRateLimit, time.Now(), "STREAM ip "+sourceHost(source.String()))
+}
+
+// isPointer returns true if the packet is a pointer to a staged packet
+func isPointer(packet []byte) bool {
+	return len(packet) >= 3 && packet[0] == wireMagic && packet[2] == kindStreamPointer
+}
+
+// encodePointer encodes a stream pointer as a binary packet
+func encodePointer(pointer streamPointer) []byte {
+	writer := newPacketWriter(kindStreamPointer)
+	writer.id(pointer.Token)
+	writer.uvarint(pointer.Size)
+	writer.uvarint(uint64(pointer.Port))
+	return writer.buf
+}
+
+// decodePointer decodes a stream pointer
+func decodePointer(packet []byte) (streamPointer, error) {
+	if _, err := packetEncoding(packet); err != nil {
+		return streamPointer{}, err
+	}
+	reader, err := newPacketReader(packet, kindStreamPointer)
+	if err != nil {
+		return streamPointer{}, err
+	}
+	pointer := streamPointer{
+		Token: reader.id(),
+		Size:  reader.uvarint(),
+	}
+	port := reader.uvarint()
+	if reader.err == nil && (pointer.Token == nil || port == 0 || port > 65535) {
+		return streamPointer{}, fmt.Errorf("%w: invalid stream pointer", ErrMalformedPacket)
+	}
+	pointer.Port = int(port)
+	return pointer, reader.err
+}
@@ -0,0 +1,236 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveLoopbackStreams serves the streams of the network on a loopback TCP listener
+func serveLoopbackStreams(t *testing.T, network *Network, address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go network.ServeStreams(listener)
+	// Wait until the listener is registered
+	deadline := time.Now().Add(time.Second)
+	for {
+		network.streamMutex.Lock()
+		ready := network.streamListener != nil
+		network.streamMutex.Unlock()
+		if ready || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// outboxSize returns the number of packets staged for streaming
+func outboxSize(network *Network) int {
+	network.streamMutex.Lock()
+	defer network.streamMutex.Unlock()
+	return len(network.outbox)
+}
+
+func TestPreparePacket_KeepsPacketWithoutStreamListener(t *testing.T) {
+	network := NewNetwork(nil)
+	packet := make([]byte, 2*DefaultStreamThreshold)
+
+	if prepared := network.preparePacket(packet); !bytes.Equal(prepared, packet) {
+		t.Error("Expected the packet to be sent as is")
+	}
+}
+
+func TestPreparePacket_StagesLargePacket(t *testing.T) {
+	network := NewNetwork(nil)
+	serveLoopbackStreams(t, network, "127.0.0.1:0")
+	packet := make([]byte, 2*DefaultStreamThreshold)
+	rand.Read(packet)
+
+	prepared := network.preparePacket(packet)
+
+	pointer, err := decodePointer(prepared)
+	if err != nil {
+		t.Fatalf("Expected a stream pointer, got %v", err)
+	}
+	if pointer.Size != uint64(len(packet)) || !bytes.Equal(network.stagedData(pointer.Token), packet) {
+		t.Error("Expected the pointer to refer to the staged packet")
+	}
+	if small := []byte("small"); !bytes.Equal(network.preparePacket(small), small) {
+		t.Error("Expected packets below the threshold to be sent as is")
+	}
+}
+
+func TestPrepareReply_ServesTheReplyOnce(t *testing.T) {
+	network := NewNetwork(nil)
+	serveLoopbackStreams(t, network, "127.0.0.1:0")
+	packet := make([]byte, 2*DefaultStreamThreshold)
+	rand.Read(packet)
+	pointer, err := decodePointer(network.prepareReply(packet))
+	if err != nil {
+		t.Fatalf("Expected a stream pointer, got %v", err)
+	}
+
+	first, second := network.stagedData(pointer.Token), network.stagedData(pointer.Token)
+
+	if !bytes.Equal(first, packet) || second != nil {
+		t.Error("Expected the reply to be served once")
+	}
+	if network.outboxBytes != 0 {
+		t.Errorf("Expected no staged bytes, got %d", network.outboxBytes)
+	}
+}
+
+func TestPreparePacket_KeepsPacketWhenTheOutboxIsFull(t *testing.T) {
+	network := NewNetwork(nil)
+	serveLoopbackStreams(t, network, "127.0.0.1:0")
+	packet := make([]byte, 2*DefaultStreamThreshold)
+	network.outboxBytes = network.maxStreamBytes() - len(packet) + 1
+
+	if prepared := network.prepareReply(packet); !bytes.Equal(prepared, packet) {
+		t.Error("Expected the packet to be sent as is")
+	}
+}
+
+func TestFetchStream_RejectsStreamsOverTheBudget(t *testing.T) {
+	network := NewNetwork(nil)
+	serveLoopbackStreams(t, network, "127.0.0.1:0")
+	pointer, _ := decodePointer(network.prepareReply(make([]byte, 2*DefaultStreamThreshold)))
+	fetcher := NewNetwork(nil)
+	fetcher.fetchingBytes = fetcher.maxStreamBytes() - int(pointer.Size) + 1
+
+	_, err := fetcher.fetchStream(network.streamListener.Addr().String(), pointer)
+
+	if !errors.Is(err, ErrStreamsBusy) {
+		t.Fatalf("Expected ErrStreamsBusy, got %v", err)
+	}
+	fetcher.fetchingBytes = 0
+	if _, err := fetcher.fetchStream(network.streamListener.Addr().String(), pointer); err != nil {
+		t.Errorf("Expected the reply to be kept for a fetch within the budget, got %v", err)
+	}
+	if fetcher.fetchingBytes != 0 {
+		t.Errorf("Expected the fetched bytes to be released, got %d", fetcher.fetchingBytes)
+	}
+}
+
+func TestFetchStream_ReturnsErrorForUnknownToken(t *testing.T) {
+	network := NewNetwork(nil)
+	serveLoopbackStreams(t, network, "127.0.0.1:0")
+	address := network.streamListener.Addr().String()
+
+	_, err := network.fetchStream(address, streamPointer{Token: NewRandomKademliaID(), Size: 1})
+
+	if !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("Expected ErrStreamNotFound, got %v", err)
+	}
+}
+
+func TestSendStoreMessage_MovesLargeValuesOverStreams(t *testing.T) {
+	peer := listeningNode(t, nil)
+	serveLoopbackStreams(t, peer.Network, peer.RoutingTable.Me.Address)
+	network := NewNetwork(nil)
+	serveLoopbackStreams(t, network, "127.0.0.1:0")
+	me := NewContact(NewRandomKademliaID(), "127.0.0.1:1")
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	dataID := HashData(data)
+
+	if err := network.SendStoreMessage(context.Background(), &me, &peer.RoutingTable.Me, dataID, data); err != nil {
+		t.Fatalf("Expected STORE_OK, got %v", err)
+	}
+	if outboxSize(network) != 0 {
+		t.Error("Expected the staged STORE to be removed once it was answered")
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, ok := peer.getData(dataID.String()); !ok; _, ok = peer.getData(dataID.String()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the peer to store the value")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, found, err := network.SendFindDataMessage(context.Background(), &me, &peer.RoutingTable.Me, dataID.String())
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(found, data) {
+		t.Errorf("Expected the %d byte value, got %d bytes", len(data), len(found))
+	}
+	if outboxSize(peer.Network) != 0 {
+		t.Error("Expected the staged FIND_DATA reply to be removed once it was fetched")
+	}
+}
+
+func TestPreparePacket_KeepsPacketForListenerWithoutPort(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "streams"))
+	if err != nil {
+		t.Skipf("No unix sockets: %v", err)
+	}
+	network := NewNetwork(nil)
+	go network.ServeStreams(listener)
+	t.Cleanup(func() { network.Close() })
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		network.streamMutex.Lock()
+		ready := network.streamListener != nil
+		network.streamMutex.Unlock()
+		if ready {
+			break
+		}
+	}
+	packet := make([]byte, 2*DefaultStreamThreshold)
+
+	if prepared := network.preparePacket(packet); !bytes.Equal(prepared, packet) {
+		t.Error("Expected the packet to be sent as is")
+	}
+}
+
+func TestListen_FetchesStreamsFromAnIPOnlyWithinItsBudget(t *testing.T) {
+	peer := listeningNode(t, func(k *Kademlia) {
+		k.Network.StreamRateLimit = RateLimit{Rate: 0.001, Burst: 1}
+	})
+	// Count the connections the peer opens to the host the pointers come from
+	streams, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { streams.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := streams.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { sender.Close() })
+	peerAddr, _ := net.ResolveUDPAddr("udp", peer.RoutingTable.Me.Address)
+
+	for i := 0; i < 3; i++ {
+		pointer := streamPointer{Token: NewRandomKademliaID(), Size: 100, Port: streams.Addr().(*net.TCPAddr).Port}
+		sender.WriteTo(encodePointer(pointer), peerAddr)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if count := accepted.Load(); count != 1 {
+		t.Errorf("Expected one stream to be fetched, got %d", count)
+	}
+	if count := peer.Metrics.rejectedRPCs.Value("STREAM", rejectedRateLimit); count != 2 {
+		t.Errorf("Expected two pointers over the limit, got %v", count)
+	}
+}
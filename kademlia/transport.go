@@ -0,0 +1,73 @@
+package kademlia
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transport carries the datagrams of a Network, it lets nodes run over UDP or an in-memory network
+type Transport interface {
+	// ReadFrom reads the next datagram sent to the node
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
+	// WriteTo sends a datagram from the node to the address
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+	// Dial opens a socket for one RPC that only exchanges datagrams with the address
+	Dial(address string) (net.Conn, error)
+	// DialStream opens a stream to the address to fetch a staged packet from
+	DialStream(address string, timeout time.Duration) (net.Conn, error)
+	// LocalAddr returns the address the node receives datagrams on
+	LocalAddr() net.Addr
+	// Close stops the node from receiving datagrams
+	Close() error
+}
+
+// udpTransport is a Transport over UDP sockets
+type udpTransport struct {
+	conn net.PacketConn
+}
+
+// NewUDPTransport returns a Transport that receives on conn and dials a new UDP socket for every RPC,
+// conn may be nil for a node that only sends RPCs
+func NewUDPTransport(conn net.PacketConn) Transport {
+	if conn != nil {
+		setSocketBuffers(conn)
+	}
+	return &udpTransport{conn: conn}
+}
+
+func (transport *udpTransport) ReadFrom(p []byte) (int, net.Addr, error) {
+	return transport.conn.ReadFrom(p)
+}
+
+func (transport *udpTransport) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return transport.conn.WriteTo(p, addr)
+}
+
+func (transport *udpTransport) Dial(address string) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving UDP address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing UDP: %w", err)
+	}
+	setSocketBuffers(conn)
+	return conn, nil
+}
+
+func (transport *udpTransport) DialStream(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func (transport *udpTransport) LocalAddr() net.Addr {
+	return transport.conn.LocalAddr()
+}
+
+func (transport *udpTransport) Close() error {
+	if transport.conn == nil {
+		return nil
+	}
+	return transport.conn.Close()
+}
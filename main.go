@@ -1,107 +1,389 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"d7024e/api"
 	"d7024e/cli"
+	"d7024e/config"
 	"d7024e/kademlia"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
-	fmt.Println("Starting the kademlia app...")
-	ipf, err := GetOutboundIP()
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
 	if err != nil {
-		fmt.Println("Error getting IP: ", err)
-		return
+		fmt.Fprintln(os.Stderr, "Error loading configuration:", err)
+		os.Exit(2)
+	}
+	// Logs go to stderr so they do not mix with the output of the CLI
+	slog.SetDefault(NewLogger(cfg, os.Stderr))
+	slog.Info("Starting the kademlia app")
+	address, err := AdvertiseAddress(cfg)
+	if err != nil {
+		slog.Error("Error getting IP", "err", err)
+		os.Exit(1)
 	}
-	ip := ipf.String()
-	if ip == "172.20.0.6" {
-		StartBootstrapNode(ip)
+	// docker stop sends SIGTERM, the node then stops the same way as on EXIT
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	var k *kademlia.Kademlia
+	if IsBootstrapNode(cfg, address) {
+		k, err = StartBootstrapNode(ctx, cfg, address)
 	} else {
-		StartNode(ip)
+		k, err = StartNode(ctx, cfg, address)
+	}
+	if err != nil {
+		slog.Error("Error joining network", "err", err)
+		os.Exit(1)
 	}
 
-	// Keep the main function running to prevent container exit
-	select {}
+	exited := make(chan struct{})
+	go func() {
+		// The CLI returns false when stdin is closed, the node then runs until it gets a signal
+		if cli.NewCLI(k).UserInputHandler() {
+			close(exited)
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		slog.Info("Received a signal, stopping the node")
+	case <-exited:
+	}
+	if err := k.Stop(); err != nil {
+		slog.Error("Error stopping the node", "err", err)
+		os.Exit(1)
+	}
 }
 
-func StartBootstrapNode(ip string) {
-	k, err := JoinNetworkBootstrap(ip, "8000")
+// StartBootstrapNode starts a bootstrap node, it joins through the other bootstrap nodes in the background
+func StartBootstrapNode(ctx context.Context, cfg config.Config, address string) (*kademlia.Kademlia, error) {
+	k, err := JoinNetworkBootstrap(cfg, address)
 	if err != nil {
-		fmt.Println("Error joining network: ", err)
-		return
+		return nil, err
+	}
+	if err := k.Start(ctx); err != nil {
+		return nil, err
+	}
+	serveHTTP(k, cfg)
+	// Other bootstrap nodes may already be running, join through them if they answer
+	seeds := BootstrapContacts(cfg, address)
+	go func() {
+		if err := JoinSavedContactsOrSeeds(ctx, k, cfg, seeds); err != nil {
+			slog.Warn("No other bootstrap node answered", "err", err)
+		}
+		k.ListenRejoin(ctx, seeds)
+	}()
+	return k, nil
+}
+
+// StartNode starts a node and joins the network through the saved contacts or the bootstrap nodes
+func StartNode(ctx context.Context, cfg config.Config, address string) (*kademlia.Kademlia, error) {
+	k, err := JoinNetwork(cfg, address)
+	if err != nil {
+		return nil, err
+	}
+	seeds := BootstrapContacts(cfg, address)
+	if cfg.AdvertiseAddress == "" {
+		DiscoverAddress(ctx, k, seeds)
 	}
-	go k.ListenActionChannel()
+	if err := k.Start(ctx); err != nil {
+		return nil, err
+	}
+	serveHTTP(k, cfg)
 	//wait for the network to be ready
 	time.Sleep(1 * time.Second)
-	go k.Network.Listen(k)
-	c := cli.NewCLI(k)
-	go c.UserInputHandler()
+	if err := JoinSavedContactsOrSeeds(ctx, k, cfg, seeds); err != nil {
+		slog.Warn("Error joining network, retrying in the background", "err", err)
+	}
+	go k.ListenRejoin(ctx, seeds)
+	return k, nil
 }
 
-func StartNode(ip string) {
-
-	k, err := JoinNetwork(ip, "8000")
+// DiscoverAddress advertises the address the seeds see the node at instead of the one guessed from
+// its interfaces, the guess is kept if no seed answers
+func DiscoverAddress(ctx context.Context, k *kademlia.Kademlia, seeds []kademlia.Contact) {
+	address, err := k.DiscoverAddress(ctx, seeds)
 	if err != nil {
-		fmt.Println("Error joining network: ", err)
+		slog.Warn("Error discovering the public address, advertising the local one", "address", k.RoutingTable.Me.Address, "err", err)
 		return
 	}
-	go k.ListenActionChannel()
-	go k.Network.Listen(k)
-	time.Sleep(1 * time.Second)
-	DoLookUpOnSelf(k)
-	c := cli.NewCLI(k)
-	if c.UserInputHandler() {
-		os.Exit(0)
+	if address != k.RoutingTable.Me.Address {
+		slog.Info("Advertising the address seen by the bootstrap contacts", "address", address, "local", k.RoutingTable.Me.Address)
+		k.RoutingTable.Me.Address = address
+	}
+}
+
+// JoinNetwork creates a node with the configured ID, the saved ID or the ID its signing key is bound to,
+// or with the ID of its Identity if secure IDs are configured, the routing table is filled by Kademlia.Join
+// once the node listens
+func JoinNetwork(cfg config.Config, address string) (*kademlia.Kademlia, error) {
+	if cfg.SecureID {
+		return newSecureNode(cfg, address)
+	}
+	key := NodeSigningKey(cfg)
+	id := kademlia.KeyID(key.Public().(ed25519.PublicKey))
+	if state, ok := SavedState(cfg); ok {
+		id = state.NodeID()
+	}
+	if cfg.NodeID != "" {
+		id = kademlia.NewKademliaID(cfg.NodeID)
+	}
+	return newNode(cfg, id, key, address)
+}
+
+// BootstrapContacts returns the configured bootstrap contacts except the node itself,
+// contacts without a configured ID get theirs from the PONG when they are pinged
+func BootstrapContacts(cfg config.Config, address string) []kademlia.Contact {
+	var seeds []kademlia.Contact
+	for _, seed := range cfg.Bootstrap {
+		if seed.Address == address {
+			continue
+		}
+		var id *kademlia.KademliaID
+		if seed.ID != "" {
+			id = kademlia.NewKademliaID(seed.ID)
+		}
+		seeds = append(seeds, kademlia.NewContact(id, seed.Address))
 	}
+	return seeds
 }
 
-func JoinNetwork(ip string, port string) (*kademlia.Kademlia, error) {
-	id := kademlia.NewRandomKademliaID()
-	contact := kademlia.NewContact(id, ip+":"+port)
+// newNode listens on the configured address and creates a Kademlia instance with the configured parameters
+// that signs its messages with the key
+func newNode(cfg config.Config, id *kademlia.KademliaID, key ed25519.PrivateKey, address string) (*kademlia.Kademlia, error) {
+	contact := kademlia.NewContact(id, address)
 	contact.CalcDistance(id)
-	routingTable := kademlia.NewRoutingTable(contact)
-	bootStrapContact := kademlia.NewContact(kademlia.NewKademliaID("FFFFFFFFF0000000000000000000000000000000)"), "172.20.0.6:8000")
-	routingTable.AddContact(bootStrapContact)
+	routingTable := kademlia.NewRoutingTableWithBucketSize(contact, cfg.K)
 
-	conn, err := net.ListenPacket("udp", ":"+port)
+	conn, err := net.ListenPacket("udp", cfg.ListenAddress)
 	if err != nil {
 		return nil, err
 	}
 
-	return kademlia.NewKademlia(routingTable, conn), nil
+	k := kademlia.NewKademlia(routingTable, conn)
+	if cfg.DataDir != "" {
+		store, err := kademlia.OpenDiskStore(cfg.DataDir)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		k.Storage = store
+	}
+	// Large packets are served over TCP on the same port, without it they are sent over UDP in chunks
+	if listener, err := net.Listen("tcp", cfg.ListenAddress); err != nil {
+		slog.Warn("Error listening for streams, large values are sent in chunks", "err", err)
+	} else {
+		k.StreamListener = listener
+	}
+	k.K = cfg.K
+	k.Alpha = cfg.Alpha
+	k.RefreshInterval = cfg.RefreshInterval
+	k.Network.Timeout = cfg.RPCTimeout
+	k.Network.Retries = cfg.RPCRetries
+	k.Network.Encoding = cfg.Encoding
+	k.Network.MaxObjectSize = cfg.MaxObjectSize
+	k.Network.StreamThreshold = cfg.StreamThreshold
+	k.StateFile = cfg.StateFile
+	k.StateInterval = cfg.StateInterval
+	k.HandoffOnStop = cfg.Handoff
+	k.Network.RequireSignatures = cfg.RequireSignatures
+	k.Network.RateLimits = kademlia.RateLimits(kademlia.RateLimit{Rate: float64(cfg.RateLimit), Burst: cfg.RateBurst})
+	if cfg.RateLimit == 0 {
+		k.Network.StreamRateLimit = kademlia.RateLimit{}
+	}
+	k.StoreQuota = cfg.StoreQuota
+	k.StorageLimit = cfg.StorageLimit
+	k.Network.SigningKey = key
+	// Peers drop messages signed with another key than the one they know an ID by, unless the ID is bound to the key
+	if !kademlia.KeyID(key.Public().(ed25519.PublicKey)).Equals(id) && cfg.StateFile == "" {
+		slog.Warn("The node ID is not bound to the signing key and the key is not saved, peers that know the node drop its messages after a restart", "id", id.String())
+	}
+	if cfg.SecureID {
+		puzzle := cfg.Puzzle
+		k.Network.Puzzle = &puzzle
+	}
+	return k, nil
 }
-func GetOutboundIP() (net.IP, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+
+// newSecureNode creates a node whose ID is derived from its Identity, the saved one or a new one
+func newSecureNode(cfg config.Config, address string) (*kademlia.Kademlia, error) {
+	identity, err := NodeIdentity(cfg)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP, nil
+	k, err := newNode(cfg, identity.ID(), identity.PrivateKey, address)
+	if err != nil {
+		return nil, err
+	}
+	k.Network.Identity = identity
+	return k, nil
+}
+
+// NodeIdentity returns the Identity saved by an earlier run if it solves the configured puzzles,
+// otherwise it generates a new one
+func NodeIdentity(cfg config.Config) (*kademlia.Identity, error) {
+	if state, ok := SavedState(cfg); ok {
+		identity, err := state.Identity()
+		if err == nil && identity != nil {
+			err = kademlia.VerifyIdentity(identity.ID(), identity.PublicKey, identity.Nonce[:], cfg.Puzzle)
+			if err == nil {
+				return identity, nil
+			}
+		}
+		if err != nil {
+			slog.Warn("Ignoring the saved identity", "path", cfg.StateFile, "err", err)
+		}
+	}
+	slog.Info("Generating a node identity", "static_bits", cfg.Puzzle.Static, "dynamic_bits", cfg.Puzzle.Dynamic)
+	return kademlia.NewIdentity(cfg.Puzzle)
 }
 
-func DoLookUpOnSelf(k *kademlia.Kademlia) {
-	fmt.Println("Doing lookup on self")
-	if k.RoutingTable == nil {
-		fmt.Println("RoutingTable is nil, aborting lookup")
+// NodeSigningKey returns the signing key saved by an earlier run, otherwise it generates a new one
+func NodeSigningKey(cfg config.Config) ed25519.PrivateKey {
+	if state, ok := SavedState(cfg); ok {
+		key, err := state.SigningKey()
+		if err != nil {
+			slog.Warn("Ignoring the saved signing key", "path", cfg.StateFile, "err", err)
+		} else if key != nil {
+			return key
+		}
+	}
+	return kademlia.NewSigningKey()
+}
+
+// SavedState returns the state saved by an earlier run of the node, if there is one
+func SavedState(cfg config.Config) (kademlia.State, bool) {
+	if cfg.StateFile == "" {
+		return kademlia.State{}, false
+	}
+	state, err := kademlia.LoadState(cfg.StateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Ignoring the saved state", "path", cfg.StateFile, "err", err)
+		}
+		return kademlia.State{}, false
+	}
+	return state, true
+}
+
+// JoinSavedContactsOrSeeds rebuilds the routing table by pinging the contacts saved by an earlier run,
+// and joins through the seeds only if none of them answer
+func JoinSavedContactsOrSeeds(ctx context.Context, k *kademlia.Kademlia, cfg config.Config, seeds []kademlia.Contact) error {
+	if state, ok := SavedState(cfg); ok && len(state.SavedContacts()) > 0 {
+		answered, err := k.Join(ctx, state.SavedContacts())
+		if err == nil {
+			slog.Info("Rebuilt the routing table from saved contacts", "answered", answered, "saved", len(state.SavedContacts()))
+			return nil
+		}
+		slog.Warn("No saved contact answered, joining through the bootstrap contacts", "err", err)
+	}
+	_, err := k.Join(ctx, seeds)
+	return err
+}
+
+// serveHTTP serves the HTTP API on the configured address unless it is disabled
+func serveHTTP(k *kademlia.Kademlia, cfg config.Config) {
+	if cfg.HTTPAddress == "" {
 		return
 	}
-	_, _, _ = k.NodeLookup(&k.RoutingTable.Me, "")
+	server := api.NewServer(k)
+	// Stop shuts the API down first, so the requests it serves finish while the node still runs
+	k.BeforeStop = server.Shutdown
+	go func() {
+		if err := server.ListenAndServe(cfg.HTTPAddress); err != nil {
+			slog.Error("Error serving the HTTP API", "err", err)
+		}
+	}()
+}
+
+// NewLogger returns a logger writing records of the configured level and format to w
+func NewLogger(cfg config.Config, w io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: cfg.LogLevel}
+	if cfg.LogFormat == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
 }
 
-func JoinNetworkBootstrap(ip string, port string) (*kademlia.Kademlia, error) {
-	bootStrapContact := kademlia.NewContact(kademlia.NewKademliaID("FFFFFFFFF0000000000000000000000000000000)"), ip+":"+port)
-	bootStrapContact.CalcDistance(bootStrapContact.ID)
-	routingTable := kademlia.NewRoutingTable(bootStrapContact)
-	conn, err := net.ListenPacket("udp", ":"+port)
+// AdvertiseAddress returns the configured advertised address,
+// or the local IP together with the listen port if none is configured
+func AdvertiseAddress(cfg config.Config) (string, error) {
+	if cfg.AdvertiseAddress != "" {
+		return cfg.AdvertiseAddress, nil
+	}
+	host, port, err := net.SplitHostPort(cfg.ListenAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address: %w", err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		ip, err := GetOutboundIP()
+		if err != nil {
+			return "", err
+		}
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// IsBootstrapNode returns true if the node is one of the configured bootstrap contacts
+func IsBootstrapNode(cfg config.Config, address string) bool {
+	for _, seed := range cfg.Bootstrap {
+		if seed.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOutboundIP returns the IP used for outbound traffic, falling back to the first
+// non-loopback interface address and then to loopback on machines without a default route
+func GetOutboundIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err == nil {
+		defer conn.Close()
+		localAddr := conn.LocalAddr().(*net.UDPAddr)
+		return localAddr.IP, nil
+	}
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return nil, err
 	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+	}
+	return net.IPv4(127, 0, 0, 1), nil
+}
 
-	return kademlia.NewKademlia(routingTable, conn), nil
+// JoinNetworkBootstrap creates a bootstrap node, its ID is the configured one,
+// the ID of the bootstrap contact with the node's own address, the saved one or the ID its
+// signing key is bound to, with secure IDs it is the ID of its Identity like for any other node
+func JoinNetworkBootstrap(cfg config.Config, address string) (*kademlia.Kademlia, error) {
+	if cfg.SecureID {
+		return newSecureNode(cfg, address)
+	}
+	key := NodeSigningKey(cfg)
+	id := kademlia.KeyID(key.Public().(ed25519.PublicKey))
+	if state, ok := SavedState(cfg); ok {
+		id = state.NodeID()
+	}
+	for _, seed := range cfg.Bootstrap {
+		if seed.Address == address && seed.ID != "" {
+			id = kademlia.NewKademliaID(seed.ID)
+		}
+	}
+	if cfg.NodeID != "" {
+		id = kademlia.NewKademliaID(cfg.NodeID)
+	}
+	return newNode(cfg, id, key, address)
 }
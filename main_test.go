@@ -1,45 +1,73 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"d7024e/config"
 	"d7024e/kademlia"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// testConfig returns the default configuration listening on a free loopback port
+func testConfig() config.Config {
+	cfg := config.Default()
+	cfg.ListenAddress = "127.0.0.1:0"
+	cfg.HTTPAddress = ""
+	return cfg
+}
+
+// join creates a node with the join function and stops it when the test ends
+func join(t *testing.T, joinFn func(config.Config, string) (*kademlia.Kademlia, error), cfg config.Config, address string) (*kademlia.Kademlia, error) {
+	t.Helper()
+	k, err := joinFn(cfg, address)
+	if err == nil {
+		t.Cleanup(func() { k.Stop() })
+	}
+	return k, err
+}
+
 func TestJoinNetwork_ReturnsNonNilKademliaInstance(t *testing.T) {
-	k, _ := JoinNetwork("172.20.0.1", "8000")
+	k, _ := join(t, JoinNetwork, testConfig(), "172.20.0.1:8000")
 	if k == nil {
 		t.Fatal("Expected non-nil Kademlia instance")
 	}
 }
 
 func TestJoinNetwork_InitializesRoutingTable(t *testing.T) {
-	k, _ := JoinNetwork("172.20.0.1", "8001")
+	k, _ := join(t, JoinNetwork, testConfig(), "172.20.0.1:8001")
 	if k.RoutingTable == nil {
 		t.Fatal("Expected non-nil RoutingTable")
 	}
 }
 
 func TestJoinNetwork_InitializesNetwork(t *testing.T) {
-	k, _ := JoinNetwork("172.20.0.1", "8002")
+	k, _ := join(t, JoinNetwork, testConfig(), "172.20.0.1:8002")
 	if k.Network == nil {
 		t.Fatal("Expected non-nil Network")
 	}
 }
 
 func TestJoinNetwork_HandlesPortInUse(t *testing.T) {
-	_, err := JoinNetwork("172.20.0.1", "8003")
+	first, err := join(t, JoinNetwork, testConfig(), "172.20.0.1:8003")
 	if err != nil {
 		t.Fatal("Expected no error on first call to JoinNetwork")
 	}
 
-	_, err = JoinNetwork("172.20.0.1", "8003")
+	cfg := testConfig()
+	cfg.ListenAddress = first.Network.LocalAddr().String()
+	_, err = join(t, JoinNetwork, cfg, "172.20.0.1:8003")
 	if err == nil {
 		t.Fatal("Expected error due to port in use")
 	}
 }
 
 func TestJoinNetworkBootstrap_ReturnsNonNilKademliaInstance(t *testing.T) {
-	k, err := JoinNetworkBootstrap("172.20.0.1", "8004")
+	k, err := join(t, JoinNetworkBootstrap, testConfig(), "172.20.0.1:8004")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -49,7 +77,7 @@ func TestJoinNetworkBootstrap_ReturnsNonNilKademliaInstance(t *testing.T) {
 }
 
 func TestJoinNetworkBootstrap_InitializesRoutingTable(t *testing.T) {
-	k, err := JoinNetworkBootstrap("172.20.0.1", "8005")
+	k, err := join(t, JoinNetworkBootstrap, testConfig(), "172.20.0.1:8005")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -57,12 +85,8 @@ func TestJoinNetworkBootstrap_InitializesRoutingTable(t *testing.T) {
 		t.Fatal("Expected non-nil RoutingTable")
 	}
 }
-func TestDoLookUpOnSelf_AbortsOnNilRoutingTable(t *testing.T) {
-	k := &kademlia.Kademlia{RoutingTable: nil}
-	DoLookUpOnSelf(k)
-}
 func TestJoinNetworkBootstrap_InitializesNetwork(t *testing.T) {
-	k, err := JoinNetworkBootstrap("172.20.0.1", "8006")
+	k, err := join(t, JoinNetworkBootstrap, testConfig(), "172.20.0.1:8006")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -72,12 +96,14 @@ func TestJoinNetworkBootstrap_InitializesNetwork(t *testing.T) {
 }
 
 func TestJoinNetworkBootstrap_HandlesPortInUse(t *testing.T) {
-	_, err := JoinNetworkBootstrap("172.20.0.1", "8007")
+	first, err := join(t, JoinNetworkBootstrap, testConfig(), "172.20.0.1:8007")
 	if err != nil {
 		t.Fatal("Expected no error on first call to JoinNetworkBootstrap")
 	}
 
-	_, err = JoinNetworkBootstrap("172.20.0.1", "8007")
+	cfg := testConfig()
+	cfg.ListenAddress = first.Network.LocalAddr().String()
+	_, err = join(t, JoinNetworkBootstrap, cfg, "172.20.0.1:8007")
 	if err == nil {
 		t.Fatal("Expected error due to port in use")
 	}
@@ -95,11 +121,222 @@ func TestReturnsValidIPAddress(t *testing.T) {
 		t.Fatal("Expected a valid IPv4 address")
 	}
 }
-func TestStartBootstrapNode_StartsNetworkComponents(t *testing.T) {
-	StartBootstrapNode("172.20.0.1")
-	// No assertion needed, just ensure no panic occurs
+func TestStartBootstrapNode_StopsWhenCancelled(t *testing.T) {
+	cfg := testConfig()
+	cfg.Bootstrap = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	k, err := StartBootstrapNode(ctx, cfg, "127.0.0.1:8020")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	udpAddress, tcpAddress := listenAddresses(k)
+
+	cancel()
+
+	// Stop waits for the shutdown started by the cancellation
+	if err := k.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertPortReleased(t, udpAddress, tcpAddress)
+}
+
+func TestStartNode_SavesStateAndReleasesPortOnStop(t *testing.T) {
+	cfg := testConfig()
+	cfg.Bootstrap = nil
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	k, err := StartNode(context.Background(), cfg, "127.0.0.1:8021")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	udpAddress, tcpAddress := listenAddresses(k)
+
+	if err := k.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if state, err := kademlia.LoadState(cfg.StateFile); err != nil || !state.NodeID().Equals(k.RoutingTable.Me.ID) {
+		t.Errorf("Expected the state to be saved on stop, got %v", err)
+	}
+	assertPortReleased(t, udpAddress, tcpAddress)
+}
+
+// listenAddresses returns the addresses the UDP and TCP sockets of a node are bound to
+func listenAddresses(k *kademlia.Kademlia) (string, string) {
+	return k.Network.LocalAddr().String(), k.StreamListener.Addr().String()
+}
+
+// assertPortReleased checks that the UDP and TCP sockets of a stopped node were closed
+func assertPortReleased(t *testing.T, udpAddress, tcpAddress string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", udpAddress)
+	if err != nil {
+		t.Fatalf("Expected the UDP port to be released, got %v", err)
+	}
+	conn.Close()
+	listener, err := net.Listen("tcp", tcpAddress)
+	if err != nil {
+		t.Fatalf("Expected the TCP port to be released, got %v", err)
+	}
+	listener.Close()
 }
-func TestStartNode_StartsNetworkComponents(t *testing.T) {
-	StartNode("172.20.0.2")
-	// No assertion needed, just ensure no panic occurs
+
+func TestJoinNetwork_UsesConfiguredID(t *testing.T) {
+	cfg := testConfig()
+	cfg.NodeID = "0000000000000000000000000000000000000001"
+	cfg.K = 3
+	k, err := join(t, JoinNetwork, cfg, "127.0.0.1:8008")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if k.RoutingTable.Me.ID.String() != cfg.NodeID {
+		t.Errorf("Expected node ID %s, got %s", cfg.NodeID, k.RoutingTable.Me.ID.String())
+	}
+	if k.K != 3 {
+		t.Errorf("Expected k to be 3, got %d", k.K)
+	}
+}
+
+func TestBootstrapContacts_SkipsSelfAndKeepsUnknownIDs(t *testing.T) {
+	cfg := config.Default()
+	cfg.Bootstrap = []config.Seed{
+		{ID: "fffffffff0000000000000000000000000000000", Address: "127.0.0.1:8000"},
+		{Address: "127.0.0.1:8001"},
+		{Address: "127.0.0.1:8002"},
+	}
+
+	seeds := BootstrapContacts(cfg, "127.0.0.1:8002")
+
+	if len(seeds) != 2 {
+		t.Fatalf("Expected two bootstrap contacts, got %v", seeds)
+	}
+	if seeds[0].ID == nil || seeds[0].ID.String() != cfg.Bootstrap[0].ID {
+		t.Errorf("Expected the configured ID, got %v", seeds[0].ID)
+	}
+	if seeds[1].ID != nil {
+		t.Errorf("Expected no ID for a seed given as host:port, got %v", seeds[1].ID)
+	}
+}
+
+func TestJoinNetworkBootstrap_UsesSeedID(t *testing.T) {
+	cfg := testConfig()
+	cfg.Bootstrap = []config.Seed{{ID: "fffffffff0000000000000000000000000000000", Address: "127.0.0.1:8009"}}
+	k, err := join(t, JoinNetworkBootstrap, cfg, "127.0.0.1:8009")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if k.RoutingTable.Me.ID.String() != cfg.Bootstrap[0].ID {
+		t.Errorf("Expected the seed ID, got %s", k.RoutingTable.Me.ID.String())
+	}
+}
+
+func TestIsBootstrapNode(t *testing.T) {
+	cfg := config.Default()
+	if !IsBootstrapNode(cfg, "172.20.0.6:8000") {
+		t.Error("Expected the default bootstrap address to be a bootstrap node")
+	}
+	if IsBootstrapNode(cfg, "172.20.0.7:8000") {
+		t.Error("Expected other addresses not to be bootstrap nodes")
+	}
+}
+
+func TestAdvertiseAddress(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdvertiseAddress = "127.0.0.1:9000"
+	if address, _ := AdvertiseAddress(cfg); address != "127.0.0.1:9000" {
+		t.Errorf("Expected the configured address, got %s", address)
+	}
+
+	cfg.AdvertiseAddress = ""
+	cfg.ListenAddress = "127.0.0.1:9001"
+	if address, _ := AdvertiseAddress(cfg); address != "127.0.0.1:9001" {
+		t.Errorf("Expected the listen address, got %s", address)
+	}
+
+	cfg.ListenAddress = ":9002"
+	address, err := AdvertiseAddress(cfg)
+	if err != nil || address == ":9002" {
+		t.Errorf("Expected a detected host, got %s (%v)", address, err)
+	}
+}
+
+func TestNewLogger_WritesConfiguredFormatAndLevel(t *testing.T) {
+	cfg := config.Default()
+	cfg.LogFormat = config.LogFormatJSON
+	cfg.LogLevel = slog.LevelWarn
+	var buf bytes.Buffer
+	logger := NewLogger(cfg, &buf)
+
+	logger.Info("hidden")
+	logger.Warn("shown", "peer", "127.0.0.1:8000")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["peer"] != "127.0.0.1:8000" {
+		t.Errorf("Unexpected record: %v", record)
+	}
+
+	buf.Reset()
+	cfg.LogFormat = config.LogFormatText
+	NewLogger(cfg, &buf).Warn("shown")
+	if !strings.Contains(buf.String(), "level=WARN msg=shown") {
+		t.Errorf("Expected a text record, got %q", buf.String())
+	}
+}
+
+func TestJoinNetwork_UsesSavedID(t *testing.T) {
+	cfg := testConfig()
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	if _, ok := SavedState(cfg); ok {
+		t.Fatal("Expected no saved state before the first run")
+	}
+	first, err := join(t, JoinNetwork, cfg, "127.0.0.1:8010")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first.RoutingTable.AddContact(kademlia.NewContact(kademlia.NewRandomKademliaID(), "127.0.0.1:8012"))
+	if err := first.SaveState(cfg.StateFile); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	restarted, err := join(t, JoinNetwork, cfg, "127.0.0.1:8011")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !restarted.RoutingTable.Me.ID.Equals(first.RoutingTable.Me.ID) {
+		t.Errorf("Expected the saved ID %s, got %s", first.RoutingTable.Me.ID.String(), restarted.RoutingTable.Me.ID.String())
+	}
+	if state, ok := SavedState(cfg); !ok || len(state.SavedContacts()) != 1 {
+		t.Errorf("Expected the saved contact, got %v", state.Contacts)
+	}
+}
+
+func TestJoinNetwork_KeepsSavedSecureIdentity(t *testing.T) {
+	cfg := testConfig()
+	cfg.SecureID = true
+	cfg.Puzzle = kademlia.PuzzleDifficulty{Static: 4, Dynamic: 4}
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	first, err := join(t, JoinNetwork, cfg, "127.0.0.1:8022")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first.Network.Identity == nil || !first.Network.Identity.ID().Equals(first.RoutingTable.Me.ID) {
+		t.Fatal("Expected the node ID to be derived from its identity")
+	}
+	if first.Network.Puzzle == nil || *first.Network.Puzzle != cfg.Puzzle {
+		t.Errorf("Expected contacts to be checked against the configured puzzle, got %v", first.Network.Puzzle)
+	}
+	// Stop saves the state
+	first.Stop()
+
+	restarted, err := join(t, JoinNetwork, cfg, "127.0.0.1:8022")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !restarted.RoutingTable.Me.ID.Equals(first.RoutingTable.Me.ID) {
+		t.Errorf("Expected the saved ID %s, got %s", first.RoutingTable.Me.ID.String(), restarted.RoutingTable.Me.ID.String())
+	}
 }
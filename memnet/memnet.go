@@ -0,0 +1,436 @@
+// Package memnet is an in-memory datagram network for running many Kademlia nodes in one process.
+// It can delay, drop and reorder datagrams and split the nodes into partitions.
+package memnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const inboxSize = 1024 // datagrams queued per socket before new ones are dropped, like a full socket buffer
+const firstEphemeralPort = 49152
+
+var (
+	ErrAddressInUse   = errors.New("address already in use")
+	ErrNoSuchAddress  = errors.New("no node listening on address")
+	ErrInvalidAddress = errors.New("address must be host:port")
+	ErrNoStreams      = errors.New("streams are not simulated")
+)
+
+// Addr is the address of a socket on a Network
+type Addr string
+
+func (addr Addr) Network() string { return "memnet" }
+func (addr Addr) String() string  { return string(addr) }
+
+// Stats counts the datagrams sent over a Network
+type Stats struct {
+	Sent      int // datagrams written by any socket
+	Delivered int // datagrams put in the queue of their receiver
+	Dropped   int // datagrams lost, sent across a partition or sent to a full or missing socket
+}
+
+// Network is an in-memory network of sockets, the zero value is not usable, use New
+type Network struct {
+	mutex      sync.Mutex
+	seed       int64
+	sequences  map[link]uint64
+	sockets    map[string]*socket
+	partitions map[string]int
+	nextPort   map[string]int
+	latency    time.Duration
+	jitter     time.Duration
+	lossRate   float64
+	reorder    float64
+	stats      Stats
+}
+
+// New returns an empty network, all random decisions are drawn from the seed
+func New(seed int64) *Network {
+	return &Network{
+		seed:       seed,
+		sequences:  make(map[link]uint64),
+		sockets:    make(map[string]*socket),
+		partitions: make(map[string]int),
+		nextPort:   make(map[string]int),
+	}
+}
+
+// SetLatency delays every datagram by latency plus a random duration up to jitter
+func (network *Network) SetLatency(latency time.Duration, jitter time.Duration) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.latency = latency
+	network.jitter = jitter
+}
+
+// SetLoss drops the given fraction of datagrams, between 0 and 1
+func (network *Network) SetLoss(rate float64) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.lossRate = rate
+}
+
+// SetReordering holds back the given fraction of datagrams so later datagrams overtake them
+func (network *Network) SetReordering(rate float64) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.reorder = rate
+}
+
+// Partition splits the hosts into groups that cannot reach each other,
+// hosts that are not listed form one more group together
+func (network *Network) Partition(groups ...[]string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			network.partitions[host] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions
+func (network *Network) Heal() {
+	network.Partition()
+}
+
+// Stats returns the datagram counters of the network
+func (network *Network) Stats() Stats {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.stats
+}
+
+// Listen opens the socket a node receives datagrams on, the address is host:port
+func (network *Network) Listen(address string) (*Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+	socket, err := network.open(address, host)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{socket: socket}, nil
+}
+
+// open registers a socket on the address that belongs to the host
+func (network *Network) open(address string, host string) (*socket, error) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if _, ok := network.sockets[address]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAddressInUse, address)
+	}
+	socket := newSocket(network, Addr(address), host)
+	network.sockets[address] = socket
+	return socket, nil
+}
+
+// dial opens a socket on a free port of the host
+func (network *Network) dial(host string) *socket {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	for {
+		port := network.nextPort[host]
+		if port == 0 {
+			port = firstEphemeralPort
+		}
+		network.nextPort[host] = port + 1
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		if _, ok := network.sockets[address]; !ok {
+			socket := newSocket(network, Addr(address), host)
+			network.sockets[address] = socket
+			return socket
+		}
+	}
+}
+
+// close removes the socket from the network
+func (network *Network) close(socket *socket) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if network.sockets[socket.addr.String()] == socket {
+		delete(network.sockets, socket.addr.String())
+	}
+}
+
+// hasSocket returns true if a socket is open on the address
+func (network *Network) hasSocket(address string) bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	_, ok := network.sockets[address]
+	return ok
+}
+
+// send delivers a copy of the datagram after the simulated delay, unless it is lost or crosses a partition
+func (network *Network) send(from *socket, p []byte, to string) {
+	network.mutex.Lock()
+	network.stats.Sent++
+	toHost, _, _ := net.SplitHostPort(to)
+	random := network.draw(link{from: from.host, to: toHost})
+	if network.partitions[from.host] != network.partitions[toHost] || random.float64() < network.lossRate {
+		network.stats.Dropped++
+		network.mutex.Unlock()
+		return
+	}
+	delay := network.latency
+	if network.jitter > 0 {
+		delay += time.Duration(random.next() % uint64(network.jitter))
+	}
+	if random.float64() < network.reorder {
+		delay += network.latency + network.jitter + time.Millisecond
+	}
+	network.mutex.Unlock()
+
+	datagram := packet{data: append([]byte{}, p...), from: from.addr}
+	if delay <= 0 {
+		network.deliver(datagram, to)
+		return
+	}
+	time.AfterFunc(delay, func() { network.deliver(datagram, to) })
+}
+
+// link is the direction between two hosts datagrams are sent in
+type link struct {
+	from string
+	to   string
+}
+
+// draw returns the random source of the next datagram sent over the link. It is derived from the seed, the hosts
+// and the number of datagrams sent over the link before, so the same datagram meets the same loss, jitter and
+// reordering however the goroutines of other hosts interleave with it
+func (network *Network) draw(link link) *splitMix {
+	sequence := network.sequences[link]
+	network.sequences[link] = sequence + 1
+	hash := fnv.New64a()
+	binary.Write(hash, binary.BigEndian, network.seed)
+	hash.Write([]byte(link.from))
+	hash.Write([]byte{0})
+	hash.Write([]byte(link.to))
+	binary.Write(hash, binary.BigEndian, sequence)
+	return &splitMix{state: hash.Sum64()}
+}
+
+// splitMix is a small pseudo random generator, cheap enough to seed for every datagram
+type splitMix struct {
+	state uint64
+}
+
+func (random *splitMix) next() uint64 {
+	random.state += 0x9e3779b97f4a7c15
+	z := random.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// float64 returns a number in [0, 1)
+func (random *splitMix) float64() float64 {
+	return float64(random.next()>>11) / (1 << 53)
+}
+
+// deliver queues the datagram at the socket listening on the address
+func (network *Network) deliver(datagram packet, to string) {
+	network.mutex.Lock()
+	socket, ok := network.sockets[to]
+	network.mutex.Unlock()
+	delivered := ok && socket.enqueue(datagram)
+
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if delivered {
+		network.stats.Delivered++
+	} else {
+		network.stats.Dropped++
+	}
+}
+
+// packet is a datagram in flight
+type packet struct {
+	data []byte
+	from Addr
+}
+
+// socket is an endpoint on the network with a queue of received datagrams and a read deadline
+type socket struct {
+	network   *Network
+	addr      Addr
+	host      string
+	inbox     chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	deadline  time.Time
+	changed   chan struct{} // closed and replaced whenever the deadline changes to wake up blocked reads
+}
+
+func newSocket(network *Network, addr Addr, host string) *socket {
+	return &socket{
+		network: network,
+		addr:    addr,
+		host:    host,
+		inbox:   make(chan packet, inboxSize),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// enqueue queues a datagram, returns false if the socket is closed or its queue is full
+func (socket *socket) enqueue(datagram packet) bool {
+	select {
+	case <-socket.closed:
+		return false
+	default:
+	}
+	select {
+	case socket.inbox <- datagram:
+		return true
+	default:
+		return false
+	}
+}
+
+// read waits for the next datagram until the deadline passes or the socket is closed
+func (socket *socket) read(p []byte) (int, Addr, error) {
+	for {
+		socket.mutex.Lock()
+		deadline := socket.deadline
+		changed := socket.changed
+		socket.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return 0, "", os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		}
+		select {
+		case datagram := <-socket.inbox:
+			stopTimer(timer)
+			return copy(p, datagram.data), datagram.from, nil
+		case <-socket.closed:
+			stopTimer(timer)
+			return 0, "", net.ErrClosed
+		case <-changed:
+			stopTimer(timer)
+		case <-timeout:
+			return 0, "", os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (socket *socket) setDeadline(deadline time.Time) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.deadline = deadline
+	close(socket.changed)
+	socket.changed = make(chan struct{})
+}
+
+func (socket *socket) close() {
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		socket.network.close(socket)
+	})
+}
+
+func (socket *socket) isClosed() bool {
+	select {
+	case <-socket.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Conn is the socket a node receives requests on, it implements net.PacketConn and kademlia.Transport
+type Conn struct {
+	socket *socket
+}
+
+func (conn *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, from, err := conn.socket.read(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, from, nil
+}
+
+func (conn *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if conn.socket.isClosed() {
+		return 0, net.ErrClosed
+	}
+	conn.socket.network.send(conn.socket, p, addr.String())
+	return len(p), nil
+}
+
+// Dial opens a socket on a free port of this node's host that exchanges datagrams with the address,
+// dialing an address nobody listens on fails like a refused connection
+func (conn *Conn) Dial(address string) (net.Conn, error) {
+	if !conn.socket.network.hasSocket(address) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchAddress, address)
+	}
+	socket := conn.socket.network.dial(conn.socket.host)
+	return &DialConn{socket: socket, remote: Addr(address)}, nil
+}
+
+// DialStream fails, nodes on a memnet have no stream listener so they never send stream pointers
+func (conn *Conn) DialStream(address string, timeout time.Duration) (net.Conn, error) {
+	return nil, fmt.Errorf("%w: %s", ErrNoStreams, address)
+}
+
+func (conn *Conn) LocalAddr() net.Addr                { return conn.socket.addr }
+func (conn *Conn) Close() error                       { conn.socket.close(); return nil }
+func (conn *Conn) SetDeadline(t time.Time) error      { conn.socket.setDeadline(t); return nil }
+func (conn *Conn) SetReadDeadline(t time.Time) error  { conn.socket.setDeadline(t); return nil }
+func (conn *Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+// DialConn is a socket connected to one remote address, it implements net.Conn
+type DialConn struct {
+	socket *socket
+	remote Addr
+}
+
+// Read returns the next datagram from the remote address, datagrams from other addresses are discarded
+func (conn *DialConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := conn.socket.read(p)
+		if err != nil || from == conn.remote {
+			return n, err
+		}
+	}
+}
+
+func (conn *DialConn) Write(p []byte) (int, error) {
+	if conn.socket.isClosed() {
+		return 0, net.ErrClosed
+	}
+	conn.socket.network.send(conn.socket, p, conn.remote.String())
+	return len(p), nil
+}
+
+func (conn *DialConn) LocalAddr() net.Addr                { return conn.socket.addr }
+func (conn *DialConn) RemoteAddr() net.Addr               { return conn.remote }
+func (conn *DialConn) Close() error                       { conn.socket.close(); return nil }
+func (conn *DialConn) SetDeadline(t time.Time) error      { conn.socket.setDeadline(t); return nil }
+func (conn *DialConn) SetReadDeadline(t time.Time) error  { conn.socket.setDeadline(t); return nil }
+func (conn *DialConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,253 @@
+package memnet
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// listen opens a socket on the network or fails the test
+func listen(t *testing.T, network *Network, address string) *Conn {
+	conn, err := network.Listen(address)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestDial_ExchangesDatagramsWithListener(t *testing.T) {
+	network := New(1)
+	server := listen(t, network, "10.0.0.1:8000")
+	client := listen(t, network, "10.0.0.2:8000")
+
+	conn, err := client.Dial("10.0.0.1:8000")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+
+	buf := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Expected ping, got %q, %v", buf[:n], err)
+	}
+	if from.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected the datagram from %s, got %s", conn.LocalAddr(), from)
+	}
+	server.WriteTo([]byte("pong"), from)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("Expected pong, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestListen_RejectsAddressInUse(t *testing.T) {
+	network := New(1)
+	listen(t, network, "10.0.0.1:8000")
+
+	if _, err := network.Listen("10.0.0.1:8000"); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("Expected ErrAddressInUse, got %v", err)
+	}
+}
+
+func TestDial_FailsWithoutListener(t *testing.T) {
+	network := New(1)
+	client := listen(t, network, "10.0.0.1:8000")
+
+	if _, err := client.Dial("10.0.0.2:8000"); !errors.Is(err, ErrNoSuchAddress) {
+		t.Errorf("Expected ErrNoSuchAddress, got %v", err)
+	}
+}
+
+func TestRead_ReturnsDeadlineExceeded(t *testing.T) {
+	network := New(1)
+	conn := listen(t, network, "10.0.0.1:8000")
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	start := time.Now()
+	_, _, err := conn.ReadFrom(make([]byte, 16))
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected the read to wait for the deadline")
+	}
+}
+
+func TestRead_ReturnsWhenClosed(t *testing.T) {
+	network := New(1)
+	conn, _ := network.Listen("10.0.0.1:8000")
+	done := make(chan error)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error from a closed socket")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the read to return when the socket closes")
+	}
+}
+
+func TestSetLatency_DelaysDatagrams(t *testing.T) {
+	network := New(1)
+	network.SetLatency(30*time.Millisecond, 0)
+	server := listen(t, network, "10.0.0.1:8000")
+	client := listen(t, network, "10.0.0.2:8000")
+
+	start := time.Now()
+	client.WriteTo([]byte("ping"), Addr("10.0.0.1:8000"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := server.ReadFrom(make([]byte, 16))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Error("Expected the datagram to be delayed by the latency")
+	}
+}
+
+func TestSetLoss_DropsDatagrams(t *testing.T) {
+	network := New(1)
+	network.SetLoss(1)
+	listen(t, network, "10.0.0.1:8000")
+	client := listen(t, network, "10.0.0.2:8000")
+
+	for i := 0; i < 10; i++ {
+		client.WriteTo([]byte("ping"), Addr("10.0.0.1:8000"))
+	}
+
+	if stats := network.Stats(); stats.Sent != 10 || stats.Dropped != 10 || stats.Delivered != 0 {
+		t.Errorf("Expected all 10 datagrams to be dropped, got %+v", stats)
+	}
+}
+
+func TestSetLoss_IsDeterministicForSeed(t *testing.T) {
+	dropped := func() int {
+		network := New(42)
+		network.SetLoss(0.5)
+		listen(t, network, "10.0.0.1:8000")
+		client := listen(t, network, "10.0.0.2:8000")
+		for i := 0; i < 100; i++ {
+			client.WriteTo([]byte("ping"), Addr("10.0.0.1:8000"))
+		}
+		return network.Stats().Dropped
+	}
+
+	first := dropped()
+	if first == 0 || first == 100 {
+		t.Errorf("Expected about half of the datagrams to be dropped, got %d", first)
+	}
+	if second := dropped(); second != first {
+		t.Errorf("Expected the same seed to drop the same datagrams, got %d and %d", first, second)
+	}
+}
+
+func TestSetLoss_DropsTheSameDatagramsWhateverTheOrderOfOtherHosts(t *testing.T) {
+	// received sends 20 datagrams from each of two clients, in the given order of clients, and returns
+	// the datagrams the server got from the first client
+	received := func(order []int) map[byte]bool {
+		network := New(42)
+		network.SetLoss(0.5)
+		server := listen(t, network, "10.0.0.1:8000")
+		clients := []*Conn{listen(t, network, "10.0.0.2:8000"), listen(t, network, "10.0.0.3:8000")}
+		sent := make([]byte, len(clients))
+		for _, client := range order {
+			clients[client].WriteTo([]byte{sent[client]}, Addr("10.0.0.1:8000"))
+			sent[client]++
+		}
+		got := make(map[byte]bool)
+		buf := make([]byte, 1)
+		server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		for {
+			_, from, err := server.ReadFrom(buf)
+			if err != nil {
+				return got
+			}
+			if from.String() == "10.0.0.2:8000" {
+				got[buf[0]] = true
+			}
+		}
+	}
+	var interleaved, batched []int
+	for i := 0; i < 20; i++ {
+		interleaved = append(interleaved, 0, 1)
+	}
+	for i := 0; i < 40; i++ {
+		batched = append(batched, 1-i/20)
+	}
+
+	first, second := received(interleaved), received(batched)
+	if len(first) == 0 || len(first) == 20 {
+		t.Errorf("Expected about half of the datagrams to be dropped, %d of 20 arrived", len(first))
+	}
+	for datagram := byte(0); datagram < 20; datagram++ {
+		if first[datagram] != second[datagram] {
+			t.Errorf("Expected datagram %d to meet the same loss in both orders, arrived %v and %v", datagram, first[datagram], second[datagram])
+		}
+	}
+}
+
+func TestSetReordering_LetsLaterDatagramsOvertake(t *testing.T) {
+	network := New(1)
+	network.SetLatency(time.Millisecond, 0)
+	network.SetReordering(0.5)
+	server := listen(t, network, "10.0.0.1:8000")
+	client := listen(t, network, "10.0.0.2:8000")
+
+	for i := 0; i < 20; i++ {
+		client.WriteTo([]byte{byte(i)}, Addr("10.0.0.1:8000"))
+	}
+	reordered := false
+	last := -1
+	buf := make([]byte, 1)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 20; i++ {
+		if _, _, err := server.ReadFrom(buf); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if int(buf[0]) < last {
+			reordered = true
+		}
+		last = int(buf[0])
+	}
+
+	if !reordered {
+		t.Error("Expected some datagrams to arrive out of order")
+	}
+}
+
+func TestPartition_DropsDatagramsBetweenGroups(t *testing.T) {
+	network := New(1)
+	server := listen(t, network, "10.0.0.1:8000")
+	client := listen(t, network, "10.0.0.2:8000")
+	network.Partition([]string{"10.0.0.1"})
+
+	client.WriteTo([]byte("lost"), Addr("10.0.0.1:8000"))
+	if network.Stats().Dropped != 1 {
+		t.Fatal("Expected the datagram across the partition to be dropped")
+	}
+
+	network.Heal()
+	client.WriteTo([]byte("ping"), Addr("10.0.0.1:8000"))
+	buf := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("Expected ping after healing, got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,328 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text format written by Registry.Write
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// labelSeparator joins label values into a series key, it cannot appear in valid UTF-8
+const labelSeparator = "\xff"
+
+// Registry holds metrics in the order they were registered, the zero value is not usable, use NewRegistry
+type Registry struct {
+	mutex     sync.Mutex
+	metrics   []metric
+	collectFn []func()
+}
+
+// metric is a family of series sharing a name and type
+type metric interface {
+	write(w io.Writer)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// OnCollect registers a function that runs before every Write, gauges that mirror state are set there
+func (registry *Registry) OnCollect(fn func()) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.collectFn = append(registry.collectFn, fn)
+}
+
+// Write runs the collect functions and writes every metric in the Prometheus text format
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mutex.Lock()
+	collectFn := append([]func(){}, registry.collectFn...)
+	metrics := append([]metric{}, registry.metrics...)
+	registry.mutex.Unlock()
+
+	for _, fn := range collectFn {
+		fn()
+	}
+	buffered := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		metric.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+func (registry *Registry) register(metric metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// family holds the series of a metric keyed by their label values
+type family[T any] struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  sync.Mutex
+	series map[string]*T
+}
+
+func newFamily[T any](name string, help string, kind string, labels []string) *family[T] {
+	return &family[T]{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*T)}
+}
+
+// get returns the series of the label values, creating it with create if it does not exist,
+// it must be called with the mutex held
+func (family *family[T]) get(labelValues []string, create func() *T) *T {
+	if len(labelValues) != len(family.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", family.name, len(family.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	series, ok := family.series[key]
+	if !ok {
+		series = create()
+		family.series[key] = series
+	}
+	return series
+}
+
+// find returns the series of the label values or nil, it must be called with the mutex held
+func (family *family[T]) find(labelValues []string) *T {
+	return family.series[strings.Join(labelValues, labelSeparator)]
+}
+
+// write writes the header and calls writeSeries for every series sorted by label values
+func (family *family[T]) write(w io.Writer, writeSeries func(labelValues []string, series *T)) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", family.name, escapeHelp(family.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+	keys := make([]string, 0, len(family.series))
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var labelValues []string
+		if len(family.labels) > 0 {
+			labelValues = strings.Split(key, labelSeparator)
+		}
+		writeSeries(labelValues, family.series[key])
+	}
+}
+
+// Counter is a value that only goes up, split into series by its labels
+type Counter struct {
+	family *family[float64]
+}
+
+// Counter registers a counter with the given label names
+func (registry *Registry) Counter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{family: newFamily[float64](name, help, "counter", labels)}
+	registry.register(counter)
+	return counter
+}
+
+// Inc adds one to the series of the label values
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds delta to the series of the label values, negative deltas are ignored
+func (counter *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	counter.family.mutex.Lock()
+	defer counter.family.mutex.Unlock()
+	*counter.family.get(labelValues, newFloat) += delta
+}
+
+// Value returns the value of the series of the label values
+func (counter *Counter) Value(labelValues ...string) float64 {
+	counter.family.mutex.Lock()
+	defer counter.family.mutex.Unlock()
+	if value := counter.family.find(labelValues); value != nil {
+		return *value
+	}
+	return 0
+}
+
+func (counter *Counter) write(w io.Writer) {
+	counter.family.write(w, func(labelValues []string, value *float64) {
+		writeSample(w, counter.family.name, counter.family.labels, labelValues, *value)
+	})
+}
+
+// Gauge is a value that can go up and down, split into series by its labels
+type Gauge struct {
+	family *family[float64]
+}
+
+// Gauge registers a gauge with the given label names
+func (registry *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{family: newFamily[float64](name, help, "gauge", labels)}
+	registry.register(gauge)
+	return gauge
+}
+
+// Set sets the series of the label values
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	gauge.family.mutex.Lock()
+	defer gauge.family.mutex.Unlock()
+	*gauge.family.get(labelValues, newFloat) = value
+}
+
+// Value returns the value of the series of the label values
+func (gauge *Gauge) Value(labelValues ...string) float64 {
+	gauge.family.mutex.Lock()
+	defer gauge.family.mutex.Unlock()
+	if value := gauge.family.find(labelValues); value != nil {
+		return *value
+	}
+	return 0
+}
+
+// Reset removes every series, so series that are not set again are no longer written
+func (gauge *Gauge) Reset() {
+	gauge.family.mutex.Lock()
+	defer gauge.family.mutex.Unlock()
+	gauge.family.series = make(map[string]*float64)
+}
+
+func (gauge *Gauge) write(w io.Writer) {
+	gauge.family.write(w, func(labelValues []string, value *float64) {
+		writeSample(w, gauge.family.name, gauge.family.labels, labelValues, *value)
+	})
+}
+
+// Histogram counts observations in buckets, split into series by its labels
+type Histogram struct {
+	family  *family[histogramSeries]
+	buckets []float64
+}
+
+type histogramSeries struct {
+	counts []uint64 // observations per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram registers a histogram with the given upper bounds of its buckets, in increasing order,
+// and label names, the +Inf bucket is added to the bounds
+func (registry *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{family: newFamily[histogramSeries](name, help, "histogram", labels), buckets: buckets}
+	registry.register(histogram)
+	return histogram
+}
+
+// Observe counts the value in the series of the label values
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.family.mutex.Lock()
+	defer histogram.family.mutex.Unlock()
+	series := histogram.family.get(labelValues, histogram.newSeries)
+	index := sort.SearchFloat64s(histogram.buckets, value)
+	if index < len(histogram.buckets) {
+		series.counts[index]++
+	}
+	series.count++
+	series.sum += value
+}
+
+// Count returns the number of observations and their sum in the series of the label values
+func (histogram *Histogram) Count(labelValues ...string) (uint64, float64) {
+	histogram.family.mutex.Lock()
+	defer histogram.family.mutex.Unlock()
+	if series := histogram.family.find(labelValues); series != nil {
+		return series.count, series.sum
+	}
+	return 0, 0
+}
+
+func (histogram *Histogram) newSeries() *histogramSeries {
+	return &histogramSeries{counts: make([]uint64, len(histogram.buckets))}
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	name := histogram.family.name
+	labels := append(append([]string{}, histogram.family.labels...), "le")
+	histogram.family.write(w, func(labelValues []string, series *histogramSeries) {
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += series.counts[i]
+			writeSample(w, name+"_bucket", labels, append(append([]string{}, labelValues...), formatValue(bound)), float64(cumulative))
+		}
+		writeSample(w, name+"_bucket", labels, append(append([]string{}, labelValues...), "+Inf"), float64(series.count))
+		writeSample(w, name+"_sum", histogram.family.labels, labelValues, series.sum)
+		writeSample(w, name+"_count", histogram.family.labels, labelValues, float64(series.count))
+	})
+}
+
+// LinearBuckets returns count bucket bounds starting at start and width apart
+func LinearBuckets(start float64, width float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start + float64(i)*width
+	}
+	return buckets
+}
+
+// ExponentialBuckets returns count bucket bounds starting at start, each factor times the one before
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start * math.Pow(factor, float64(i))
+	}
+	return buckets
+}
+
+func newFloat() *float64 {
+	return new(float64)
+}
+
+// writeSample writes one line of the text format
+func writeSample(w io.Writer, name string, labels []string, labelValues []string, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatValue(value))
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func write(t *testing.T, registry *Registry) string {
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return buf.String()
+}
+
+func TestRegistry_WritesCountersByLabel(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.Counter("rpcs_total", "RPCs sent.", "type")
+
+	counter.Inc("PING")
+	counter.Add(2, "FIND_NODE")
+	counter.Add(-1, "FIND_NODE")
+
+	expected := "# HELP rpcs_total RPCs sent.\n" +
+		"# TYPE rpcs_total counter\n" +
+		"rpcs_total{type=\"FIND_NODE\"} 2\n" +
+		"rpcs_total{type=\"PING\"} 1\n"
+	if output := write(t, registry); output != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, output)
+	}
+	if counter.Value("STORE") != 0 || counter.Value("PING") != 1 {
+		t.Errorf("Unexpected values %v and %v", counter.Value("STORE"), counter.Value("PING"))
+	}
+}
+
+func TestRegistry_WritesCumulativeHistogramBuckets(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.Histogram("hops", "Hops.", []float64{1, 2, 4})
+
+	for _, value := range []float64{1, 2, 3, 8} {
+		histogram.Observe(value)
+	}
+
+	expected := "# HELP hops Hops.\n" +
+		"# TYPE hops histogram\n" +
+		"hops_bucket{le=\"1\"} 1\n" +
+		"hops_bucket{le=\"2\"} 2\n" +
+		"hops_bucket{le=\"4\"} 3\n" +
+		"hops_bucket{le=\"+Inf\"} 4\n" +
+		"hops_sum 14\n" +
+		"hops_count 4\n"
+	if output := write(t, registry); output != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, output)
+	}
+	if count, sum := histogram.Count(); count != 4 || sum != 14 {
+		t.Errorf("Expected 4 observations summing to 14, got %d and %v", count, sum)
+	}
+}
+
+func TestRegistry_SetsGaugesOnCollect(t *testing.T) {
+	registry := NewRegistry()
+	gauge := registry.Gauge("contacts", "Contacts.", "bucket")
+	gauge.Set(3, "7")
+	registry.OnCollect(func() {
+		gauge.Reset()
+		gauge.Set(5, "159")
+	})
+
+	output := write(t, registry)
+
+	if strings.Contains(output, `bucket="7"`) || !strings.Contains(output, "contacts{bucket=\"159\"} 5\n") {
+		t.Errorf("Expected only the series set on collect, got\n%s", output)
+	}
+}
+
+func TestRegistry_EscapesLabelValuesAndHelp(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("errors_total", "Errors\nby message.", "message").Inc("say \"hi\"\\")
+
+	output := write(t, registry)
+
+	if !strings.Contains(output, "# HELP errors_total Errors\\nby message.\n") {
+		t.Errorf("Expected the help to be escaped, got\n%s", output)
+	}
+	if !strings.Contains(output, `errors_total{message="say \"hi\"\\"} 1`) {
+		t.Errorf("Expected the label value to be escaped, got\n%s", output)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	linear := LinearBuckets(1, 1, 3)
+	exponential := ExponentialBuckets(0.5, 2, 3)
+	if linear[0] != 1 || linear[2] != 3 || exponential[0] != 0.5 || exponential[2] != 2 {
+		t.Errorf("Unexpected buckets %v and %v", linear, exponential)
+	}
+}
@@ -0,0 +1,89 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+
+	"d7024e/kademlia"
+	"d7024e/memnet"
+)
+
+// LookupReport summarises the lookups of one kind
+type LookupReport struct {
+	Count     int // lookups done
+	Succeeded int // lookups that found what they were looking for
+	Rounds    int // rounds of RPCs over all lookups
+	MaxRounds int // rounds of the longest lookup
+	RPCs      int // RPCs over all lookups
+}
+
+// add counts one lookup
+func (report *LookupReport) add(stats kademlia.LookupStats, succeeded bool) {
+	report.Count++
+	if succeeded {
+		report.Succeeded++
+	}
+	report.Rounds += stats.Rounds
+	report.MaxRounds = max(report.MaxRounds, stats.Rounds)
+	report.RPCs += stats.RPCs
+}
+
+// SuccessRate returns the fraction of lookups that succeeded
+func (report LookupReport) SuccessRate() float64 {
+	return ratio(report.Succeeded, report.Count)
+}
+
+// MeanHops returns the average number of rounds per lookup
+func (report LookupReport) MeanHops() float64 {
+	return ratio(report.Rounds, report.Count)
+}
+
+// MeanRPCs returns the average number of RPCs per lookup
+func (report LookupReport) MeanRPCs() float64 {
+	return ratio(report.RPCs, report.Count)
+}
+
+// Report holds the measurements of a simulation
+type Report struct {
+	Nodes       int          // nodes running at the end
+	Joined      int          // nodes that joined
+	FailedJoins int          // nodes that found no seed
+	Left        int          // nodes stopped by churn
+	Puts        LookupReport // a PUT succeeds if a majority of the k closest nodes stored the value
+	Gets        LookupReport // a GET succeeds if it returned the value matching the key
+	Lookups     LookupReport // a node lookup succeeds if the closest running node is returned first
+	Checked     int          // values fetched by the last durability check
+	Durable     int          // values the last durability check still found
+	Network     memnet.Stats
+}
+
+// Durability returns the fraction of the checked values that were still found
+func (report Report) Durability() float64 {
+	return ratio(report.Durable, report.Checked)
+}
+
+// Print writes the report as a table
+func (report Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "nodes: %d running, %d joined, %d failed to join, %d left\n",
+		report.Nodes, report.Joined, report.FailedJoins, report.Left)
+	fmt.Fprintf(w, "%-8s %8s %8s %10s %10s %10s\n", "kind", "count", "success", "mean hops", "max hops", "mean RPCs")
+	for _, row := range []struct {
+		name   string
+		report LookupReport
+	}{{"put", report.Puts}, {"get", report.Gets}, {"lookup", report.Lookups}} {
+		fmt.Fprintf(w, "%-8s %8d %7.1f%% %10.2f %10d %10.2f\n", row.name, row.report.Count,
+			100*row.report.SuccessRate(), row.report.MeanHops(), row.report.MaxRounds, row.report.MeanRPCs())
+	}
+	if report.Checked > 0 {
+		fmt.Fprintf(w, "durability: %d of %d values found (%.1f%%)\n", report.Durable, report.Checked, 100*report.Durability())
+	}
+	fmt.Fprintf(w, "datagrams: %d sent, %d delivered, %d dropped\n",
+		report.Network.Sent, report.Network.Delivered, report.Network.Dropped)
+}
+
+func ratio(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
@@ -0,0 +1,464 @@
+// Package sim runs many Kademlia nodes in one process over an in-memory network
+// and measures how lookups, PUTs and GETs behave in scripted scenarios.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"d7024e/kademlia"
+	"d7024e/memnet"
+)
+
+const nodePort = 8000
+const seedCount = 3 // nodes started first that the others join through
+
+var ErrUnknownStep = errors.New("unknown scenario step")
+
+// Options configure a simulation, zero values fall back to the defaults of Default
+type Options struct {
+	Nodes       int           // nodes started by the join step
+	Seed        int64         // seed of all random decisions, node IDs, keys and the network
+	K           int           // replication parameter of every node
+	Alpha       int           // parallel RPCs of every lookup
+	Timeout     time.Duration // RPC timeout of every node
+	Retries     int           // RPC retries of every node
+	Latency     time.Duration // one-way latency of every datagram
+	Jitter      time.Duration // random extra latency of every datagram
+	Loss        float64       // fraction of datagrams dropped
+	Reordering  float64       // fraction of datagrams delayed so later ones overtake them
+	Concurrency int           // nodes joining, PUTs or GETs running at the same time
+	Puts        int           // values stored by the put step
+	ValueSize   int           // size of every stored value in bytes
+	Gets        int           // values fetched by the get step
+	Lookups     int           // random node IDs looked up by the lookup step
+	Churn       float64       // fraction of the nodes replaced by the churn step
+	Unsigned    bool          // nodes neither sign messages nor require signatures, which saves the Ed25519 work
+}
+
+// Default returns the options of a simulation with 1000 nodes on a perfect network
+func Default() Options {
+	return Options{
+		Nodes:       1000,
+		Seed:        1,
+		K:           kademlia.DefaultK,
+		Alpha:       kademlia.DefaultAlpha,
+		Timeout:     500 * time.Millisecond,
+		Retries:     1,
+		Concurrency: 64,
+		Puts:        100,
+		ValueSize:   64,
+		Gets:        500,
+		Lookups:     100,
+		Churn:       0.1,
+	}
+}
+
+// withDefaults fills in the zero values with the defaults
+func (options Options) withDefaults() Options {
+	defaults := Default()
+	if options.Nodes <= 0 {
+		options.Nodes = defaults.Nodes
+	}
+	if options.K <= 0 {
+		options.K = defaults.K
+	}
+	if options.Alpha <= 0 {
+		options.Alpha = defaults.Alpha
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaults.Timeout
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaults.Concurrency
+	}
+	if options.ValueSize <= 0 {
+		options.ValueSize = defaults.ValueSize
+	}
+	return options
+}
+
+// node is a running Kademlia instance
+type node struct {
+	kademlia *kademlia.Kademlia
+}
+
+// Simulation is a set of nodes on an in-memory network
+type Simulation struct {
+	Network  *memnet.Network
+	options  Options
+	random   *rand.Rand
+	mutex    sync.Mutex
+	nodes    []*node
+	nextHost int
+	values   map[string][]byte // values stored by the put step, by key
+	report   Report
+}
+
+// New returns a simulation without nodes, the join step starts them
+func New(options Options) *Simulation {
+	options = options.withDefaults()
+	network := memnet.New(options.Seed)
+	network.SetLatency(options.Latency, options.Jitter)
+	network.SetLoss(options.Loss)
+	network.SetReordering(options.Reordering)
+	return &Simulation{
+		Network: network,
+		options: options,
+		random:  rand.New(rand.NewSource(options.Seed)),
+		values:  make(map[string][]byte),
+	}
+}
+
+// Run runs the steps of a scenario in order: join, put, get, lookup, churn and check,
+// then stops every node
+func (simulation *Simulation) Run(ctx context.Context, steps []string) (Report, error) {
+	defer simulation.Stop()
+	for _, step := range steps {
+		var err error
+		switch strings.TrimSpace(step) {
+		case "join":
+			err = simulation.JoinStorm(ctx, simulation.options.Nodes)
+		case "put":
+			simulation.PutValues(ctx, simulation.options.Puts)
+		case "get":
+			simulation.GetValues(ctx, simulation.options.Gets)
+		case "lookup":
+			simulation.LookupNodes(ctx, simulation.options.Lookups)
+		case "churn":
+			err = simulation.Churn(ctx, int(simulation.options.Churn*float64(simulation.NodeCount())))
+		case "check":
+			simulation.CheckDurability(ctx)
+		default:
+			err = fmt.Errorf("%w: %q", ErrUnknownStep, step)
+		}
+		if err != nil {
+			return simulation.Report(), err
+		}
+	}
+	return simulation.Report(), nil
+}
+
+// NodeCount returns the number of running nodes
+func (simulation *Simulation) NodeCount() int {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	return len(simulation.nodes)
+}
+
+// Stop stops every running node
+func (simulation *Simulation) Stop() {
+	simulation.mutex.Lock()
+	nodes := simulation.nodes
+	simulation.nodes = nil
+	simulation.mutex.Unlock()
+	simulation.stopNodes(nodes)
+}
+
+// stopNodes stops the nodes in parallel, their handlers wait for the RPCs they sent
+func (simulation *Simulation) stopNodes(nodes []*node) {
+	simulation.parallel(len(nodes), func(i int) { nodes[i].kademlia.Stop() })
+}
+
+// Report returns the measurements so far
+func (simulation *Simulation) Report() Report {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	report := simulation.report
+	report.Nodes = len(simulation.nodes)
+	report.Network = simulation.Network.Stats()
+	return report
+}
+
+// JoinStorm starts n nodes that all join at the same time, the first nodes are seeds the others join through
+func (simulation *Simulation) JoinStorm(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	started := make([]*node, 0, n)
+	for i := 0; i < n; i++ {
+		node, err := simulation.startNode()
+		if err != nil {
+			simulation.stopNodes(started)
+			return err
+		}
+		started = append(started, node)
+	}
+	seeds := simulation.seeds()
+	// The first nodes of an empty network are the seeds, they only find each other
+	firstSeeds := 0
+	if len(seeds) == 0 {
+		firstSeeds = min(seedCount, len(started))
+		for _, node := range started[:firstSeeds] {
+			seeds = append(seeds, node.kademlia.RoutingTable.Me)
+		}
+	}
+
+	var failed int
+	simulation.parallel(len(started), func(i int) {
+		// A lone first node has nobody to join
+		if firstSeeds == 1 && i == 0 {
+			return
+		}
+		if _, err := started[i].kademlia.Join(ctx, seeds); err != nil {
+			simulation.mutex.Lock()
+			failed++
+			simulation.mutex.Unlock()
+		}
+	})
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	simulation.nodes = append(simulation.nodes, started...)
+	simulation.report.Joined += len(started) - failed
+	simulation.report.FailedJoins += failed
+	return nil
+}
+
+// PutValues stores count random values, each from a random node
+func (simulation *Simulation) PutValues(ctx context.Context, count int) {
+	if simulation.NodeCount() == 0 {
+		return
+	}
+	values := make([][]byte, count)
+	from := make([]*node, count)
+	for i := range values {
+		values[i] = simulation.randomBytes(simulation.options.ValueSize)
+		from[i] = simulation.randomNode()
+	}
+	simulation.parallel(count, func(i int) {
+		key, result, err := from[i].kademlia.Put(ctx, values[i])
+		simulation.mutex.Lock()
+		defer simulation.mutex.Unlock()
+		simulation.report.Puts.add(result.Lookup, err == nil)
+		if len(result.StoredOn) > 0 {
+			simulation.values[key.String()] = values[i]
+		}
+	})
+}
+
+// GetValues fetches count stored values, each from a random node
+func (simulation *Simulation) GetValues(ctx context.Context, count int) {
+	keys := simulation.storedKeys()
+	if len(keys) == 0 || simulation.NodeCount() == 0 {
+		return
+	}
+	picked := make([]string, count)
+	from := make([]*node, count)
+	for i := range picked {
+		picked[i] = keys[simulation.intn(len(keys))]
+		from[i] = simulation.randomNode()
+	}
+	simulation.parallel(count, func(i int) {
+		found, stats := simulation.get(ctx, from[i], picked[i])
+		simulation.mutex.Lock()
+		defer simulation.mutex.Unlock()
+		simulation.report.Gets.add(stats, found)
+	})
+}
+
+// LookupNodes looks up count random node IDs, a lookup succeeds if it finds the closest running node
+func (simulation *Simulation) LookupNodes(ctx context.Context, count int) {
+	if simulation.NodeCount() == 0 {
+		return
+	}
+	targets := make([]kademlia.KademliaID, count)
+	from := make([]*node, count)
+	for i := range targets {
+		copy(targets[i][:], simulation.randomBytes(kademlia.IDLength))
+		from[i] = simulation.randomNode()
+	}
+	simulation.parallel(count, func(i int) {
+		target := kademlia.NewContact(&targets[i], "")
+		contacts, _, _, stats := from[i].kademlia.NodeLookupWithStats(ctx, &target, "")
+		closest := simulation.closestNode(&targets[i])
+		found := len(contacts) > 0 && contacts[0].ID.Equals(closest)
+		simulation.mutex.Lock()
+		defer simulation.mutex.Unlock()
+		simulation.report.Lookups.add(stats, found)
+	})
+}
+
+// Churn stops n random nodes and starts n new ones that join through random running nodes
+func (simulation *Simulation) Churn(ctx context.Context, n int) error {
+	simulation.mutex.Lock()
+	n = max(0, min(n, len(simulation.nodes)-1))
+	stopped := make([]*node, n)
+	for i := range stopped {
+		j := simulation.random.Intn(len(simulation.nodes))
+		stopped[i] = simulation.nodes[j]
+		simulation.nodes = append(simulation.nodes[:j], simulation.nodes[j+1:]...)
+	}
+	simulation.report.Left += n
+	simulation.mutex.Unlock()
+	simulation.stopNodes(stopped)
+	if n <= 0 {
+		return nil
+	}
+
+	started := make([]*node, n)
+	seeds := make([][]kademlia.Contact, n)
+	for i := range started {
+		node, err := simulation.startNode()
+		if err != nil {
+			simulation.stopNodes(started[:i])
+			return err
+		}
+		started[i] = node
+		seeds[i] = []kademlia.Contact{simulation.randomNode().kademlia.RoutingTable.Me}
+	}
+	var failed int
+	simulation.parallel(n, func(i int) {
+		if _, err := started[i].kademlia.Join(ctx, seeds[i]); err != nil {
+			simulation.mutex.Lock()
+			failed++
+			simulation.mutex.Unlock()
+		}
+	})
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	simulation.nodes = append(simulation.nodes, started...)
+	simulation.report.Joined += n - failed
+	simulation.report.FailedJoins += failed
+	return nil
+}
+
+// CheckDurability fetches every stored value once from a random node and counts the ones still found
+func (simulation *Simulation) CheckDurability(ctx context.Context) {
+	keys := simulation.storedKeys()
+	if len(keys) == 0 || simulation.NodeCount() == 0 {
+		return
+	}
+	from := make([]*node, len(keys))
+	for i := range from {
+		from[i] = simulation.randomNode()
+	}
+	var durable int
+	simulation.parallel(len(keys), func(i int) {
+		if found, _ := simulation.get(ctx, from[i], keys[i]); found {
+			simulation.mutex.Lock()
+			durable++
+			simulation.mutex.Unlock()
+		}
+	})
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	simulation.report.Checked = len(keys)
+	simulation.report.Durable = durable
+}
+
+// get fetches the value with the key from the node
+func (simulation *Simulation) get(ctx context.Context, from *node, key string) (bool, kademlia.LookupStats) {
+	_, result, err := from.kademlia.Get(ctx, *kademlia.NewKademliaID(key))
+	return err == nil, result.Lookup
+}
+
+// startNode starts a node on the next free host, it does not join the network yet
+func (simulation *Simulation) startNode() (*node, error) {
+	simulation.mutex.Lock()
+	host := simulation.nextHost
+	simulation.nextHost++
+	id := kademlia.KademliaID{}
+	simulation.random.Read(id[:])
+	simulation.mutex.Unlock()
+
+	address := fmt.Sprintf("10.%d.%d.%d:%d", host>>16&0xff, host>>8&0xff, host&0xff, nodePort)
+	conn, err := simulation.Network.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	table := kademlia.NewRoutingTableWithBucketSize(kademlia.NewContact(&id, address), simulation.options.K)
+	k := kademlia.NewKademliaWithTransport(table, conn)
+	k.K = simulation.options.K
+	k.Alpha = simulation.options.Alpha
+	k.Network.Timeout = simulation.options.Timeout
+	k.Network.Retries = simulation.options.Retries
+	if simulation.options.Unsigned {
+		k.Network.SigningKey = nil
+		k.Network.RequireSignatures = false
+	}
+	if err := k.Start(context.Background()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &node{kademlia: k}, nil
+}
+
+// seeds returns the first running nodes
+func (simulation *Simulation) seeds() []kademlia.Contact {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	var seeds []kademlia.Contact
+	for _, node := range simulation.nodes[:min(seedCount, len(simulation.nodes))] {
+		seeds = append(seeds, node.kademlia.RoutingTable.Me)
+	}
+	return seeds
+}
+
+// closestNode returns the ID of the running node closest to the target
+func (simulation *Simulation) closestNode(target *kademlia.KademliaID) *kademlia.KademliaID {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	var closest *kademlia.KademliaID
+	for _, node := range simulation.nodes {
+		id := node.kademlia.RoutingTable.Me.ID
+		if closest == nil || id.CalcDistance(target).Less(closest.CalcDistance(target)) {
+			closest = id
+		}
+	}
+	return closest
+}
+
+// storedKeys returns the keys stored by the put step in a fixed order
+func (simulation *Simulation) storedKeys() []string {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	keys := make([]string, 0, len(simulation.values))
+	for key := range simulation.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// randomNode returns a random running node
+func (simulation *Simulation) randomNode() *node {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	return simulation.nodes[simulation.random.Intn(len(simulation.nodes))]
+}
+
+func (simulation *Simulation) randomBytes(n int) []byte {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	data := make([]byte, n)
+	simulation.random.Read(data)
+	return data
+}
+
+func (simulation *Simulation) intn(n int) int {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	return simulation.random.Intn(n)
+}
+
+// parallel calls work for 0 to n-1 with at most Concurrency calls running at the same time
+func (simulation *Simulation) parallel(n int, work func(i int)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, simulation.options.Concurrency)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			work(i)
+		}(i)
+	}
+	wg.Wait()
+}
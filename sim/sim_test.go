@@ -0,0 +1,126 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"d7024e/kademlia"
+)
+
+// smallOptions returns the options of a simulation small enough for a unit test
+func smallOptions() Options {
+	options := Default()
+	options.Nodes = 100
+	options.Puts = 10
+	options.Gets = 10
+	options.Lookups = 20
+	options.Unsigned = true
+	return options
+}
+
+func TestRun_JoinsNodesAndFindsClosestNodes(t *testing.T) {
+	report, err := New(smallOptions()).Run(context.Background(), []string{"join", "lookup", "put"})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.Nodes != 100 || report.Joined != 100 || report.FailedJoins != 0 {
+		t.Errorf("Expected 100 joined nodes, got %+v", report)
+	}
+	if report.Lookups.Count != 20 || report.Lookups.SuccessRate() < 0.9 {
+		t.Errorf("Expected lookups to find the closest node, got %d of %d", report.Lookups.Succeeded, report.Lookups.Count)
+	}
+	if report.Lookups.MeanHops() < 1 || report.Lookups.MeanRPCs() < report.Lookups.MeanHops() {
+		t.Errorf("Expected hop and RPC counts, got %.2f hops and %.2f RPCs", report.Lookups.MeanHops(), report.Lookups.MeanRPCs())
+	}
+	if report.Puts.Succeeded != 10 {
+		t.Errorf("Expected every PUT to be stored, got %d of 10", report.Puts.Succeeded)
+	}
+}
+
+func TestRun_ChurnReplacesNodes(t *testing.T) {
+	options := smallOptions()
+	options.Churn = 0.2
+
+	report, err := New(options).Run(context.Background(), []string{"join", "put", "churn", "check"})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.Nodes != 100 || report.Left != 20 || report.Joined != 120 {
+		t.Errorf("Expected 20 nodes to be replaced, got %+v", report)
+	}
+	if report.Checked != 10 {
+		t.Errorf("Expected the 10 stored values to be checked, got %d", report.Checked)
+	}
+}
+
+func TestRun_StopsEveryNode(t *testing.T) {
+	options := smallOptions()
+	options.Nodes = 10
+	simulation := New(options)
+
+	if _, err := simulation.Run(context.Background(), []string{"join"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if simulation.NodeCount() != 0 {
+		t.Errorf("Expected no running nodes, got %d", simulation.NodeCount())
+	}
+	if conn, err := simulation.Network.Listen("10.0.0.0:8000"); err != nil {
+		t.Errorf("Expected the socket of the stopped node to be closed, got %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestChurn_StopsTheReplacedNodes(t *testing.T) {
+	options := smallOptions()
+	options.Nodes = 10
+	simulation := New(options)
+	defer simulation.Stop()
+	if err := simulation.JoinStorm(context.Background(), options.Nodes); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	before := append([]*node{}, simulation.nodes...)
+
+	if err := simulation.Churn(context.Background(), 3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	stopped := 0
+	for _, node := range before {
+		if err := node.kademlia.Start(context.Background()); errors.Is(err, kademlia.ErrStopped) {
+			stopped++
+		}
+	}
+	if stopped != 3 {
+		t.Errorf("Expected the 3 replaced nodes to be stopped, %d are", stopped)
+	}
+}
+
+func TestRun_RejectsUnknownStep(t *testing.T) {
+	_, err := New(smallOptions()).Run(context.Background(), []string{"dance"})
+
+	if !errors.Is(err, ErrUnknownStep) {
+		t.Fatalf("Expected ErrUnknownStep, got %v", err)
+	}
+}
+
+func TestReport_Print(t *testing.T) {
+	report := Report{Nodes: 2, Checked: 4, Durable: 3}
+	report.Gets.add(kademlia.LookupStats{Rounds: 2, RPCs: 6}, true)
+	report.Gets.add(kademlia.LookupStats{Rounds: 4, RPCs: 10}, false)
+	var out bytes.Buffer
+
+	report.Print(&out)
+
+	for _, want := range []string{"get             2    50.0%       3.00          4       8.00", "3 of 4 values found (75.0%)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the report, got:\n%s", want, out.String())
+		}
+	}
+}